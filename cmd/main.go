@@ -1,26 +1,209 @@
 package main
 
 import (
+	"balance/pkg/config"
+	"balance/pkg/exchange"
+	"balance/pkg/migrations"
 	"balance/pkg/repository"
 	"balance/pkg/server"
 	"balance/pkg/service"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitInvalidUsage = 2
 )
 
 func main() {
-	postgres := repository.New()
-	err := postgres.Open()
+	os.Exit(run())
+}
+
+//run returns process exit code, so deferred cleanups are executed before exit
+func run() int {
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		fmt.Printf("Error loading configuration: %v\n", err)
+		return exitInvalidUsage
+	}
+	log.Printf("effective configuration: %s", cfg)
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if len(args) != 0 {
+		if args[0] != "migrate" {
+			fmt.Printf("Unknown command %q\n%s\n", args[0], migrateUsage)
+			return exitInvalidUsage
+		}
+		return runMigrate(signals, cfg, args[1:])
+	}
+
+	if cfg.Database.MigrateOnStart && cfg.Database.Driver != config.DriverMemory {
+		err = withMigrator(cfg.Database, func(migrator *migrations.Migrator) error {
+			return migrateUp(signals, migrator)
+		})
+		if err != nil {
+			fmt.Printf("Error migrating database: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	repo := newRepository(cfg.Database)
+	err = repo.Open()
 	if err != nil {
 		fmt.Printf("Error opening database: %v\n", err)
-		return
+		return exitFailure
+	}
+
+	rates, err := newExchangeRateProvider(cfg.Exchange)
+	if err != nil {
+		fmt.Printf("Error creating exchange rate provider: %v\n", err)
+		repo.Close()
+		return exitFailure
+	}
+
+	service := service.New(repo, rates, cfg.Service)
+
+	//background workers are stopped before database is closed
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	workers := &sync.WaitGroup{}
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		purgeIdempotencyKeys(workersCtx, service, cfg.Service.IdempotencyKeyTTL)
+	}()
+	go func() {
+		defer workers.Done()
+		expireReservations(workersCtx, service, cfg.Service.ReservationExpiryInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		executeSchedules(workersCtx, service, cfg.Service.ScheduleInterval)
+	}()
+
+	server := server.New(service, cfg.Server)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+
+	code := exitOK
+	select {
+	case err := <-serverErr:
+		log.Printf("server stopped: %v", err)
+		code = exitFailure
+	case <-signals.Done():
+		log.Printf("shutting down, waiting up to %s for in-flight requests", cfg.Server.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("requests were not drained in time: %v", err)
+			code = exitFailure
+		}
 	}
-	defer postgres.Close()
 
-	service := service.New(postgres)
+	stopWorkers()
+	workers.Wait()
+
+	//database is closed last, when no handler can use it anymore
+	if err := repo.Close(); err != nil {
+		log.Printf("error closing database: %v", err)
+		code = exitFailure
+	}
+	return code
+}
+
+func newRepository(cfg config.Database) service.Repository {
+	switch cfg.Driver {
+	case config.DriverPgxPool:
+		return repository.NewPool(cfg)
+	case config.DriverMemory:
+		return repository.NewMemory()
+	}
+	return repository.New(cfg)
+}
+
+func newExchangeRateProvider(cfg config.Exchange) (service.ExchangeRateProvider, error) {
+	if cfg.Provider == config.ProviderStatic {
+		return exchange.LoadStatic(cfg.RatesFile)
+	}
+	return exchange.NewHTTP(cfg), nil
+}
+
+//purgeIdempotencyKeys deletes expired idempotency keys until ctx is canceled,
+//keys are checked at least hourly, so they do not outlive ttl much
+func purgeIdempotencyKeys(ctx context.Context, service *service.BalanceService, ttl time.Duration) {
+	interval := time.Hour
+	if ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := service.PurgeIdempotencyKeys(ctx); err != nil {
+				log.Printf("purging expired idempotency keys: %v", err)
+			}
+		}
+	}
+}
+
+//expireReservations returns money of expired reservations to users every interval until ctx is canceled
+func expireReservations(ctx context.Context, service *service.BalanceService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := service.ExpireReservations(ctx)
+			if expired != 0 {
+				log.Printf("released %d expired reservations", expired)
+			}
+			if err != nil {
+				log.Printf("releasing expired reservations: %v", err)
+			}
+		}
+	}
+}
+
+//executeSchedules makes due scheduled transfers every interval until ctx is canceled
+func executeSchedules(ctx context.Context, service *service.BalanceService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	server := server.New(service)
-	if err := server.Start(1323); err != nil {
-		log.Fatal("failed to start server")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			executed, err := service.ExecuteDueSchedules(ctx)
+			if executed != 0 {
+				log.Printf("executed %d scheduled transfers", executed)
+			}
+			if err != nil {
+				log.Printf("executing scheduled transfers: %v", err)
+			}
+		}
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"balance/pkg/config"
+	"balance/pkg/migrations"
+	"balance/pkg/repository"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const migrateUsage = "usage: balance [flags] migrate up|down [steps]|status"
+
+//runMigrate executes migrate subcommand, by default down reverts only the last migration
+func runMigrate(ctx context.Context, cfg *config.Config, args []string) int {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		fmt.Println(migrateUsage)
+		return exitInvalidUsage
+	}
+
+	var command func(migrator *migrations.Migrator) error
+	switch args[0] {
+	case "up":
+		command = func(migrator *migrations.Migrator) error {
+			return migrateUp(ctx, migrator)
+		}
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				fmt.Println(migrateUsage)
+				return exitInvalidUsage
+			}
+		}
+		command = func(migrator *migrations.Migrator) error {
+			reverted, err := migrator.Down(ctx, steps)
+			for _, migration := range reverted {
+				log.Printf("reverted migration %d_%s", migration.Version, migration.Name)
+			}
+			return err
+		}
+	case "status":
+		command = func(migrator *migrations.Migrator) error {
+			statuses, err := migrator.Status(ctx)
+			for _, status := range statuses {
+				applied := "pending"
+				if status.AppliedAt != nil {
+					applied = "applied at " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+				}
+				fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+			}
+			return err
+		}
+	default:
+		fmt.Println(migrateUsage)
+		return exitInvalidUsage
+	}
+
+	if err := withMigrator(cfg.Database, command); err != nil {
+		fmt.Printf("Error migrating database: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+//withMigrator opens separate database/sql connection for migrations, whatever driver service uses
+func withMigrator(cfg config.Database, fn func(migrator *migrations.Migrator) error) error {
+	postgres := repository.New(cfg)
+	if err := postgres.Open(); err != nil {
+		return err
+	}
+	defer postgres.Close()
+
+	migrator, err := migrations.New(postgres.DB())
+	if err != nil {
+		return err
+	}
+	return fn(migrator)
+}
+
+func migrateUp(ctx context.Context, migrator *migrations.Migrator) error {
+	applied, err := migrator.Up(ctx)
+	for _, migration := range applied {
+		log.Printf("applied migration %d_%s", migration.Version, migration.Name)
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+//Secret is a string which is never printed as is, so effective configuration
+//can be logged without leaking passwords and keys
+type Secret string
+
+func (secret Secret) String() string {
+	if secret == "" {
+		return ""
+	}
+	return "******"
+}
+
+type Config struct {
+	Server   Server   `yaml:"server" toml:"server"`
+	Database Database `yaml:"database" toml:"database"`
+	Exchange Exchange `yaml:"exchange" toml:"exchange"`
+	Service  Service  `yaml:"service" toml:"service"`
+}
+
+type Server struct {
+	Port int `yaml:"port" toml:"port"`
+	//time given to in-flight requests to finish after shutdown signal
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+const (
+	//database/sql over pgx driver
+	DriverSQL = "sql"
+	//native pgx connection pool
+	DriverPgxPool = "pgxpool"
+	//data is kept in process memory and lost on exit, for local runs
+	DriverMemory = "memory"
+)
+
+type Database struct {
+	Driver   string `yaml:"driver" toml:"driver"`
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password Secret `yaml:"password" toml:"password"`
+	Name     string `yaml:"name" toml:"name"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode"`
+	//apply pending schema migrations before serving requests
+	MigrateOnStart bool `yaml:"migrate_on_start" toml:"migrate_on_start"`
+
+	MaxConns        int           `yaml:"max_conns" toml:"max_conns"`
+	MaxConnLifetime time.Duration `yaml:"max_conn_lifetime" toml:"max_conn_lifetime"`
+	MaxConnIdleTime time.Duration `yaml:"max_conn_idle_time" toml:"max_conn_idle_time"`
+	//settings below are used only by pgxpool driver
+	MinConns               int           `yaml:"min_conns" toml:"min_conns"`
+	HealthCheckPeriod      time.Duration `yaml:"health_check_period" toml:"health_check_period"`
+	StatementCacheCapacity int           `yaml:"statement_cache_capacity" toml:"statement_cache_capacity"`
+	//prepare or describe, see pgconn/stmtcache
+	StatementCacheMode string `yaml:"statement_cache_mode" toml:"statement_cache_mode"`
+}
+
+const (
+	//rates are requested from currconv compatible HTTP API
+	ProviderHTTP = "http"
+	//rates are read once from JSON file
+	ProviderStatic = "static"
+)
+
+type Exchange struct {
+	Provider string        `yaml:"provider" toml:"provider"`
+	URL      string        `yaml:"url" toml:"url"`
+	APIKey   Secret        `yaml:"api_key" toml:"api_key"`
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout"`
+	//JSON object with rates like {"RUB_USD": 0.0135}, used by static provider
+	RatesFile string `yaml:"rates_file" toml:"rates_file"`
+}
+
+//Service holds limits for balance operations, each timeout covers the whole operation
+//including database queries and currency conversion
+type Service struct {
+	BalanceTimeout  time.Duration `yaml:"balance_timeout" toml:"balance_timeout"`
+	HistoryTimeout  time.Duration `yaml:"history_timeout" toml:"history_timeout"`
+	ChangeTimeout   time.Duration `yaml:"change_timeout" toml:"change_timeout"`
+	TransferTimeout time.Duration `yaml:"transfer_timeout" toml:"transfer_timeout"`
+
+	//batch transfer with more items is rejected, the whole batch runs in one transaction
+	MaxBatchSize int `yaml:"max_batch_size" toml:"max_batch_size"`
+
+	//exchange rate younger than TTL is used as is, older one is still used but refreshed in background
+	RateCacheTTL time.Duration `yaml:"rate_cache_ttl" toml:"rate_cache_ttl"`
+	//exchange rate older than this is never used, conversion fails if it can't be refreshed
+	RateMaxStaleness time.Duration `yaml:"rate_max_staleness" toml:"rate_max_staleness"`
+
+	//outcome of operation is replayed for requests with the same idempotency key during this window
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl" toml:"idempotency_key_ttl"`
+
+	//transaction failed by deadlock or serialization failure is run again this many times,
+	//waiting random time up to base delay doubled on every retry, but not more than max delay
+	TxRetries        int           `yaml:"tx_retries" toml:"tx_retries"`
+	TxRetryBaseDelay time.Duration `yaml:"tx_retry_base_delay" toml:"tx_retry_base_delay"`
+	TxRetryMaxDelay  time.Duration `yaml:"tx_retry_max_delay" toml:"tx_retry_max_delay"`
+
+	//reservation without ttl given by caller is held this long, longer ttl is rejected
+	ReservationTTL    time.Duration `yaml:"reservation_ttl" toml:"reservation_ttl"`
+	ReservationMaxTTL time.Duration `yaml:"reservation_max_ttl" toml:"reservation_max_ttl"`
+	//expired reservations are released this often
+	ReservationExpiryInterval time.Duration `yaml:"reservation_expiry_interval" toml:"reservation_expiry_interval"`
+
+	//due scheduled transfers are executed this often
+	ScheduleInterval time.Duration `yaml:"schedule_interval" toml:"schedule_interval"`
+}
+
+//Default returns configuration used when no other source overrides a value
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:            1323,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Database: Database{
+			Driver:  DriverSQL,
+			Host:    "localhost",
+			Port:    8080,
+			User:    "postgres",
+			Name:    "postgres",
+			SSLMode: "disable",
+
+			MaxConns:               10,
+			MaxConnLifetime:        time.Hour,
+			MaxConnIdleTime:        30 * time.Minute,
+			HealthCheckPeriod:      time.Minute,
+			StatementCacheCapacity: 512,
+			StatementCacheMode:     "prepare",
+		},
+		Exchange: Exchange{
+			Provider: ProviderHTTP,
+			URL:      "https://free.currconv.com/api/v7/convert",
+			Timeout:  3 * time.Second,
+		},
+		Service: Service{
+			BalanceTimeout:  5 * time.Second,
+			HistoryTimeout:  10 * time.Second,
+			ChangeTimeout:   5 * time.Second,
+			TransferTimeout: 5 * time.Second,
+
+			MaxBatchSize: 100,
+
+			RateCacheTTL:     10 * time.Minute,
+			RateMaxStaleness: 24 * time.Hour,
+
+			IdempotencyKeyTTL: 24 * time.Hour,
+
+			TxRetries:        3,
+			TxRetryBaseDelay: 10 * time.Millisecond,
+			TxRetryMaxDelay:  200 * time.Millisecond,
+
+			ReservationTTL:            72 * time.Hour,
+			ReservationMaxTTL:         30 * 24 * time.Hour,
+			ReservationExpiryInterval: time.Minute,
+
+			ScheduleInterval: time.Minute,
+		},
+	}
+}
+
+//DSN builds connection string for pgx driver
+func (db Database) DSN() string {
+	dsn := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(db.User, string(db.Password)),
+		Host:   db.Host + ":" + strconv.Itoa(db.Port),
+		Path:   "/" + db.Name,
+	}
+	if db.SSLMode != "" {
+		dsn.RawQuery = url.Values{"sslmode": {db.SSLMode}}.Encode()
+	}
+	return dsn.String()
+}
+
+//Validate checks all values and reports every problem at once
+func (cfg *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(validPort(cfg.Server.Port), "server port %d is out of range", cfg.Server.Port)
+	check(cfg.Server.ShutdownTimeout > 0, "server shutdown timeout must be positive")
+
+	switch cfg.Database.Driver {
+	case DriverSQL, DriverPgxPool, DriverMemory:
+	default:
+		check(false, "unknown database driver %q", cfg.Database.Driver)
+	}
+	check(cfg.Database.Host != "", "database host is empty")
+	check(validPort(cfg.Database.Port), "database port %d is out of range", cfg.Database.Port)
+	check(cfg.Database.User != "", "database user is empty")
+	check(cfg.Database.Name != "", "database name is empty")
+	switch cfg.Database.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "unknown database sslmode %q", cfg.Database.SSLMode)
+	}
+
+	//background workers hold a connection while they run, requests must not wait for them
+	check(cfg.Database.MaxConns >= 2, "database max conns must be at least 2")
+	check(cfg.Database.MinConns >= 0 && cfg.Database.MinConns <= cfg.Database.MaxConns, "database min conns must be between 0 and max conns")
+	check(cfg.Database.MaxConnLifetime >= 0 && cfg.Database.MaxConnIdleTime >= 0, "database connection lifetimes must not be negative")
+	check(cfg.Database.HealthCheckPeriod > 0, "database health check period must be positive")
+	check(cfg.Database.StatementCacheCapacity >= 0, "database statement cache capacity must not be negative")
+	check(cfg.Database.StatementCacheMode == "prepare" || cfg.Database.StatementCacheMode == "describe",
+		"unknown database statement cache mode %q", cfg.Database.StatementCacheMode)
+
+	switch cfg.Exchange.Provider {
+	case ProviderHTTP:
+		exchangeURL, err := url.Parse(cfg.Exchange.URL)
+		check(err == nil && exchangeURL.Scheme != "" && exchangeURL.Host != "", "exchange url %q is not absolute", cfg.Exchange.URL)
+		check(cfg.Exchange.Timeout > 0, "exchange timeout must be positive")
+	case ProviderStatic:
+		check(cfg.Exchange.RatesFile != "", "exchange rates file is required for static provider")
+	default:
+		check(false, "unknown exchange provider %q", cfg.Exchange.Provider)
+	}
+
+	check(cfg.Service.BalanceTimeout > 0, "service balance timeout must be positive")
+	check(cfg.Service.HistoryTimeout > 0, "service history timeout must be positive")
+	check(cfg.Service.ChangeTimeout > 0, "service change timeout must be positive")
+	check(cfg.Service.TransferTimeout > 0, "service transfer timeout must be positive")
+	check(cfg.Service.MaxBatchSize > 0, "max batch size must be positive")
+	check(cfg.Service.RateCacheTTL > 0, "exchange rate cache ttl must be positive")
+	check(cfg.Service.RateMaxStaleness >= cfg.Service.RateCacheTTL, "exchange rate max staleness must not be less than cache ttl")
+	check(cfg.Service.IdempotencyKeyTTL > 0, "idempotency key ttl must be positive")
+	check(cfg.Service.TxRetries >= 0, "transaction retries must not be negative")
+	check(cfg.Service.TxRetryBaseDelay > 0, "transaction retry base delay must be positive")
+	check(cfg.Service.TxRetryMaxDelay >= cfg.Service.TxRetryBaseDelay, "transaction retry max delay must not be less than base delay")
+	check(cfg.Service.ReservationTTL > 0, "reservation ttl must be positive")
+	check(cfg.Service.ReservationMaxTTL >= cfg.Service.ReservationTTL, "reservation max ttl must not be less than ttl")
+	check(cfg.Service.ReservationExpiryInterval > 0, "reservation expiry interval must be positive")
+	check(cfg.Service.ScheduleInterval > 0, "schedule interval must be positive")
+
+	if len(problems) != 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//String returns effective configuration with secrets redacted
+func (cfg *Config) String() string {
+	//plain type has no String method, so fmt prints fields instead of recursing
+	type plain Config
+	return fmt.Sprintf("%+v", plain(*cfg))
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	"balance/pkg/config"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Load(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(yamlPath, []byte("server:\n  port: 2000\n  shutdown_timeout: 30s\ndatabase:\n  host: db.yaml\n  password: yamlsecret\n"), 0600)
+	tomlPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(tomlPath, []byte("[server]\nport = 3000\nshutdown_timeout = \"1m\"\n[database]\nhost = \"db.toml\"\n"), 0600)
+
+	var tests = []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		expectedPort int
+		expectedHost string
+		expectedErr  error
+	}{
+		{name: "defaults", expectedPort: 1323, expectedHost: "localhost"},
+		{name: "yaml file", args: []string{"-config", yamlPath}, expectedPort: 2000, expectedHost: "db.yaml"},
+		{name: "toml file from env", env: map[string]string{"BALANCE_CONFIG": tomlPath}, expectedPort: 3000, expectedHost: "db.toml"},
+		{name: "env overrides file", args: []string{"-config", yamlPath}, env: map[string]string{"BALANCE_PORT": "4000"}, expectedPort: 4000, expectedHost: "db.yaml"},
+		{name: "flag overrides env", args: []string{"-config", yamlPath, "-port", "5000"}, env: map[string]string{"BALANCE_PORT": "4000"}, expectedPort: 5000, expectedHost: "db.yaml"},
+
+		{name: "invalid port", args: []string{"-port", "70000"}, expectedErr: config.ErrInvalidConfig},
+		{name: "invalid duration", args: []string{"-shutdown-timeout", "10"}, expectedErr: config.ErrInvalidConfig},
+		{name: "not a number", env: map[string]string{"BALANCE_DB_PORT": "abc"}, expectedErr: config.ErrInvalidConfig},
+		{name: "staleness less than ttl", args: []string{"-rate-cache-ttl", "1h", "-rate-max-staleness", "1m"}, expectedErr: config.ErrInvalidConfig},
+		{name: "zero idempotency key ttl", args: []string{"-idempotency-key-ttl", "0s"}, expectedErr: config.ErrInvalidConfig},
+		{name: "single database connection", args: []string{"-db-max-conns", "1", "-db-min-conns", "0"}, expectedErr: config.ErrInvalidConfig},
+		{name: "zero max batch size", args: []string{"-max-batch-size", "0"}, expectedErr: config.ErrInvalidConfig},
+		{name: "zero schedule interval", args: []string{"-schedule-interval", "0s"}, expectedErr: config.ErrInvalidConfig},
+		{name: "negative transaction retries", args: []string{"-tx-retries", "-1"}, expectedErr: config.ErrInvalidConfig},
+		{name: "retry max delay less than base", args: []string{"-tx-retry-base-delay", "1s", "-tx-retry-max-delay", "10ms"}, expectedErr: config.ErrInvalidConfig},
+		{name: "reservation max ttl less than ttl", args: []string{"-reservation-ttl", "48h", "-reservation-max-ttl", "24h"}, expectedErr: config.ErrInvalidConfig},
+		{name: "unsupported file", args: []string{"-config", "config.ini"}, expectedErr: config.ErrInvalidConfig},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, _, err := config.Load(test.args)
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr), "unexpected error %v", err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedPort, cfg.Server.Port)
+				assert.Equal(t, test.expectedHost, cfg.Database.Host)
+			}
+		})
+	}
+}
+
+func TestConfig_LoadSubcommand(t *testing.T) {
+	cfg, args, err := config.Load([]string{"-db-host", "db", "migrate", "down", "2"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "db", cfg.Database.Host)
+		assert.Equal(t, []string{"migrate", "down", "2"}, args)
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.Password = "dbsecret"
+	cfg.Exchange.APIKey = "apisecret"
+
+	printed := cfg.String()
+	assert.False(t, strings.Contains(printed, "dbsecret"))
+	assert.False(t, strings.Contains(printed, "apisecret"))
+	assert.True(t, strings.Contains(printed, "localhost"))
+	assert.True(t, strings.Contains(cfg.Database.DSN(), "dbsecret"))
+}
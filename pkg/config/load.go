@@ -0,0 +1,182 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix  = "BALANCE_"
+	configFlag = "config"
+)
+
+//option describes one setting which can be overridden by flag and environment variable.
+//Environment variable name is derived from flag name: db-host -> BALANCE_DB_HOST
+type option struct {
+	name   string
+	usage  string
+	target func(cfg *Config) interface{}
+}
+
+var options = []option{
+	{"port", "port for REST API server", func(cfg *Config) interface{} { return &cfg.Server.Port }},
+	{"shutdown-timeout", "time to drain in-flight requests on shutdown", func(cfg *Config) interface{} { return &cfg.Server.ShutdownTimeout }},
+
+	{"db-driver", "database driver: sql, pgxpool or memory", func(cfg *Config) interface{} { return &cfg.Database.Driver }},
+	{"db-host", "database host", func(cfg *Config) interface{} { return &cfg.Database.Host }},
+	{"db-port", "database port", func(cfg *Config) interface{} { return &cfg.Database.Port }},
+	{"db-user", "database user", func(cfg *Config) interface{} { return &cfg.Database.User }},
+	{"db-password", "database password", func(cfg *Config) interface{} { return &cfg.Database.Password }},
+	{"db-name", "database name", func(cfg *Config) interface{} { return &cfg.Database.Name }},
+	{"db-sslmode", "database sslmode", func(cfg *Config) interface{} { return &cfg.Database.SSLMode }},
+	{"db-max-conns", "maximum number of database connections", func(cfg *Config) interface{} { return &cfg.Database.MaxConns }},
+	{"db-min-conns", "minimum number of database connections (pgxpool)", func(cfg *Config) interface{} { return &cfg.Database.MinConns }},
+	{"db-max-conn-lifetime", "time after which connection is closed", func(cfg *Config) interface{} { return &cfg.Database.MaxConnLifetime }},
+	{"db-max-conn-idle-time", "time after which idle connection is closed", func(cfg *Config) interface{} { return &cfg.Database.MaxConnIdleTime }},
+	{"db-health-check-period", "period of idle connections check (pgxpool)", func(cfg *Config) interface{} { return &cfg.Database.HealthCheckPeriod }},
+	{"db-statement-cache-capacity", "prepared statements cached per connection (pgxpool)", func(cfg *Config) interface{} { return &cfg.Database.StatementCacheCapacity }},
+	{"db-statement-cache-mode", "statement cache mode: prepare or describe (pgxpool)", func(cfg *Config) interface{} { return &cfg.Database.StatementCacheMode }},
+	{"migrate-on-start", "apply pending migrations on startup", func(cfg *Config) interface{} { return &cfg.Database.MigrateOnStart }},
+
+	{"exchange-provider", "exchange rates provider: http or static", func(cfg *Config) interface{} { return &cfg.Exchange.Provider }},
+	{"exchange-url", "exchange rates API url", func(cfg *Config) interface{} { return &cfg.Exchange.URL }},
+	{"exchange-api-key", "exchange rates API key", func(cfg *Config) interface{} { return &cfg.Exchange.APIKey }},
+	{"exchange-timeout", "timeout of exchange rates API request", func(cfg *Config) interface{} { return &cfg.Exchange.Timeout }},
+	{"exchange-rates-file", "JSON file with exchange rates for static provider", func(cfg *Config) interface{} { return &cfg.Exchange.RatesFile }},
+
+	{"balance-timeout", "timeout for getting balance", func(cfg *Config) interface{} { return &cfg.Service.BalanceTimeout }},
+	{"history-timeout", "timeout for getting history", func(cfg *Config) interface{} { return &cfg.Service.HistoryTimeout }},
+	{"change-timeout", "timeout for changing balance", func(cfg *Config) interface{} { return &cfg.Service.ChangeTimeout }},
+	{"transfer-timeout", "timeout for transferring money", func(cfg *Config) interface{} { return &cfg.Service.TransferTimeout }},
+	{"max-batch-size", "most transfers in one batch", func(cfg *Config) interface{} { return &cfg.Service.MaxBatchSize }},
+	{"rate-cache-ttl", "time exchange rate is used without refreshing", func(cfg *Config) interface{} { return &cfg.Service.RateCacheTTL }},
+	{"rate-max-staleness", "time after which exchange rate that failed to refresh is not used", func(cfg *Config) interface{} { return &cfg.Service.RateMaxStaleness }},
+	{"idempotency-key-ttl", "time operation outcome is replayed for repeated idempotency key", func(cfg *Config) interface{} { return &cfg.Service.IdempotencyKeyTTL }},
+	{"tx-retries", "times transaction failed by deadlock or serialization failure is retried", func(cfg *Config) interface{} { return &cfg.Service.TxRetries }},
+	{"tx-retry-base-delay", "maximum delay before first transaction retry, doubled for every next one", func(cfg *Config) interface{} { return &cfg.Service.TxRetryBaseDelay }},
+	{"tx-retry-max-delay", "upper bound of delay between transaction retries", func(cfg *Config) interface{} { return &cfg.Service.TxRetryMaxDelay }},
+	{"reservation-ttl", "time reservation is held if caller gives no ttl", func(cfg *Config) interface{} { return &cfg.Service.ReservationTTL }},
+	{"reservation-max-ttl", "longest time reservation can be held", func(cfg *Config) interface{} { return &cfg.Service.ReservationMaxTTL }},
+	{"reservation-expiry-interval", "how often expired reservations are released", func(cfg *Config) interface{} { return &cfg.Service.ReservationExpiryInterval }},
+	{"schedule-interval", "how often due scheduled transfers are executed", func(cfg *Config) interface{} { return &cfg.Service.ScheduleInterval }},
+}
+
+//Load builds configuration from several sources, each next one overrides previous:
+//defaults, config file (YAML or TOML, chosen by extension), environment variables, flags.
+//Config file path is taken from -config flag or BALANCE_CONFIG variable.
+//Arguments left after flags (subcommand) are returned as is
+func Load(args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet("balance", flag.ContinueOnError)
+	configPath := flags.String(configFlag, os.Getenv(envName(configFlag)), "path to YAML or TOML config file")
+	flagValues := make(map[string]*string, len(options))
+	for _, opt := range options {
+		flagValues[opt.name] = flags.String(opt.name, "", fmt.Sprintf("%s (env %s)", opt.usage, envName(opt.name)))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Default()
+
+	if *configPath != "" {
+		if err := loadFile(cfg, *configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, opt := range options {
+		value, ok := os.LookupEnv(envName(opt.name))
+		if !ok {
+			continue
+		}
+		if err := set(opt.target(cfg), value); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, envName(opt.name), err)
+		}
+	}
+
+	//only flags given explicitly override other sources
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == configFlag || flagErr != nil {
+			return
+		}
+		for _, opt := range options {
+			if opt.name == f.Name {
+				if err := set(opt.target(cfg), *flagValues[opt.name]); err != nil {
+					flagErr = fmt.Errorf("%w: -%s: %v", ErrInvalidConfig, opt.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	var unmarshal func(data []byte, v interface{}) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return fmt.Errorf("%w: unsupported config file format %q", ErrInvalidConfig, filepath.Ext(path))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if err := unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%w: parsing %s: %v", ErrInvalidConfig, path, err)
+	}
+	return nil
+}
+
+func set(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *Secret:
+		*target = Secret(value)
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+	case *bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+	case *time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+	default:
+		panic(fmt.Sprintf("config: unsupported option type %T", target))
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
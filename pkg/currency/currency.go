@@ -0,0 +1,78 @@
+package currency
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+)
+
+//Currency describes how amounts are stored: every amount is an integer number of minor units,
+//MinorUnits is the number of decimal digits after major unit (2 for RUB, 0 for JPY, 3 for KWD)
+type Currency struct {
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	MinorUnits int    `json:"minor units"`
+}
+
+var registry = make(map[string]Currency, len(currencies))
+
+func init() {
+	for _, currency := range currencies {
+		registry[currency.Code] = currency
+	}
+}
+
+func Get(code string) (Currency, error) {
+	currency, ok := registry[code]
+	if !ok {
+		return Currency{}, ErrUnknownCurrency
+	}
+	return currency, nil
+}
+
+//All returns every known currency ordered by code
+func All() []Currency {
+	all := make([]Currency, 0, len(registry))
+	for _, currency := range registry {
+		all = append(all, currency)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Code < all[j].Code
+	})
+	return all
+}
+
+//Factor is the number of minor units in one major unit
+func (currency Currency) Factor() int64 {
+	factor := int64(1)
+	for i := 0; i < currency.MinorUnits; i++ {
+		factor *= 10
+	}
+	return factor
+}
+
+//Split divides amount of minor units into major and minor parts, both have sign of amount
+func (currency Currency) Split(amount int64) (int64, int64) {
+	factor := currency.Factor()
+	return amount / factor, amount % factor
+}
+
+//Join is the reverse of Split, ok is false if amount doesn't fit into int64
+func (currency Currency) Join(major int64, minor int64) (int64, bool) {
+	factor := currency.Factor()
+	if minor <= -factor || minor >= factor {
+		return 0, false
+	}
+	if major > math.MaxInt64/factor || major < math.MinInt64/factor {
+		return 0, false
+	}
+	amount := major*factor + minor
+	if minor > 0 && amount < major*factor || minor < 0 && amount > major*factor {
+		return 0, false
+	}
+	return amount, true
+}
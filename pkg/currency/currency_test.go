@@ -0,0 +1,63 @@
+package currency_test
+
+import (
+	"balance/pkg/currency"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrency_Get(t *testing.T) {
+	rub, err := currency.Get("RUB")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rub.MinorUnits)
+
+	_, err = currency.Get("rub")
+	assert.Equal(t, currency.ErrUnknownCurrency, err)
+	_, err = currency.Get("XAU")
+	assert.Equal(t, currency.ErrUnknownCurrency, err, "precious metals are not money")
+
+	all := currency.All()
+	for i := 1; i < len(all); i++ {
+		assert.Less(t, all[i-1].Code, all[i].Code)
+	}
+}
+
+func TestCurrency_SplitJoin(t *testing.T) {
+	var tests = []struct {
+		code          string
+		amount        int64
+		expectedMajor int64
+		expectedMinor int64
+	}{
+		{code: "RUB", amount: 12345, expectedMajor: 123, expectedMinor: 45},
+		{code: "JPY", amount: 12345, expectedMajor: 12345, expectedMinor: 0},
+		{code: "KWD", amount: 12345, expectedMajor: 12, expectedMinor: 345},
+		{code: "CLF", amount: 12345, expectedMajor: 1, expectedMinor: 2345},
+		{code: "RUB", amount: -150, expectedMajor: -1, expectedMinor: -50},
+		{code: "RUB", amount: math.MaxInt64, expectedMajor: math.MaxInt64 / 100, expectedMinor: 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			units, err := currency.Get(test.code)
+			assert.NoError(t, err)
+			major, minor := units.Split(test.amount)
+			assert.Equal(t, test.expectedMajor, major)
+			assert.Equal(t, test.expectedMinor, minor)
+
+			amount, ok := units.Join(major, minor)
+			assert.True(t, ok)
+			assert.Equal(t, test.amount, amount)
+		})
+	}
+
+	rub, _ := currency.Get("RUB")
+	_, ok := rub.Join(math.MaxInt64/100, 8)
+	assert.False(t, ok, "overflow by minor part")
+	_, ok = rub.Join(math.MaxInt64/100+1, 0)
+	assert.False(t, ok, "overflow by major part")
+	_, ok = rub.Join(1, 100)
+	assert.False(t, ok, "minor part is out of range")
+}
@@ -0,0 +1,16 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownPair     = errors.New("exchange rate for currency pair is unknown")
+	ErrRateUnavailable = errors.New("exchange rate provider is unavailable")
+)
+
+//pair is the key rates are stored under, in the same form as currconv API uses
+func pair(from string, to string) string {
+	return fmt.Sprintf("%s_%s", from, to)
+}
@@ -0,0 +1,89 @@
+package exchange_test
+
+import (
+	"balance/pkg/config"
+	"balance/pkg/exchange"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP_Rate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apiKey") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case "RUB_USD":
+			w.Write([]byte(`{"RUB_USD":0.0135}`))
+		case "RUB_EUR":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.Default().Exchange
+	cfg.URL = server.URL
+	cfg.APIKey = "key"
+	provider := exchange.NewHTTP(cfg)
+
+	var tests = []struct {
+		name         string
+		to           string
+		expectedRate float64
+		expectedErr  error
+	}{
+		{name: "known pair", to: "USD", expectedRate: 0.0135},
+		{name: "unknown pair", to: "123", expectedErr: exchange.ErrUnknownPair},
+		{name: "bad status", to: "EUR", expectedErr: exchange.ErrRateUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rate, err := provider.Rate(context.Background(), "RUB", test.to)
+			assert.True(t, errors.Is(err, test.expectedErr), "unexpected error %v", err)
+			assert.Equal(t, test.expectedRate, rate)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := provider.Rate(ctx, "RUB", "USD")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestStatic_Rate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"RUB_USD": 0.0125}`), 0o600))
+	provider, err := exchange.LoadStatic(path)
+	require.NoError(t, err)
+
+	rate, err := provider.Rate(context.Background(), "RUB", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0125, rate)
+
+	rate, err = provider.Rate(context.Background(), "USD", "RUB")
+	assert.NoError(t, err)
+	assert.Equal(t, 80.0, rate, "reversed pair is derived from direct one")
+
+	rate, err = provider.Rate(context.Background(), "RUB", "RUB")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, rate)
+
+	_, err = provider.Rate(context.Background(), "RUB", "EUR")
+	assert.Equal(t, exchange.ErrUnknownPair, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"RUBUSD": 0.0125}`), 0o600))
+	_, err = exchange.LoadStatic(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package exchange
+
+import (
+	"context"
+	"sync"
+)
+
+//Fake is provider for tests, rates and failures are set explicitly and calls are counted
+type Fake struct {
+	mu     sync.Mutex
+	rates  map[string]float64
+	errors map[string]error
+	calls  int
+}
+
+func NewFake() *Fake {
+	return &Fake{rates: make(map[string]float64), errors: make(map[string]error)}
+}
+
+func (fake *Fake) Set(from string, to string, rate float64) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.rates[pair(from, to)] = rate
+	delete(fake.errors, pair(from, to))
+}
+
+//Fail makes every next request for pair return err
+func (fake *Fake) Fail(from string, to string, err error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.errors[pair(from, to)] = err
+}
+
+func (fake *Fake) Calls() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.calls
+}
+
+func (fake *Fake) Rate(ctx context.Context, from string, to string) (float64, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.calls++
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err, ok := fake.errors[pair(from, to)]; ok {
+		return 0, err
+	}
+	if rate, ok := fake.rates[pair(from, to)]; ok {
+		return rate, nil
+	}
+	return 0, ErrUnknownPair
+}
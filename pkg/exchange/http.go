@@ -0,0 +1,62 @@
+package exchange
+
+import (
+	"balance/pkg/config"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+//HTTP requests rates from currconv compatible API:
+//GET <url>?q=RUB_USD&compact=ultra&apiKey=<key> returns {"RUB_USD": 0.0135}
+type HTTP struct {
+	client *http.Client
+	cfg    config.Exchange
+}
+
+func NewHTTP(cfg config.Exchange) *HTTP {
+	return &HTTP{client: &http.Client{Timeout: cfg.Timeout}, cfg: cfg}
+}
+
+func (provider *HTTP) Rate(ctx context.Context, from string, to string) (float64, error) {
+	query := url.Values{
+		"q":       {pair(from, to)},
+		"compact": {"ultra"},
+		"apiKey":  {string(provider.cfg.APIKey)},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.cfg.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := provider.client.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("%w: %v", ErrRateUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: status %d", ErrRateUnavailable, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("%w: %v", ErrRateUnavailable, err)
+	}
+
+	//API answers with empty object for unknown currencies
+	rate := gjson.GetBytes(body, pair(from, to))
+	if rate.Type != gjson.Number || rate.Float() <= 0 {
+		return 0, ErrUnknownPair
+	}
+	return rate.Float(), nil
+}
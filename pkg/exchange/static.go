@@ -0,0 +1,50 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//Static serves rates from a fixed table, reversed pairs are derived from direct ones
+type Static struct {
+	rates map[string]float64
+}
+
+//LoadStatic reads JSON object with rates like {"RUB_USD": 0.0135, "RUB_EUR": 0.0119}
+func LoadStatic(path string) (*Static, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading exchange rates file: %w", err)
+	}
+
+	var rates map[string]float64
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("parsing exchange rates file: %w", err)
+	}
+	for key, rate := range rates {
+		if len(strings.Split(key, "_")) != 2 || rate <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q: %v", key, rate)
+		}
+	}
+	return NewStatic(rates), nil
+}
+
+func NewStatic(rates map[string]float64) *Static {
+	return &Static{rates: rates}
+}
+
+func (provider *Static) Rate(ctx context.Context, from string, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := provider.rates[pair(from, to)]; ok {
+		return rate, nil
+	}
+	if rate, ok := provider.rates[pair(to, from)]; ok {
+		return 1 / rate, nil
+	}
+	return 0, ErrUnknownPair
+}
@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations_Embedded(t *testing.T) {
+	migrations, err := load(files)
+	if assert.NoError(t, err) {
+		for i, migration := range migrations {
+			assert.Equal(t, int64(i+1), migration.Version, "versions must be sequential")
+		}
+	}
+}
+
+func TestMigrations_Load(t *testing.T) {
+	file := func(content string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(content)}
+	}
+
+	var tests = []struct {
+		name             string
+		fsys             fstest.MapFS
+		expectedVersions []int64
+		expectedErr      error
+	}{
+		{name: "sorted by version", fsys: fstest.MapFS{
+			"sql/0010_second.up.sql":   file("up"),
+			"sql/0010_second.down.sql": file("down"),
+			"sql/0002_first.up.sql":    file("up"),
+			"sql/0002_first.down.sql":  file("down"),
+		}, expectedVersions: []int64{2, 10}},
+
+		{name: "missing down", fsys: fstest.MapFS{
+			"sql/0001_first.up.sql": file("up"),
+		}, expectedErr: ErrInvalidMigrations},
+		{name: "different names", fsys: fstest.MapFS{
+			"sql/0001_first.up.sql":    file("up"),
+			"sql/0001_another.down.sql": file("down"),
+		}, expectedErr: ErrInvalidMigrations},
+		{name: "unexpected file", fsys: fstest.MapFS{
+			"sql/readme.txt": file("text"),
+		}, expectedErr: ErrInvalidMigrations},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrations, err := load(test.fsys)
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr), "unexpected error %v", err)
+				return
+			}
+			if assert.NoError(t, err) {
+				versions := make([]int64, 0, len(migrations))
+				for _, migration := range migrations {
+					versions = append(versions, migration.Version)
+				}
+				assert.Equal(t, test.expectedVersions, versions)
+			}
+		})
+	}
+}
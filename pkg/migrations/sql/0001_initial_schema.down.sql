@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS UserTransfers;
+DROP TABLE IF EXISTS UserBalance;
@@ -1,11 +1,12 @@
-CREATE TABLE UserBalance (
+-- tables could already be created by database init script before migrations were introduced
+CREATE TABLE IF NOT EXISTS UserBalance (
     id BIGINT NOT NULL,
     balance BIGINT NOT NULL -- balance is stored in pennies (kopeks?) and then converted to roubles
 );
 
-CREATE TABLE UserTransfers (
+CREATE TABLE IF NOT EXISTS UserTransfers (
     id BIGINT NOT NULL,
     amount BIGINT NOT NULL,
     transferred_at TIMESTAMP,
     purpose TEXT
-);
\ No newline at end of file
+);
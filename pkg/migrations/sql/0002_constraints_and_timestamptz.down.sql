@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS usertransfers_id_idx;
+
+ALTER TABLE UserTransfers ALTER COLUMN transferred_at DROP DEFAULT;
+ALTER TABLE UserTransfers ALTER COLUMN transferred_at TYPE TIMESTAMP USING transferred_at AT TIME ZONE 'UTC';
+
+ALTER TABLE UserBalance DROP CONSTRAINT IF EXISTS userbalance_balance_non_negative;
+ALTER TABLE UserBalance DROP CONSTRAINT IF EXISTS userbalance_pkey;
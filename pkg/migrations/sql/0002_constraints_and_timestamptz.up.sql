@@ -0,0 +1,18 @@
+-- without primary key concurrent first creditings could create several rows for one user,
+-- merge them into one row before adding the key
+WITH duplicated AS (
+    DELETE FROM UserBalance
+    WHERE id IN (SELECT id FROM UserBalance GROUP BY id HAVING COUNT(*) > 1)
+    RETURNING id, balance
+)
+INSERT INTO UserBalance (id, balance)
+SELECT id, SUM(balance)::BIGINT FROM duplicated GROUP BY id;
+
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_pkey PRIMARY KEY (id);
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_balance_non_negative CHECK (balance >= 0);
+
+-- service wrote wall clock time of its host without zone, hosts run in UTC
+ALTER TABLE UserTransfers ALTER COLUMN transferred_at TYPE TIMESTAMPTZ USING transferred_at AT TIME ZONE 'UTC';
+ALTER TABLE UserTransfers ALTER COLUMN transferred_at SET DEFAULT now();
+
+CREATE INDEX usertransfers_id_idx ON UserTransfers (id);
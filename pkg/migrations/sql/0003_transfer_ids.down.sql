@@ -0,0 +1,5 @@
+CREATE INDEX IF NOT EXISTS usertransfers_id_idx ON UserTransfers (id);
+DROP INDEX IF EXISTS usertransfers_id_transferred_at_idx;
+
+ALTER TABLE UserTransfers DROP CONSTRAINT IF EXISTS usertransfers_pkey;
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS transfer_id;
@@ -0,0 +1,7 @@
+-- transfers get their own key, it orders transfers made at the same time and makes pagination stable
+ALTER TABLE UserTransfers ADD COLUMN transfer_id BIGSERIAL;
+ALTER TABLE UserTransfers ADD CONSTRAINT usertransfers_pkey PRIMARY KEY (transfer_id);
+
+-- history is read newest first, page by page, so index covers both ordering columns
+CREATE INDEX usertransfers_id_transferred_at_idx ON UserTransfers (id, transferred_at DESC, transfer_id DESC);
+DROP INDEX IF EXISTS usertransfers_id_idx;
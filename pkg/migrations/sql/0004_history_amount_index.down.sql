@@ -0,0 +1 @@
+DROP INDEX IF EXISTS usertransfers_id_amount_idx;
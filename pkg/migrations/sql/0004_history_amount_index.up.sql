@@ -0,0 +1,2 @@
+-- history can be sorted by absolute amount, pages are read by (abs(amount), transfer_id) like by date
+CREATE INDEX usertransfers_id_amount_idx ON UserTransfers (id, abs(amount), transfer_id);
@@ -0,0 +1,4 @@
+ALTER TABLE UserTransfers DROP CONSTRAINT IF EXISTS usertransfers_op_type_check;
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS external_ref;
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS counterparty;
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS op_type;
@@ -0,0 +1,21 @@
+-- operation type and counterparty were kept only inside purpose text
+ALTER TABLE UserTransfers ADD COLUMN op_type TEXT;
+ALTER TABLE UserTransfers ADD COLUMN counterparty BIGINT;
+ALTER TABLE UserTransfers ADD COLUMN external_ref TEXT;
+
+-- service wrote only these purposes, anything else was put by hand and is an adjustment
+UPDATE UserTransfers SET
+    op_type = CASE
+        WHEN purpose = 'External service operation' AND amount >= 0 THEN 'deposit'
+        WHEN purpose = 'External service operation' THEN 'withdrawal'
+        WHEN purpose ~ '^Transferred to [0-9]+$' THEN 'transfer_out'
+        WHEN purpose ~ '^Transferred from [0-9]+$' THEN 'transfer_in'
+        ELSE 'adjustment'
+    END,
+    counterparty = CASE
+        WHEN purpose ~ '^Transferred (to|from) [0-9]+$' THEN substring(purpose FROM '[0-9]+$')::BIGINT
+    END;
+
+ALTER TABLE UserTransfers ALTER COLUMN op_type SET NOT NULL;
+ALTER TABLE UserTransfers ADD CONSTRAINT usertransfers_op_type_check
+    CHECK (op_type IN ('deposit', 'withdrawal', 'transfer_in', 'transfer_out', 'adjustment'));
@@ -0,0 +1 @@
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,2 @@
+-- key/value pairs given by caller, size is limited by service
+ALTER TABLE UserTransfers ADD COLUMN metadata JSONB;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS usertransfers_operation_id_idx;
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS operation_id;
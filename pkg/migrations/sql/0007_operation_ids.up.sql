@@ -0,0 +1,15 @@
+-- every operation gets globally unique id, both legs of transfer share it
+ALTER TABLE UserTransfers ADD COLUMN operation_id UUID;
+UPDATE UserTransfers SET operation_id = gen_random_uuid();
+
+-- legs of old transfers were inserted one after another by the same transaction,
+-- pairs which can't be matched this way keep separate ids
+UPDATE UserTransfers AS recipient SET operation_id = sender.operation_id
+FROM UserTransfers AS sender
+WHERE sender.op_type = 'transfer_out' AND recipient.op_type = 'transfer_in'
+    AND recipient.transfer_id = sender.transfer_id + 1
+    AND recipient.id = sender.counterparty AND recipient.counterparty = sender.id
+    AND recipient.amount = -sender.amount;
+
+ALTER TABLE UserTransfers ALTER COLUMN operation_id SET NOT NULL;
+CREATE INDEX usertransfers_operation_id_idx ON UserTransfers (operation_id);
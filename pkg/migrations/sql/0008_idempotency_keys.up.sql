@@ -0,0 +1,12 @@
+-- outcome of balance change or transfer stored under caller's idempotency key,
+-- row is written by the same transaction as operation itself
+CREATE TABLE IdempotencyKeys (
+    idempotency_key TEXT PRIMARY KEY,
+    -- hash of request parameters, key can't be reused for another request
+    fingerprint TEXT NOT NULL,
+    response JSONB,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- expired keys are deleted periodically
+CREATE INDEX idempotencykeys_created_at_idx ON IdempotencyKeys (created_at);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS Reservations;
+
+ALTER TABLE UserBalance DROP CONSTRAINT IF EXISTS userbalance_reserved_check;
+ALTER TABLE UserBalance DROP COLUMN IF EXISTS reserved;
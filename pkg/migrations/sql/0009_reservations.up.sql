@@ -0,0 +1,24 @@
+-- money held by active reservations, it is part of balance but can't be withdrawn or transferred
+ALTER TABLE UserBalance ADD COLUMN reserved BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_reserved_check CHECK (reserved >= 0 AND reserved <= balance);
+
+CREATE TABLE Reservations (
+    reservation_id UUID PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES UserBalance (id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    -- active until captured, released by caller or expired
+    status TEXT NOT NULL CHECK (status IN ('active', 'captured', 'released', 'expired')),
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    -- part of amount charged by capture and its history operation, the rest is returned to user
+    captured BIGINT NOT NULL DEFAULT 0,
+    operation_id UUID,
+    purpose TEXT,
+    external_ref TEXT,
+    metadata JSONB,
+    CHECK (captured >= 0 AND captured <= amount)
+);
+
+-- expired reservations are released periodically
+CREATE INDEX reservations_expires_at_idx ON Reservations (expires_at) WHERE status = 'active';
@@ -0,0 +1,8 @@
+-- reversals stay in history as adjustments, link to reversed operation is lost
+DROP INDEX IF EXISTS usertransfers_reverses_idx;
+ALTER TABLE UserTransfers DROP CONSTRAINT IF EXISTS usertransfers_reverses_check;
+ALTER TABLE UserTransfers DROP CONSTRAINT IF EXISTS usertransfers_op_type_check;
+UPDATE UserTransfers SET op_type = 'adjustment' WHERE op_type = 'reversal';
+ALTER TABLE UserTransfers ADD CONSTRAINT usertransfers_op_type_check
+    CHECK (op_type IN ('deposit', 'withdrawal', 'transfer_in', 'transfer_out', 'adjustment'));
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS reverses;
@@ -0,0 +1,10 @@
+-- reversal refunds whole or part of earlier operation, its entries reference that operation
+ALTER TABLE UserTransfers ADD COLUMN reverses UUID;
+
+ALTER TABLE UserTransfers DROP CONSTRAINT usertransfers_op_type_check;
+ALTER TABLE UserTransfers ADD CONSTRAINT usertransfers_op_type_check
+    CHECK (op_type IN ('deposit', 'withdrawal', 'transfer_in', 'transfer_out', 'adjustment', 'reversal'));
+ALTER TABLE UserTransfers ADD CONSTRAINT usertransfers_reverses_check CHECK ((op_type = 'reversal') = (reverses IS NOT NULL));
+
+-- refunds of operation are summed up before every new one
+CREATE INDEX usertransfers_reverses_idx ON UserTransfers (reverses) WHERE reverses IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ScheduleRuns;
+DROP TABLE IF EXISTS Schedules;
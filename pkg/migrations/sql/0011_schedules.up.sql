@@ -0,0 +1,39 @@
+-- transfers made by service at given time, once or repeatedly
+CREATE TABLE Schedules (
+    schedule_id UUID PRIMARY KEY,
+    sender_id BIGINT NOT NULL REFERENCES UserBalance (id),
+    recipient_id BIGINT NOT NULL REFERENCES UserBalance (id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    -- NULL for one-time transfer
+    recurrence TEXT CHECK (recurrence IN ('daily', 'weekly', 'monthly')),
+    start_at TIMESTAMPTZ NOT NULL,
+    -- due times already executed, next one is counted from start_at, so monthly runs keep day of month
+    runs INTEGER NOT NULL DEFAULT 0 CHECK (runs >= 0),
+    -- NULL when schedule is not active anymore
+    next_run_at TIMESTAMPTZ,
+    status TEXT NOT NULL CHECK (status IN ('active', 'completed', 'canceled')),
+    created_at TIMESTAMPTZ NOT NULL,
+    canceled_at TIMESTAMPTZ,
+    purpose TEXT,
+    external_ref TEXT,
+    metadata JSONB,
+    CHECK (sender_id <> recipient_id),
+    CHECK ((status = 'active') = (next_run_at IS NOT NULL))
+);
+
+-- workers pick due schedules, users list their own ones
+CREATE INDEX schedules_next_run_at_idx ON Schedules (next_run_at) WHERE status = 'active';
+CREATE INDEX schedules_sender_id_idx ON Schedules (sender_id, created_at);
+
+-- outcome of every due time of schedule, failed run is not retried
+CREATE TABLE ScheduleRuns (
+    run_id BIGSERIAL PRIMARY KEY,
+    schedule_id UUID NOT NULL REFERENCES Schedules (schedule_id),
+    scheduled_at TIMESTAMPTZ NOT NULL,
+    executed_at TIMESTAMPTZ NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('succeeded', 'failed')),
+    operation_id UUID,
+    error TEXT,
+    -- due time is executed once even if several workers see it
+    UNIQUE (schedule_id, scheduled_at)
+);
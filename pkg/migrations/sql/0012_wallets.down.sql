@@ -0,0 +1,22 @@
+-- only wallets in default currency can be kept, other ones and their history are lost
+DELETE FROM UserTransfers WHERE currency <> 'RUB';
+ALTER TABLE UserTransfers DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE Reservations DROP CONSTRAINT IF EXISTS reservations_user_id_fkey;
+ALTER TABLE Schedules DROP CONSTRAINT IF EXISTS schedules_sender_id_fkey;
+ALTER TABLE Schedules DROP CONSTRAINT IF EXISTS schedules_recipient_id_fkey;
+
+DELETE FROM UserBalance WHERE currency <> 'RUB';
+ALTER TABLE UserBalance DROP CONSTRAINT IF EXISTS userbalance_id_fkey;
+ALTER TABLE UserBalance DROP CONSTRAINT IF EXISTS userbalance_pkey;
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_pkey PRIMARY KEY (id);
+ALTER TABLE UserBalance DROP COLUMN IF EXISTS currency;
+
+-- users without wallet in default currency get an empty one, so their reservations and schedules stay valid
+INSERT INTO UserBalance (id, balance) SELECT id, 0 FROM Users WHERE id NOT IN (SELECT id FROM UserBalance);
+
+ALTER TABLE Reservations ADD CONSTRAINT reservations_user_id_fkey FOREIGN KEY (user_id) REFERENCES UserBalance (id);
+ALTER TABLE Schedules ADD CONSTRAINT schedules_sender_id_fkey FOREIGN KEY (sender_id) REFERENCES UserBalance (id);
+ALTER TABLE Schedules ADD CONSTRAINT schedules_recipient_id_fkey FOREIGN KEY (recipient_id) REFERENCES UserBalance (id);
+
+DROP TABLE IF EXISTS Users;
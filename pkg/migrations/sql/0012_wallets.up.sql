@@ -0,0 +1,25 @@
+-- user holds wallets in several currencies, every row of UserBalance is one of them.
+-- Users are registered on their own, so reservations and schedules keep referencing them
+CREATE TABLE Users (
+    id BIGINT PRIMARY KEY
+);
+INSERT INTO Users (id) SELECT id FROM UserBalance;
+
+ALTER TABLE Reservations DROP CONSTRAINT reservations_user_id_fkey;
+ALTER TABLE Schedules DROP CONSTRAINT schedules_sender_id_fkey;
+ALTER TABLE Schedules DROP CONSTRAINT schedules_recipient_id_fkey;
+
+-- balances kept before wallets are in default currency
+ALTER TABLE UserBalance ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'RUB';
+ALTER TABLE UserBalance ALTER COLUMN currency DROP DEFAULT;
+ALTER TABLE UserBalance DROP CONSTRAINT userbalance_pkey;
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_pkey PRIMARY KEY (id, currency);
+ALTER TABLE UserBalance ADD CONSTRAINT userbalance_id_fkey FOREIGN KEY (id) REFERENCES Users (id);
+
+ALTER TABLE Reservations ADD CONSTRAINT reservations_user_id_fkey FOREIGN KEY (user_id) REFERENCES Users (id);
+ALTER TABLE Schedules ADD CONSTRAINT schedules_sender_id_fkey FOREIGN KEY (sender_id) REFERENCES Users (id);
+ALTER TABLE Schedules ADD CONSTRAINT schedules_recipient_id_fkey FOREIGN KEY (recipient_id) REFERENCES Users (id);
+
+-- history entry is in currency of wallet it changed
+ALTER TABLE UserTransfers ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'RUB';
+ALTER TABLE UserTransfers ALTER COLUMN currency DROP DEFAULT;
@@ -0,0 +1,7 @@
+-- only reservations in default currency can be kept, money held by other active ones is returned to wallets
+UPDATE UserBalance SET reserved = reserved - held.amount
+FROM (SELECT user_id, currency, sum(amount) AS amount FROM Reservations
+    WHERE status = 'active' AND currency <> 'RUB' GROUP BY user_id, currency) held
+WHERE UserBalance.id = held.user_id AND UserBalance.currency = held.currency;
+DELETE FROM Reservations WHERE currency <> 'RUB';
+ALTER TABLE Reservations DROP COLUMN IF EXISTS currency;
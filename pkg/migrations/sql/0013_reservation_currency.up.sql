@@ -0,0 +1,3 @@
+-- reservation holds money of one wallet, reservations made before wallets are in default currency
+ALTER TABLE Reservations ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'RUB';
+ALTER TABLE Reservations ALTER COLUMN currency DROP DEFAULT;
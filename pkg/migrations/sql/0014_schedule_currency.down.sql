@@ -0,0 +1,4 @@
+-- only schedules in default currency can be kept, other ones and their runs are lost
+DELETE FROM ScheduleRuns WHERE schedule_id IN (SELECT schedule_id FROM Schedules WHERE currency <> 'RUB');
+DELETE FROM Schedules WHERE currency <> 'RUB';
+ALTER TABLE Schedules DROP COLUMN IF EXISTS currency;
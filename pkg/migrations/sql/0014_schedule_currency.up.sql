@@ -0,0 +1,3 @@
+-- schedule transfers money between wallets of one currency, schedules made before wallets are in default currency
+ALTER TABLE Schedules ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'RUB';
+ALTER TABLE Schedules ALTER COLUMN currency DROP DEFAULT;
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+)
+
+//PostgreSQL error codes (SQLSTATE) used by service
+const (
+	CodeInvalidTextRepresentation = "22P02"
+	CodeForeignKeyViolation       = "23503"
+	CodeUniqueViolation           = "23505"
+	CodeCheckViolation            = "23514"
+	CodeReadOnlyTransaction       = "25006"
+	CodeInFailedTransaction       = "25P02"
+	CodeSerializationFailure      = "40001"
+	CodeDeadlockDetected          = "40P01"
+)
+
+//SQLState returns PostgreSQL error code of err or empty string if err did not come from server.
+//Both implementations report server errors as *pgconn.PgError
+func SQLState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//executor hides differences between database/sql and native pgx transactions,
+//so both implementations share the same queries
+type executor interface {
+	exec(ctx context.Context, query string, args ...interface{}) error
+	queryRow(ctx context.Context, query string, args ...interface{}) row
+	query(ctx context.Context, query string, args ...interface{}) (rows, error)
+	commit() error
+	rollback() error
+}
+
+//row returns sql.ErrNoRows for empty result with any driver
+type row interface {
+	Scan(dest ...interface{}) error
+}
+
+type rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close()
+}
+
+type sqlExecutor struct {
+	tx *sql.Tx
+}
+
+func (executor sqlExecutor) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := executor.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (executor sqlExecutor) queryRow(ctx context.Context, query string, args ...interface{}) row {
+	return executor.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (executor sqlExecutor) query(ctx context.Context, query string, args ...interface{}) (rows, error) {
+	result, err := executor.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlRows{result}, nil
+}
+
+func (executor sqlExecutor) commit() error {
+	return executor.tx.Commit()
+}
+
+func (executor sqlExecutor) rollback() error {
+	return executor.tx.Rollback()
+}
+
+type sqlRows struct {
+	*sql.Rows
+}
+
+func (rows sqlRows) Close() {
+	rows.Rows.Close()
+}
+
+type pgxExecutor struct {
+	tx pgx.Tx
+	//context transaction was started with, used to finish it
+	ctx context.Context
+}
+
+func (executor pgxExecutor) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := executor.tx.Exec(ctx, query, args...)
+	return err
+}
+
+func (executor pgxExecutor) queryRow(ctx context.Context, query string, args ...interface{}) row {
+	return pgxRow{executor.tx.QueryRow(ctx, query, args...)}
+}
+
+func (executor pgxExecutor) query(ctx context.Context, query string, args ...interface{}) (rows, error) {
+	return executor.tx.Query(ctx, query, args...)
+}
+
+func (executor pgxExecutor) commit() error {
+	return executor.tx.Commit(executor.ctx)
+}
+
+func (executor pgxExecutor) rollback() error {
+	return executor.tx.Rollback(executor.ctx)
+}
+
+type pgxRow struct {
+	pgx.Row
+}
+
+func (row pgxRow) Scan(dest ...interface{}) error {
+	err := row.Row.Scan(dest...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sql.ErrNoRows
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//operation types of history entries
+const (
+	OpDeposit     = "deposit"
+	OpWithdrawal  = "withdrawal"
+	OpTransferIn  = "transfer_in"
+	OpTransferOut = "transfer_out"
+	OpAdjustment  = "adjustment"
+	//refund of earlier operation
+	OpReversal = "reversal"
+)
+
+//HistoryFilter selects transfers, zero value of every field means no restriction
+type HistoryFilter struct {
+	//inclusive
+	From time.Time
+	//exclusive
+	To time.Time
+	//1 for credits only, -1 for debits only
+	Sign int
+	//bounds of absolute amount, inclusive
+	MinAmount *int64
+	MaxAmount *int64
+	OpType    string
+	Currency  string
+}
+
+type HistoryOrder int
+
+const (
+	OrderByDate HistoryOrder = iota
+	//by absolute amount
+	OrderByAmount
+)
+
+//HistoryPosition is place of transfer in history, transfers with equal sort key are ordered by id
+type HistoryPosition struct {
+	TransferredAt time.Time
+	//absolute amount
+	Amount int64
+	ID     int64
+}
+
+//HistoryPage selects up to Limit transfers in given order, starting right after given position.
+//Transfers are returned from newest or largest unless Ascending is set
+type HistoryPage struct {
+	OrderBy   HistoryOrder
+	Ascending bool
+	//first page is returned if nil
+	After *HistoryPosition
+	Limit int
+}
+
+//Position returns place of transfer in history
+func (transfer Transfer) Position() HistoryPosition {
+	return HistoryPosition{TransferredAt: transfer.TransferredAt, Amount: abs(transfer.Amount), ID: transfer.ID}
+}
+
+//historyQuery builds query for PostgreSQL, every ordering is served by index on (id, sort key, transfer_id)
+func historyQuery(id int64, filter HistoryFilter, page HistoryPage) (string, []interface{}) {
+	args := []interface{}{id}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"id = $1"}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "transferred_at >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "transferred_at < "+arg(filter.To))
+	}
+	switch filter.Sign {
+	case 1:
+		conditions = append(conditions, "amount > 0")
+	case -1:
+		conditions = append(conditions, "amount < 0")
+	}
+	if filter.MinAmount != nil {
+		conditions = append(conditions, "abs(amount) >= "+arg(*filter.MinAmount))
+	}
+	if filter.MaxAmount != nil {
+		conditions = append(conditions, "abs(amount) <= "+arg(*filter.MaxAmount))
+	}
+	if filter.OpType != "" {
+		conditions = append(conditions, "op_type = "+arg(filter.OpType))
+	}
+	if filter.Currency != "" {
+		conditions = append(conditions, "currency = "+arg(filter.Currency))
+	}
+
+	key, direction, compare := "transferred_at", "DESC", "<"
+	if page.OrderBy == OrderByAmount {
+		key = "abs(amount)"
+	}
+	if page.Ascending {
+		direction, compare = "ASC", ">"
+	}
+	if page.After != nil {
+		var after interface{} = page.After.TransferredAt
+		if page.OrderBy == OrderByAmount {
+			after = page.After.Amount
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, transfer_id) %s (%s, %s)", key, compare, arg(after), arg(page.After.ID)))
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM UserTransfers
+		WHERE %s ORDER BY %s %s, transfer_id %s LIMIT %s`,
+		transferColumns, strings.Join(conditions, " AND "), key, direction, direction, arg(page.Limit))
+	return query, args
+}
+
+//matches does the same filtering as historyQuery for in memory transfers
+func (filter HistoryFilter) matches(transfer Transfer) bool {
+	amount := abs(transfer.Amount)
+	switch {
+	case !filter.From.IsZero() && transfer.TransferredAt.Before(filter.From),
+		!filter.To.IsZero() && !transfer.TransferredAt.Before(filter.To),
+		filter.Sign > 0 && transfer.Amount <= 0,
+		filter.Sign < 0 && transfer.Amount >= 0,
+		filter.MinAmount != nil && amount < *filter.MinAmount,
+		filter.MaxAmount != nil && amount > *filter.MaxAmount,
+		filter.OpType != "" && transfer.OpType != filter.OpType,
+		filter.Currency != "" && transfer.Currency != filter.Currency:
+		return false
+	}
+	return true
+}
+
+//less tells if transfer at position a goes before b in page's order
+func (page HistoryPage) less(a HistoryPosition, b HistoryPosition) bool {
+	var cmp int
+	if page.OrderBy == OrderByAmount {
+		cmp = compareInt64(a.Amount, b.Amount)
+	} else {
+		cmp = compareTime(a.TransferredAt, b.TransferredAt)
+	}
+	if cmp == 0 {
+		cmp = compareInt64(a.ID, b.ID)
+	}
+	if page.Ascending {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+func compareInt64(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTime(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
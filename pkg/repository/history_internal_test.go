@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	after := &HistoryPosition{TransferredAt: from.Add(time.Hour), Amount: 300, ID: 42}
+	minAmount := int64(100)
+
+	var tests = []struct {
+		name          string
+		filter        HistoryFilter
+		page          HistoryPage
+		expectedQuery string
+		expectedArgs  []interface{}
+	}{
+		{
+			name: "first page",
+			page: HistoryPage{Limit: 10},
+			expectedQuery: "SELECT transfer_id, operation_id::text, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses::text FROM UserTransfers " +
+				"WHERE id = $1 ORDER BY transferred_at DESC, transfer_id DESC LIMIT $2",
+			expectedArgs: []interface{}{int64(1), 10},
+		},
+		{
+			name: "next page by date",
+			page: HistoryPage{After: after, Limit: 10},
+			expectedQuery: "SELECT transfer_id, operation_id::text, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses::text FROM UserTransfers " +
+				"WHERE id = $1 AND (transferred_at, transfer_id) < ($2, $3) ORDER BY transferred_at DESC, transfer_id DESC LIMIT $4",
+			expectedArgs: []interface{}{int64(1), after.TransferredAt, int64(42), 10},
+		},
+		{
+			name:   "filtered next page by amount ascending",
+			filter: HistoryFilter{From: from, Sign: -1, MinAmount: &minAmount, OpType: OpTransferOut},
+			page:   HistoryPage{OrderBy: OrderByAmount, Ascending: true, After: after, Limit: 10},
+			expectedQuery: "SELECT transfer_id, operation_id::text, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses::text FROM UserTransfers " +
+				"WHERE id = $1 AND transferred_at >= $2 AND amount < 0 AND abs(amount) >= $3 AND op_type = $4 " +
+				"AND (abs(amount), transfer_id) > ($5, $6) ORDER BY abs(amount) ASC, transfer_id ASC LIMIT $7",
+			expectedArgs: []interface{}{int64(1), from, int64(100), "transfer_out", int64(300), int64(42), 10},
+		},
+		{
+			name:   "wallet history",
+			filter: HistoryFilter{Currency: "USD"},
+			page:   HistoryPage{Limit: 10},
+			expectedQuery: "SELECT transfer_id, operation_id::text, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses::text FROM UserTransfers " +
+				"WHERE id = $1 AND currency = $2 ORDER BY transferred_at DESC, transfer_id DESC LIMIT $3",
+			expectedArgs: []interface{}{int64(1), "USD", 10},
+		},
+	}
+
+	spaces := regexp.MustCompile(`\s+`)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args := historyQuery(1, test.filter, test.page)
+			assert.Equal(t, test.expectedQuery, strings.TrimSpace(spaces.ReplaceAllString(query, " ")))
+			assert.Equal(t, test.expectedArgs, args)
+		})
+	}
+}
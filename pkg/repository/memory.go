@@ -0,0 +1,1111 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+)
+
+var (
+	errDeadlock = &pgconn.PgError{Severity: "ERROR", Code: CodeDeadlockDetected, Message: "deadlock detected"}
+	errAborted  = &pgconn.PgError{Severity: "ERROR", Code: CodeInFailedTransaction,
+		Message: "current transaction is aborted, commands ignored until end of transaction block"}
+	errNegativeBalance = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "userbalance" violates check constraint "userbalance_balance_non_negative"`}
+	errWalletUser = &pgconn.PgError{Severity: "ERROR", Code: CodeForeignKeyViolation,
+		Message: `insert or update on table "userbalance" violates foreign key constraint "userbalance_id_fkey"`}
+	errReservedExceedsBalance = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "userbalance" violates check constraint "userbalance_reserved_check"`}
+	errInvalidReservation = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "reservations" violates check constraint "reservations_check"`}
+	errDuplicateReservation = &pgconn.PgError{Severity: "ERROR", Code: CodeUniqueViolation,
+		Message: `duplicate key value violates unique constraint "reservations_pkey"`}
+	errReservationUser = &pgconn.PgError{Severity: "ERROR", Code: CodeForeignKeyViolation,
+		Message: `insert or update on table "reservations" violates foreign key constraint "reservations_user_id_fkey"`}
+	errInvalidOpType = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "usertransfers" violates check constraint "usertransfers_op_type_check"`}
+	errInvalidReverses = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "usertransfers" violates check constraint "usertransfers_reverses_check"`}
+	errInvalidSchedule = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "schedules" violates check constraint "schedules_check"`}
+	errDuplicateSchedule = &pgconn.PgError{Severity: "ERROR", Code: CodeUniqueViolation,
+		Message: `duplicate key value violates unique constraint "schedules_pkey"`}
+	errScheduleUser = &pgconn.PgError{Severity: "ERROR", Code: CodeForeignKeyViolation,
+		Message: `insert or update on table "schedules" violates foreign key constraint "schedules_sender_id_fkey"`}
+	errInvalidRun = &pgconn.PgError{Severity: "ERROR", Code: CodeCheckViolation,
+		Message: `new row for relation "scheduleruns" violates check constraint "scheduleruns_status_check"`}
+	errDuplicateRun = &pgconn.PgError{Severity: "ERROR", Code: CodeUniqueViolation,
+		Message: `duplicate key value violates unique constraint "scheduleruns_schedule_id_scheduled_at_key"`}
+	errInvalidUUID = &pgconn.PgError{Severity: "ERROR", Code: CodeInvalidTextRepresentation,
+		Message: "invalid input syntax for type uuid"}
+	errReadOnly = &pgconn.PgError{Severity: "ERROR", Code: CodeReadOnlyTransaction,
+		Message: "cannot execute statement in a read-only transaction"}
+	errCommitRollback       = errors.New("commit unexpectedly resulted in rollback")
+	errUnsupportedIsolation = errors.New("memory repository supports only read committed isolation")
+)
+
+//Memory is repository keeping data in process memory. It behaves like PostgreSQL with
+//read committed isolation: changes are visible to others only after commit, rows are locked
+//by FOR SHARE / FOR UPDATE reads and updates until transaction ends, waiting for a lock
+//respects context and lock cycles are reported as deadlock errors with PostgreSQL codes
+type Memory struct {
+	mu           sync.Mutex
+	users        map[int64]bool
+	balances     map[walletRow]Balance
+	history      []memoryTransfer
+	lastID       int64
+	keys         map[string]IdempotencyRecord
+	reservations map[string]Reservation
+	schedules    map[string]Schedule
+	runs         []ScheduleRun
+	lastRunID    int64
+
+	locks   map[rowKey]*rowLock
+	waiting map[*memoryTx]lockRequest
+	//closed and replaced every time any lock is released, so waiters can retry
+	released chan struct{}
+}
+
+type memoryTransfer struct {
+	Transfer
+	//user id, transfer's own id is in Transfer
+	id int64
+}
+
+type memoryTx struct {
+	users    map[int64]bool
+	balances map[walletRow]Balance
+	history  []memoryTransfer
+	//nil record is deleted one
+	keys         map[string]*IdempotencyRecord
+	reservations map[string]Reservation
+	schedules    map[string]Schedule
+	runs         []ScheduleRun
+	locked       map[rowKey]bool
+	//statement failed, like in PostgreSQL only rollback is possible
+	aborted  bool
+	readOnly bool
+	done     bool
+}
+
+type rowLock struct {
+	writer  *memoryTx
+	readers map[*memoryTx]bool
+}
+
+//rowKey identifies locked row: user id for user, walletRow for balance, string for idempotency key,
+//reservationRow for reservation and scheduleRow for schedule
+type rowKey interface{}
+
+type walletRow struct {
+	id       int64
+	currency string
+}
+
+type reservationRow string
+
+type scheduleRow string
+
+type lockRequest struct {
+	row       rowKey
+	exclusive bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:        make(map[int64]bool),
+		balances:     make(map[walletRow]Balance),
+		keys:         make(map[string]IdempotencyRecord),
+		reservations: make(map[string]Reservation),
+		schedules:    make(map[string]Schedule),
+		locks:        make(map[rowKey]*rowLock),
+		waiting:      make(map[*memoryTx]lockRequest),
+		released:     make(chan struct{}),
+	}
+}
+
+func (memory *Memory) Open() error {
+	return nil
+}
+
+func (memory *Memory) Close() error {
+	return nil
+}
+
+//WithTx runs fn in transaction, it is committed if fn returns nil and rolled back otherwise.
+//Only read committed isolation is emulated, read only transaction fails on writes like in PostgreSQL
+func (memory *Memory) WithTx(ctx context.Context, opts TxOptions, fn func(tx Tx) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts.Isolation != ReadCommitted {
+		return errUnsupportedIsolation
+	}
+	tx := &memoryTx{
+		users:        make(map[int64]bool),
+		balances:     make(map[walletRow]Balance),
+		keys:         make(map[string]*IdempotencyRecord),
+		reservations: make(map[string]Reservation),
+		schedules:    make(map[string]Schedule),
+		locked:       make(map[rowKey]bool),
+		readOnly:     opts.ReadOnly,
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			memory.rollback(tx)
+			panic(recovered)
+		}
+	}()
+
+	if err := fn(memoryQueries{memory, tx}); err != nil {
+		memory.rollback(tx)
+		return err
+	}
+	return memory.commit(tx)
+}
+
+func (memory *Memory) commit(tx *memoryTx) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if tx.aborted {
+		memory.finish(tx)
+		return errCommitRollback
+	}
+
+	for id := range tx.users {
+		memory.users[id] = true
+	}
+	for row, balance := range tx.balances {
+		memory.balances[row] = balance
+	}
+	memory.history = append(memory.history, tx.history...)
+	for key, record := range tx.keys {
+		if record == nil {
+			delete(memory.keys, key)
+		} else {
+			memory.keys[key] = *record
+		}
+	}
+	for id, reservation := range tx.reservations {
+		memory.reservations[id] = reservation
+	}
+	for id, schedule := range tx.schedules {
+		memory.schedules[id] = schedule
+	}
+	memory.runs = append(memory.runs, tx.runs...)
+	memory.finish(tx)
+	return nil
+}
+
+func (memory *Memory) rollback(tx *memoryTx) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.finish(tx)
+}
+
+//memoryQueries run queries of one transaction opened by WithTx
+type memoryQueries struct {
+	*Memory
+	tx *memoryTx
+}
+
+func (memory memoryQueries) UserExists(ctx context.Context, id int64) (bool, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return false, err
+	}
+	return memory.user(memory.tx, id), nil
+}
+
+func (memory memoryQueries) GetUserBalance(ctx context.Context, id int64, currency string, forUpdate bool) (Balance, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return Balance{}, err
+	}
+	row := walletRow{id, currency}
+	//as in PostgreSQL, missing row is not locked
+	if _, exists := memory.balance(memory.tx, row); !exists {
+		return Balance{}, sql.ErrNoRows
+	}
+	if err := memory.lock(ctx, memory.tx, row, forUpdate); err != nil {
+		return Balance{}, err
+	}
+
+	//row could be changed by transaction which held the lock
+	balance, exists := memory.balance(memory.tx, row)
+	if !exists {
+		return Balance{}, sql.ErrNoRows
+	}
+	return balance, nil
+}
+
+func (memory memoryQueries) GetUserBalances(ctx context.Context, id int64) ([]Balance, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	balances := make([]Balance, 0)
+	for row, balance := range memory.tx.balances {
+		if row.id == id {
+			balances = append(balances, balance)
+		}
+	}
+	for row, balance := range memory.balances {
+		//wallet changed by transaction is seen with its own change
+		if _, changed := memory.tx.balances[row]; row.id == id && !changed {
+			balances = append(balances, balance)
+		}
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Currency < balances[j].Currency
+	})
+	return balances, nil
+}
+
+func (memory memoryQueries) GetUserHistory(ctx context.Context, id int64, filter HistoryFilter, page HistoryPage) ([]Transfer, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+
+	var found []Transfer
+	for _, history := range [][]memoryTransfer{memory.history, memory.tx.history} {
+		for _, transfer := range history {
+			if transfer.id != id || !filter.matches(transfer.Transfer) {
+				continue
+			}
+			if page.After != nil && !page.less(*page.After, transfer.Position()) {
+				continue
+			}
+			found = append(found, transfer.Transfer)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return page.less(found[i].Position(), found[j].Position())
+	})
+
+	if len(found) > page.Limit {
+		found = found[:page.Limit]
+	}
+	return append(make([]Transfer, 0, len(found)), found...), nil
+}
+
+func (memory memoryQueries) GetOperation(ctx context.Context, operationID string) ([]OperationEntry, error) {
+	return memory.operationEntries(operationID, func(transfer Transfer) bool {
+		return transfer.OperationID == operationID
+	})
+}
+
+func (memory memoryQueries) GetReversals(ctx context.Context, operationID string) ([]OperationEntry, error) {
+	return memory.operationEntries(operationID, func(transfer Transfer) bool {
+		return transfer.Reverses != nil && *transfer.Reverses == operationID
+	})
+}
+
+//operationEntries returns history entries visible to transaction which match, ordered by id
+func (memory memoryQueries) operationEntries(operationID string, match func(transfer Transfer) bool) ([]OperationEntry, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	if _, err := uuid.Parse(operationID); err != nil {
+		memory.tx.aborted = true
+		return nil, errInvalidUUID
+	}
+
+	entries := make([]OperationEntry, 0, 2)
+	for _, history := range [][]memoryTransfer{memory.history, memory.tx.history} {
+		for _, transfer := range history {
+			if match(transfer.Transfer) {
+				entries = append(entries, OperationEntry{UserID: transfer.id, Transfer: transfer.Transfer})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (memory memoryQueries) CreateUser(ctx context.Context, id int64) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	//concurrent insert of the same key waits for the first one to finish, existing user is kept
+	if err := memory.lock(ctx, memory.tx, id, true); err != nil {
+		return err
+	}
+	if !memory.user(memory.tx, id) {
+		memory.tx.users[id] = true
+	}
+	return nil
+}
+
+func (memory memoryQueries) CreateWallet(ctx context.Context, id int64, currency string) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if !memory.user(memory.tx, id) {
+		memory.tx.aborted = true
+		return errWalletUser
+	}
+	row := walletRow{id, currency}
+	//concurrent insert of the same key waits for the first one to finish, existing wallet is kept
+	if err := memory.lock(ctx, memory.tx, row, true); err != nil {
+		return err
+	}
+	if _, exists := memory.balance(memory.tx, row); !exists {
+		memory.tx.balances[row] = Balance{Currency: currency}
+	}
+	return nil
+}
+
+func (memory memoryQueries) ChangeUserBalance(ctx context.Context, id int64, currency string, amount int64) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	row := walletRow{id, currency}
+	if _, exists := memory.balance(memory.tx, row); !exists {
+		return nil
+	}
+	if err := memory.lock(ctx, memory.tx, row, true); err != nil {
+		return err
+	}
+
+	balance, exists := memory.balance(memory.tx, row)
+	if !exists {
+		return nil
+	}
+	if balance.Amount+amount < 0 {
+		memory.tx.aborted = true
+		return errNegativeBalance
+	}
+	if balance.Amount+amount < balance.Reserved {
+		memory.tx.aborted = true
+		return errReservedExceedsBalance
+	}
+	balance.Amount += amount
+	memory.tx.balances[row] = balance
+	return nil
+}
+
+func (memory memoryQueries) UpdateHistory(ctx context.Context, id int64, transfer Transfer) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	//like sequence, id is taken even if transaction is rolled back later
+	switch transfer.OpType {
+	case OpDeposit, OpWithdrawal, OpTransferIn, OpTransferOut, OpAdjustment, OpReversal:
+	default:
+		memory.tx.aborted = true
+		return errInvalidOpType
+	}
+	//only reversal references reversed operation
+	if (transfer.OpType == OpReversal) != (transfer.Reverses != nil) {
+		memory.tx.aborted = true
+		return errInvalidReverses
+	}
+	if _, err := uuid.Parse(transfer.OperationID); err != nil {
+		memory.tx.aborted = true
+		return errInvalidUUID
+	}
+	if transfer.Reverses != nil {
+		if _, err := uuid.Parse(*transfer.Reverses); err != nil {
+			memory.tx.aborted = true
+			return errInvalidUUID
+		}
+	}
+	memory.lastID++
+	transfer.ID = memory.lastID
+	transfer.TransferredAt = time.Now()
+	memory.tx.history = append(memory.tx.history, memoryTransfer{Transfer: transfer, id: id})
+	return nil
+}
+
+func (memory memoryQueries) ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return IdempotencyRecord{}, err
+	}
+	//like concurrent inserts of the same key, claims wait for each other
+	if err := memory.lock(ctx, memory.tx, record.Key, true); err != nil {
+		return IdempotencyRecord{}, err
+	}
+	if stored, exists := memory.idempotencyKey(memory.tx, record.Key); exists {
+		return stored, nil
+	}
+	record.Response = nil
+	memory.tx.keys[record.Key] = &record
+	return record, nil
+}
+
+func (memory memoryQueries) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if _, exists := memory.idempotencyKey(memory.tx, record.Key); !exists {
+		return nil
+	}
+	if err := memory.lock(ctx, memory.tx, record.Key, true); err != nil {
+		return err
+	}
+	memory.tx.keys[record.Key] = &record
+	return nil
+}
+
+func (memory memoryQueries) DeleteIdempotencyKeys(ctx context.Context, before time.Time) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	var expired []string
+	for key, record := range memory.keys {
+		if record.CreatedAt.Before(before) {
+			expired = append(expired, key)
+		}
+	}
+	for key, record := range memory.tx.keys {
+		if record != nil && record.CreatedAt.Before(before) {
+			expired = append(expired, key)
+		}
+	}
+	for _, key := range expired {
+		if err := memory.lock(ctx, memory.tx, key, true); err != nil {
+			return err
+		}
+		//record could be changed by transaction which held the lock
+		if record, exists := memory.idempotencyKey(memory.tx, key); exists && record.CreatedAt.Before(before) {
+			memory.tx.keys[key] = nil
+		}
+	}
+	return nil
+}
+
+func (memory memoryQueries) ChangeUserReserved(ctx context.Context, id int64, currency string, amount int64) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	row := walletRow{id, currency}
+	if _, exists := memory.balance(memory.tx, row); !exists {
+		return nil
+	}
+	if err := memory.lock(ctx, memory.tx, row, true); err != nil {
+		return err
+	}
+
+	balance, exists := memory.balance(memory.tx, row)
+	if !exists {
+		return nil
+	}
+	if balance.Reserved+amount < 0 || balance.Reserved+amount > balance.Amount {
+		memory.tx.aborted = true
+		return errReservedExceedsBalance
+	}
+	balance.Reserved += amount
+	memory.tx.balances[row] = balance
+	return nil
+}
+
+func (memory memoryQueries) CreateReservation(ctx context.Context, reservation Reservation) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if _, err := uuid.Parse(reservation.ID); err != nil {
+		memory.tx.aborted = true
+		return errInvalidUUID
+	}
+	if reservation.Amount <= 0 || !validReservationStatus(reservation.Status) {
+		memory.tx.aborted = true
+		return errInvalidReservation
+	}
+	if !memory.user(memory.tx, reservation.UserID) {
+		memory.tx.aborted = true
+		return errReservationUser
+	}
+	//concurrent insert of the same key waits for the first one to finish
+	if err := memory.lock(ctx, memory.tx, reservationRow(reservation.ID), true); err != nil {
+		return err
+	}
+	if _, exists := memory.reservation(memory.tx, reservation.ID); exists {
+		memory.tx.aborted = true
+		return errDuplicateReservation
+	}
+	memory.tx.reservations[reservation.ID] = reservation
+	return nil
+}
+
+func (memory memoryQueries) GetReservation(ctx context.Context, id string, forUpdate bool) (Reservation, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return Reservation{}, err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		memory.tx.aborted = true
+		return Reservation{}, errInvalidUUID
+	}
+	if _, exists := memory.reservation(memory.tx, id); !exists {
+		return Reservation{}, sql.ErrNoRows
+	}
+	//plain read does not lock row in PostgreSQL
+	if forUpdate {
+		if err := memory.lock(ctx, memory.tx, reservationRow(id), true); err != nil {
+			return Reservation{}, err
+		}
+	}
+
+	reservation, exists := memory.reservation(memory.tx, id)
+	if !exists {
+		return Reservation{}, sql.ErrNoRows
+	}
+	return reservation, nil
+}
+
+func (memory memoryQueries) GetExpiredReservations(ctx context.Context, before time.Time, limit int) ([]Reservation, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	expired := func(reservation Reservation) bool {
+		return reservation.Status == ReservationActive && !reservation.ExpiresAt.After(before)
+	}
+
+	var candidates []Reservation
+	for id := range memory.reservations {
+		if reservation, _ := memory.reservation(memory.tx, id); expired(reservation) {
+			candidates = append(candidates, reservation)
+		}
+	}
+	for id, reservation := range memory.tx.reservations {
+		if _, committed := memory.reservations[id]; !committed && expired(reservation) {
+			candidates = append(candidates, reservation)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ExpiresAt.Before(candidates[j].ExpiresAt)
+	})
+
+	reservations := make([]Reservation, 0)
+	for _, candidate := range candidates {
+		if len(reservations) == limit {
+			break
+		}
+		//like SKIP LOCKED, rows locked by others are not waited for
+		if !memory.tryLock(memory.tx, reservationRow(candidate.ID)) {
+			continue
+		}
+		reservations = append(reservations, candidate)
+	}
+	return reservations, nil
+}
+
+func (memory memoryQueries) FinishReservation(ctx context.Context, reservation Reservation) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if _, exists := memory.reservation(memory.tx, reservation.ID); !exists {
+		return nil
+	}
+	if err := memory.lock(ctx, memory.tx, reservationRow(reservation.ID), true); err != nil {
+		return err
+	}
+
+	stored, exists := memory.reservation(memory.tx, reservation.ID)
+	if !exists {
+		return nil
+	}
+	if !validReservationStatus(reservation.Status) || reservation.Captured < 0 || reservation.Captured > stored.Amount {
+		memory.tx.aborted = true
+		return errInvalidReservation
+	}
+	stored.Status = reservation.Status
+	stored.FinishedAt = reservation.FinishedAt
+	stored.Captured = reservation.Captured
+	stored.OperationID = reservation.OperationID
+	memory.tx.reservations[reservation.ID] = stored
+	return nil
+}
+
+func validReservationStatus(status string) bool {
+	switch status {
+	case ReservationActive, ReservationCaptured, ReservationReleased, ReservationExpired:
+		return true
+	}
+	return false
+}
+
+func (memory memoryQueries) CreateSchedule(ctx context.Context, schedule Schedule) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if _, err := uuid.Parse(schedule.ID); err != nil {
+		memory.tx.aborted = true
+		return errInvalidUUID
+	}
+	if !validSchedule(schedule) {
+		memory.tx.aborted = true
+		return errInvalidSchedule
+	}
+	if !memory.user(memory.tx, schedule.SenderID) || !memory.user(memory.tx, schedule.RecipientID) {
+		memory.tx.aborted = true
+		return errScheduleUser
+	}
+	//concurrent insert of the same key waits for the first one to finish
+	if err := memory.lock(ctx, memory.tx, scheduleRow(schedule.ID), true); err != nil {
+		return err
+	}
+	if _, exists := memory.schedule(memory.tx, schedule.ID); exists {
+		memory.tx.aborted = true
+		return errDuplicateSchedule
+	}
+	memory.tx.schedules[schedule.ID] = schedule
+	return nil
+}
+
+func (memory memoryQueries) GetSchedule(ctx context.Context, id string, forUpdate bool) (Schedule, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return Schedule{}, err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		memory.tx.aborted = true
+		return Schedule{}, errInvalidUUID
+	}
+	if _, exists := memory.schedule(memory.tx, id); !exists {
+		return Schedule{}, sql.ErrNoRows
+	}
+	//plain read does not lock row in PostgreSQL
+	if forUpdate {
+		if err := memory.lock(ctx, memory.tx, scheduleRow(id), true); err != nil {
+			return Schedule{}, err
+		}
+	}
+
+	schedule, exists := memory.schedule(memory.tx, id)
+	if !exists {
+		return Schedule{}, sql.ErrNoRows
+	}
+	return schedule, nil
+}
+
+func (memory memoryQueries) GetUserSchedules(ctx context.Context, senderID int64, status string, page SchedulePage) ([]Schedule, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	schedules := memory.visibleSchedules(func(schedule Schedule) bool {
+		return schedule.SenderID == senderID && (status == "" || schedule.Status == status) &&
+			(page.After == nil || page.After.before(schedule.Position()))
+	})
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Position().before(schedules[j].Position())
+	})
+
+	if len(schedules) > page.Limit {
+		schedules = schedules[:page.Limit]
+	}
+	return schedules, nil
+}
+
+func (memory memoryQueries) GetDueSchedules(ctx context.Context, before time.Time, skip []string, limit int) ([]Schedule, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	skipped := make(map[string]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	candidates := memory.visibleSchedules(func(schedule Schedule) bool {
+		return schedule.Status == ScheduleActive && schedule.NextRunAt != nil && !schedule.NextRunAt.After(before) && !skipped[schedule.ID]
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].NextRunAt.Before(*candidates[j].NextRunAt)
+	})
+
+	schedules := make([]Schedule, 0)
+	for _, candidate := range candidates {
+		if len(schedules) == limit {
+			break
+		}
+		//like SKIP LOCKED, rows locked by others are not waited for
+		if !memory.tryLock(memory.tx, scheduleRow(candidate.ID)) {
+			continue
+		}
+		schedules = append(schedules, candidate)
+	}
+	return schedules, nil
+}
+
+func (memory memoryQueries) UpdateSchedule(ctx context.Context, schedule Schedule) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if _, exists := memory.schedule(memory.tx, schedule.ID); !exists {
+		return nil
+	}
+	if err := memory.lock(ctx, memory.tx, scheduleRow(schedule.ID), true); err != nil {
+		return err
+	}
+
+	stored, exists := memory.schedule(memory.tx, schedule.ID)
+	if !exists {
+		return nil
+	}
+	stored.Runs = schedule.Runs
+	stored.NextRunAt = schedule.NextRunAt
+	stored.Status = schedule.Status
+	stored.CanceledAt = schedule.CanceledAt
+	if !validSchedule(stored) {
+		memory.tx.aborted = true
+		return errInvalidSchedule
+	}
+	memory.tx.schedules[schedule.ID] = stored
+	return nil
+}
+
+func (memory memoryQueries) AddScheduleRun(ctx context.Context, run ScheduleRun) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.writable(memory.tx); err != nil {
+		return err
+	}
+	if run.Status != RunSucceeded && run.Status != RunFailed {
+		memory.tx.aborted = true
+		return errInvalidRun
+	}
+	//due time is unique per schedule, runs are not updated, so they are not locked
+	for _, runs := range [][]ScheduleRun{memory.runs, memory.tx.runs} {
+		for _, stored := range runs {
+			if stored.ScheduleID == run.ScheduleID && stored.ScheduledAt.Equal(run.ScheduledAt) {
+				memory.tx.aborted = true
+				return errDuplicateRun
+			}
+		}
+	}
+	//like sequence, id is taken even if transaction is rolled back later
+	memory.lastRunID++
+	run.ID = memory.lastRunID
+	memory.tx.runs = append(memory.tx.runs, run)
+	return nil
+}
+
+func (memory memoryQueries) GetScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]ScheduleRun, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if err := memory.usable(memory.tx); err != nil {
+		return nil, err
+	}
+	if _, err := uuid.Parse(scheduleID); err != nil {
+		memory.tx.aborted = true
+		return nil, errInvalidUUID
+	}
+	runs := make([]ScheduleRun, 0)
+	for _, stored := range [][]ScheduleRun{memory.runs, memory.tx.runs} {
+		for _, run := range stored {
+			if run.ScheduleID == scheduleID {
+				runs = append(runs, run)
+			}
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ID > runs[j].ID
+	})
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+//validSchedule checks constraints of Schedules table
+func validSchedule(schedule Schedule) bool {
+	if schedule.Amount <= 0 || schedule.Runs < 0 || schedule.SenderID == schedule.RecipientID {
+		return false
+	}
+	if schedule.Recurrence != nil {
+		switch *schedule.Recurrence {
+		case RecurrenceDaily, RecurrenceWeekly, RecurrenceMonthly:
+		default:
+			return false
+		}
+	}
+	switch schedule.Status {
+	case ScheduleActive, ScheduleCompleted, ScheduleCanceled:
+	default:
+		return false
+	}
+	return (schedule.Status == ScheduleActive) == (schedule.NextRunAt != nil)
+}
+
+//functions below must be called with memory.mu held
+
+func (memory *Memory) usable(tx *memoryTx) error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	if tx.aborted {
+		return errAborted
+	}
+	return nil
+}
+
+//writable is like usable, but for statements changing data
+func (memory *Memory) writable(tx *memoryTx) error {
+	if err := memory.usable(tx); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		tx.aborted = true
+		return errReadOnly
+	}
+	return nil
+}
+
+//balance returns value visible to transaction: its own change or last committed one
+func (memory *Memory) balance(tx *memoryTx, row walletRow) (Balance, bool) {
+	if balance, ok := tx.balances[row]; ok {
+		return balance, true
+	}
+	balance, ok := memory.balances[row]
+	return balance, ok
+}
+
+//user tells if user is registered by transaction or committed
+func (memory *Memory) user(tx *memoryTx, id int64) bool {
+	return tx.users[id] || memory.users[id]
+}
+
+//schedule returns schedule visible to transaction like balance does
+func (memory *Memory) schedule(tx *memoryTx, id string) (Schedule, bool) {
+	if schedule, ok := tx.schedules[id]; ok {
+		return schedule, true
+	}
+	schedule, ok := memory.schedules[id]
+	return schedule, ok
+}
+
+//visibleSchedules returns schedules visible to transaction which match
+func (memory memoryQueries) visibleSchedules(match func(schedule Schedule) bool) []Schedule {
+	schedules := make([]Schedule, 0)
+	for id := range memory.schedules {
+		if schedule, _ := memory.schedule(memory.tx, id); match(schedule) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	for id, schedule := range memory.tx.schedules {
+		if _, committed := memory.schedules[id]; !committed && match(schedule) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules
+}
+
+//reservation returns reservation visible to transaction like balance does
+func (memory *Memory) reservation(tx *memoryTx, id string) (Reservation, bool) {
+	if reservation, ok := tx.reservations[id]; ok {
+		return reservation, true
+	}
+	reservation, ok := memory.reservations[id]
+	return reservation, ok
+}
+
+//idempotencyKey returns record visible to transaction like balance does
+func (memory *Memory) idempotencyKey(tx *memoryTx, key string) (IdempotencyRecord, bool) {
+	if record, ok := tx.keys[key]; ok {
+		if record == nil {
+			return IdempotencyRecord{}, false
+		}
+		return *record, true
+	}
+	record, ok := memory.keys[key]
+	return record, ok
+}
+
+//lock acquires row lock, waiting until conflicting transactions finish.
+//Mutex is released while waiting and held again when lock returns
+func (memory *Memory) lock(ctx context.Context, tx *memoryTx, row rowKey, exclusive bool) error {
+	for {
+		lock, ok := memory.locks[row]
+		if !ok {
+			lock = &rowLock{readers: make(map[*memoryTx]bool)}
+			memory.locks[row] = lock
+		}
+		if lock.grant(tx, exclusive) {
+			delete(memory.waiting, tx)
+			tx.locked[row] = true
+			return nil
+		}
+
+		memory.waiting[tx] = lockRequest{row, exclusive}
+		if memory.deadlocked(tx) {
+			delete(memory.waiting, tx)
+			tx.aborted = true
+			return errDeadlock
+		}
+
+		released := memory.released
+		memory.mu.Unlock()
+		select {
+		case <-released:
+			memory.mu.Lock()
+		case <-ctx.Done():
+			memory.mu.Lock()
+			delete(memory.waiting, tx)
+			if lock, ok := memory.locks[row]; ok && lock.writer == nil && len(lock.readers) == 0 {
+				delete(memory.locks, row)
+			}
+			tx.aborted = true
+			return ctx.Err()
+		}
+	}
+}
+
+//tryLock acquires exclusive row lock only if no other transaction holds the row, like FOR UPDATE SKIP LOCKED
+func (memory *Memory) tryLock(tx *memoryTx, row rowKey) bool {
+	lock, ok := memory.locks[row]
+	if !ok {
+		lock = &rowLock{readers: make(map[*memoryTx]bool)}
+		memory.locks[row] = lock
+	}
+	if !lock.grant(tx, true) {
+		return false
+	}
+	tx.locked[row] = true
+	return true
+}
+
+//deadlocked reports if transactions blocking tx wait, directly or not, for tx itself
+func (memory *Memory) deadlocked(tx *memoryTx) bool {
+	visited := make(map[*memoryTx]bool)
+	var waitsFor func(waiter *memoryTx) bool
+	waitsFor = func(waiter *memoryTx) bool {
+		request, ok := memory.waiting[waiter]
+		if !ok {
+			return false
+		}
+		lock, ok := memory.locks[request.row]
+		if !ok {
+			return false
+		}
+		for _, blocker := range lock.blockers(waiter, request.exclusive) {
+			if blocker == tx {
+				return true
+			}
+			if !visited[blocker] {
+				visited[blocker] = true
+				if waitsFor(blocker) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return waitsFor(tx)
+}
+
+//finish releases all locks of transaction and wakes up waiters
+func (memory *Memory) finish(tx *memoryTx) {
+	tx.done = true
+	for row := range tx.locked {
+		lock := memory.locks[row]
+		if lock.writer == tx {
+			lock.writer = nil
+		}
+		delete(lock.readers, tx)
+		if lock.writer == nil && len(lock.readers) == 0 {
+			delete(memory.locks, row)
+		}
+	}
+	close(memory.released)
+	memory.released = make(chan struct{})
+}
+
+func (lock *rowLock) grant(tx *memoryTx, exclusive bool) bool {
+	if len(lock.blockers(tx, exclusive)) != 0 {
+		return false
+	}
+	if exclusive {
+		lock.writer = tx
+	} else {
+		lock.readers[tx] = true
+	}
+	return true
+}
+
+//blockers returns other transactions holding lock in conflicting mode
+func (lock *rowLock) blockers(tx *memoryTx, exclusive bool) []*memoryTx {
+	var blockers []*memoryTx
+	if lock.writer != nil && lock.writer != tx {
+		blockers = append(blockers, lock.writer)
+	}
+	if exclusive {
+		for reader := range lock.readers {
+			if reader != tx {
+				blockers = append(blockers, reader)
+			}
+		}
+	}
+	return blockers
+}
@@ -0,0 +1,502 @@
+package repository_test
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errRollback = errors.New("rollback")
+
+//newMemoryWithUsers creates repository with committed users having given balances in rubles
+func newMemoryWithUsers(t *testing.T, balances map[int64]int64) *repository.Memory {
+	memory := repository.NewMemory()
+	ctx := context.Background()
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		for id, balance := range balances {
+			if err := tx.CreateUser(ctx, id); err != nil {
+				return err
+			}
+			if err := tx.CreateWallet(ctx, id, "RUB"); err != nil {
+				return err
+			}
+			if err := tx.ChangeUserBalance(ctx, id, "RUB", balance); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return memory
+}
+
+//openTx keeps transaction open until it is finished by test, so several of them can be interleaved
+type openTx struct {
+	repository.Tx
+	finish chan error
+	done   chan error
+}
+
+func beginTx(t *testing.T, memory *repository.Memory) *openTx {
+	opened := make(chan repository.Tx)
+	tx := &openTx{finish: make(chan error), done: make(chan error, 1)}
+	go func() {
+		tx.done <- memory.WithTx(context.Background(), repository.TxOptions{}, func(inner repository.Tx) error {
+			opened <- inner
+			return <-tx.finish
+		})
+	}()
+	tx.Tx = <-opened
+	return tx
+}
+
+func (tx *openTx) commit() error {
+	tx.finish <- nil
+	return <-tx.done
+}
+
+func (tx *openTx) rollback() error {
+	tx.finish <- errRollback
+	if err := <-tx.done; err != errRollback {
+		return err
+	}
+	return nil
+}
+
+func TestMemory_CommitAndRollback(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		assert.NoError(t, tx.ChangeUserBalance(ctx, 1, "RUB", 50))
+		assert.NoError(t, tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: 50, Purpose: "rolled back", OpType: repository.OpDeposit, OperationID: uuid.NewString()}))
+		balance, err := tx.GetUserBalance(ctx, 1, "RUB", false)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(150), balance.Amount, "transaction sees its own changes")
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err, "error of fn is returned as is")
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		if err := tx.ChangeUserBalance(ctx, 1, "RUB", -30); err != nil {
+			return err
+		}
+		return tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: -30, Purpose: "committed", OpType: repository.OpWithdrawal, OperationID: uuid.NewString()})
+	})
+	assert.NoError(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		balance, err := tx.GetUserBalance(ctx, 1, "RUB", false)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(70), balance.Amount)
+
+		history, err := tx.GetUserHistory(ctx, 1, repository.HistoryFilter{}, repository.HistoryPage{Limit: 10})
+		assert.NoError(t, err)
+		if assert.Len(t, history, 1) {
+			assert.Equal(t, "committed", history[0].Purpose)
+		}
+
+		_, err = tx.GetUserBalance(ctx, 2, "RUB", false)
+		assert.Equal(t, sql.ErrNoRows, err)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestMemory_WithTx(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+
+	//failed statement is ignored by fn, but commit of aborted transaction fails like in PostgreSQL
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		assert.Error(t, tx.ChangeUserBalance(ctx, 1, "RUB", -101))
+		return nil
+	})
+	assert.Error(t, err, "failed commit is reported")
+
+	err = memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		return tx.ChangeUserBalance(ctx, 1, "RUB", 10)
+	})
+	assert.Equal(t, repository.CodeReadOnlyTransaction, repository.SQLState(err))
+
+	err = memory.WithTx(ctx, repository.TxOptions{Isolation: repository.Serializable}, func(tx repository.Tx) error {
+		return nil
+	})
+	assert.Error(t, err, "isolation which can't be provided is rejected")
+
+	var leaked repository.Tx
+	assert.Panics(t, func() {
+		_ = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+			leaked = tx
+			if err := tx.ChangeUserBalance(ctx, 1, "RUB", 10); err != nil {
+				return err
+			}
+			panic("fn failed")
+		})
+	})
+	_, err = leaked.GetUserBalance(ctx, 1, "RUB", false)
+	assert.Equal(t, sql.ErrTxDone, err, "transaction can't be used after WithTx returns")
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		//lock must be released by rolled back transaction
+		balance, err := tx.GetUserBalance(ctx, 1, "RUB", true)
+		assert.Equal(t, int64(100), balance.Amount, "panic rolls transaction back")
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestMemory_Constraints(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		err := tx.ChangeUserBalance(ctx, 1, "RUB", -101)
+		assert.Equal(t, repository.CodeCheckViolation, repository.SQLState(err))
+		//like in PostgreSQL failed statement aborts the whole transaction
+		_, err = tx.GetUserBalance(ctx, 1, "RUB", false)
+		assert.Equal(t, repository.CodeInFailedTransaction, repository.SQLState(err))
+		return err
+	})
+	assert.Error(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.CreateUser(ctx, 1)
+	})
+	assert.NoError(t, err, "existing user is kept")
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: 1, OpType: repository.OpDeposit, OperationID: "1"})
+	})
+	assert.Equal(t, repository.CodeInvalidTextRepresentation, repository.SQLState(err))
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: 1, OpType: repository.OpReversal, OperationID: uuid.NewString()})
+	})
+	assert.Equal(t, repository.CodeCheckViolation, repository.SQLState(err), "reversal must reference operation")
+}
+
+func TestMemory_Wallets(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		_, err := tx.GetUserBalance(ctx, 1, "USD", false)
+		assert.Equal(t, sql.ErrNoRows, err)
+		assert.NoError(t, tx.CreateWallet(ctx, 1, "USD"))
+		assert.NoError(t, tx.ChangeUserBalance(ctx, 1, "USD", 5))
+		assert.NoError(t, tx.CreateWallet(ctx, 1, "USD"), "existing wallet is kept")
+
+		balances, err := tx.GetUserBalances(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []repository.Balance{{Currency: "RUB", Amount: 100}, {Currency: "USD", Amount: 5}}, balances)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		balance, err := tx.GetUserBalance(ctx, 1, "USD", false)
+		assert.Equal(t, repository.Balance{Currency: "USD", Amount: 5}, balance)
+		balances, err := tx.GetUserBalances(ctx, 2)
+		assert.Empty(t, balances)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.CreateWallet(ctx, 2, "USD")
+	})
+	assert.Equal(t, repository.CodeForeignKeyViolation, repository.SQLState(err), "wallet belongs to existing user")
+}
+
+func TestMemory_GetOperation(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100, 2: 0})
+	ctx := context.Background()
+	operationID := uuid.NewString()
+
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		assert.NoError(t, tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: -10, OpType: repository.OpTransferOut, OperationID: operationID}))
+		assert.NoError(t, tx.UpdateHistory(ctx, 2, repository.Transfer{Amount: 10, OpType: repository.OpTransferIn, OperationID: operationID}))
+		assert.NoError(t, tx.UpdateHistory(ctx, 2, repository.Transfer{Amount: 5, OpType: repository.OpDeposit, OperationID: uuid.NewString()}))
+
+		entries, err := tx.GetOperation(ctx, operationID)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, int64(1), entries[0].UserID)
+			assert.Equal(t, int64(-10), entries[0].Amount)
+			assert.Equal(t, int64(2), entries[1].UserID)
+			assert.Equal(t, int64(10), entries[1].Amount)
+		}
+
+		entries, err = tx.GetOperation(ctx, uuid.NewString())
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+
+		//reversal references operation it refunds
+		reversalID := uuid.NewString()
+		assert.NoError(t, tx.UpdateHistory(ctx, 1, repository.Transfer{Amount: 4, OpType: repository.OpReversal, OperationID: reversalID, Reverses: &operationID}))
+		assert.NoError(t, tx.UpdateHistory(ctx, 2, repository.Transfer{Amount: -4, OpType: repository.OpReversal, OperationID: reversalID, Reverses: &operationID}))
+		entries, err = tx.GetReversals(ctx, operationID)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, reversalID, entries[0].OperationID)
+			assert.Equal(t, int64(4), entries[0].Amount)
+			assert.Equal(t, operationID, *entries[1].Reverses)
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+}
+
+func TestMemory_ExclusiveLock(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 0})
+	ctx := context.Background()
+
+	//only one worker at a time may hold the row between read for update and commit
+	const workers = 50
+	var wg sync.WaitGroup
+	var holders, maxHolders int32
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+				if _, err := tx.GetUserBalance(ctx, 1, "RUB", true); err != nil {
+					return err
+				}
+
+				current := atomic.AddInt32(&holders, 1)
+				for {
+					observed := atomic.LoadInt32(&maxHolders)
+					if current <= observed || atomic.CompareAndSwapInt32(&maxHolders, observed, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				defer atomic.AddInt32(&holders, -1)
+				return tx.ChangeUserBalance(ctx, 1, "RUB", 1)
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), maxHolders)
+
+	err := memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		balance, err := tx.GetUserBalance(ctx, 1, "RUB", false)
+		assert.Equal(t, int64(workers), balance.Amount)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestMemory_SharedLock(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+
+	first, second := beginTx(t, memory), beginTx(t, memory)
+	_, err := first.GetUserBalance(ctx, 1, "RUB", false)
+	assert.NoError(t, err)
+	_, err = second.GetUserBalance(ctx, 1, "RUB", false)
+	assert.NoError(t, err, "shared locks do not conflict")
+
+	writer := beginTx(t, memory)
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = writer.GetUserBalance(timeout, 1, "RUB", true)
+	assert.Equal(t, context.DeadlineExceeded, err, "exclusive lock waits for shared ones")
+	assert.NoError(t, writer.rollback())
+
+	updated := make(chan error, 1)
+	writer = beginTx(t, memory)
+	go func() {
+		updated <- writer.ChangeUserBalance(ctx, 1, "RUB", 10)
+	}()
+	assert.NoError(t, first.commit())
+	select {
+	case <-updated:
+		t.Fatal("update must wait for all shared locks")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.NoError(t, second.commit())
+	assert.NoError(t, <-updated)
+	assert.NoError(t, writer.commit())
+}
+
+func TestMemory_Deadlock(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100, 2: 100})
+	ctx := context.Background()
+
+	first, second := beginTx(t, memory), beginTx(t, memory)
+	_, err := first.GetUserBalance(ctx, 1, "RUB", true)
+	assert.NoError(t, err)
+	_, err = second.GetUserBalance(ctx, 2, "RUB", true)
+	assert.NoError(t, err)
+
+	firstResult := make(chan error, 1)
+	go func() {
+		_, err := first.GetUserBalance(ctx, 2, "RUB", true)
+		firstResult <- err
+	}()
+	//let first transaction start waiting
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = second.GetUserBalance(ctx, 1, "RUB", true)
+	assert.Equal(t, repository.CodeDeadlockDetected, repository.SQLState(err))
+	assert.NoError(t, second.rollback())
+
+	assert.NoError(t, <-firstResult, "first transaction continues after second one is rolled back")
+	assert.NoError(t, first.commit())
+}
+
+func TestMemory_Reservations(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100})
+	ctx := context.Background()
+	now := time.Now()
+
+	reservations := make([]repository.Reservation, 2)
+	for i := range reservations {
+		reservations[i] = repository.Reservation{ID: uuid.NewString(), UserID: 1, Amount: 30,
+			Status: repository.ReservationActive, CreatedAt: now, ExpiresAt: now.Add(-time.Second)}
+	}
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		for _, reservation := range reservations {
+			if err := tx.ChangeUserReserved(ctx, 1, "RUB", reservation.Amount); err != nil {
+				return err
+			}
+			if err := tx.CreateReservation(ctx, reservation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	//reserved money can't be withdrawn or reserved twice
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.ChangeUserBalance(ctx, 1, "RUB", -41)
+	})
+	assert.Equal(t, repository.CodeCheckViolation, repository.SQLState(err))
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.ChangeUserReserved(ctx, 1, "RUB", 41)
+	})
+	assert.Equal(t, repository.CodeCheckViolation, repository.SQLState(err))
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.CreateReservation(ctx, repository.Reservation{ID: uuid.NewString(), UserID: 2, Amount: 1, Status: repository.ReservationActive})
+	})
+	assert.Equal(t, repository.CodeForeignKeyViolation, repository.SQLState(err))
+
+	//reservation locked by another transaction is skipped by expiry
+	holder := beginTx(t, memory)
+	_, err = holder.GetReservation(ctx, reservations[0].ID, true)
+	assert.NoError(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		expired, err := tx.GetExpiredReservations(ctx, now, 10)
+		if assert.NoError(t, err) && assert.Len(t, expired, 1) {
+			assert.Equal(t, reservations[1].ID, expired[0].ID)
+			expired[0].Status = repository.ReservationExpired
+			assert.NoError(t, tx.ChangeUserReserved(ctx, 1, "RUB", -expired[0].Amount))
+			assert.NoError(t, tx.FinishReservation(ctx, expired[0]))
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, holder.commit())
+
+	err = memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		balance, err := tx.GetUserBalance(ctx, 1, "RUB", false)
+		assert.Equal(t, repository.Balance{Currency: "RUB", Amount: 100, Reserved: 30}, balance)
+		expired, err := tx.GetReservation(ctx, reservations[1].ID, false)
+		assert.Equal(t, repository.ReservationExpired, expired.Status)
+		_, missing := tx.GetReservation(ctx, uuid.NewString(), false)
+		assert.Equal(t, sql.ErrNoRows, missing)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func TestMemory_Schedules(t *testing.T) {
+	memory := newMemoryWithUsers(t, map[int64]int64{1: 100, 2: 0})
+	ctx := context.Background()
+	now := time.Now()
+
+	schedules := make([]repository.Schedule, 2)
+	for i := range schedules {
+		next := now.Add(time.Duration(i-2) * time.Second)
+		schedules[i] = repository.Schedule{ID: uuid.NewString(), SenderID: 1, RecipientID: 2, Amount: 10, StartAt: next,
+			NextRunAt: &next, Status: repository.ScheduleActive, CreatedAt: now}
+	}
+	err := memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		for _, schedule := range schedules {
+			if err := tx.CreateSchedule(ctx, schedule); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.CreateSchedule(ctx, repository.Schedule{ID: uuid.NewString(), SenderID: 1, RecipientID: 3, Amount: 10,
+			NextRunAt: &now, Status: repository.ScheduleActive})
+	})
+	assert.Equal(t, repository.CodeForeignKeyViolation, repository.SQLState(err))
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		return tx.CreateSchedule(ctx, repository.Schedule{ID: uuid.NewString(), SenderID: 1, RecipientID: 2, Amount: 10,
+			Status: repository.ScheduleActive})
+	})
+	assert.Equal(t, repository.CodeCheckViolation, repository.SQLState(err), "active schedule must have next run")
+
+	//schedule locked by another worker is skipped
+	holder := beginTx(t, memory)
+	due, err := holder.GetDueSchedules(ctx, now, nil, 1)
+	if assert.NoError(t, err) && assert.Len(t, due, 1) {
+		assert.Equal(t, schedules[0].ID, due[0].ID, "the earliest schedule goes first")
+	}
+
+	err = memory.WithTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		skipped, err := tx.GetDueSchedules(ctx, now, []string{schedules[1].ID}, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, skipped, "skipped schedules are not returned")
+		due, err := tx.GetDueSchedules(ctx, now, nil, 10)
+		if assert.NoError(t, err) && assert.Len(t, due, 1) {
+			assert.Equal(t, schedules[1].ID, due[0].ID)
+			run := repository.ScheduleRun{ScheduleID: due[0].ID, ScheduledAt: *due[0].NextRunAt, ExecutedAt: now, Status: repository.RunSucceeded}
+			assert.NoError(t, tx.AddScheduleRun(ctx, run))
+			assert.Equal(t, repository.CodeUniqueViolation, repository.SQLState(tx.AddScheduleRun(ctx, run)), "due time runs once")
+		}
+		return nil
+	})
+	assert.Error(t, err, "failed statement aborts transaction")
+	assert.NoError(t, holder.commit())
+
+	err = memory.WithTx(ctx, repository.TxOptions{ReadOnly: true}, func(tx repository.Tx) error {
+		runs, err := tx.GetScheduleRuns(ctx, schedules[1].ID, 10)
+		assert.Empty(t, runs, "runs are rolled back with transaction")
+		//schedules created at the same time are ordered by id
+		newest, err := tx.GetUserSchedules(ctx, 1, "", repository.SchedulePage{Limit: 1})
+		if assert.NoError(t, err) && assert.Len(t, newest, 1) {
+			position := newest[0].Position()
+			rest, err := tx.GetUserSchedules(ctx, 1, "", repository.SchedulePage{After: &position, Limit: 10})
+			if assert.NoError(t, err) && assert.Len(t, rest, 1) {
+				assert.Greater(t, newest[0].ID, rest[0].ID)
+			}
+		}
+		completed, err := tx.GetUserSchedules(ctx, 1, repository.ScheduleCompleted, repository.SchedulePage{Limit: 10})
+		assert.Empty(t, completed)
+		_, missing := tx.GetSchedule(ctx, uuid.NewString(), false)
+		assert.Equal(t, sql.ErrNoRows, missing)
+		return err
+	})
+	assert.NoError(t, err)
+}
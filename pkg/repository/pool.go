@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"balance/pkg/config"
+	"context"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//Pool is repository working through native pgx connection pool,
+//it avoids database/sql overhead and caches prepared statements per connection
+type Pool struct {
+	pool *pgxpool.Pool
+	cfg  config.Database
+}
+
+func NewPool(cfg config.Database) *Pool {
+	return &Pool{cfg: cfg}
+}
+
+func (pool *Pool) Open() error {
+	poolConfig, err := pgxpool.ParseConfig(pool.cfg.DSN())
+	if err != nil {
+		return err
+	}
+
+	poolConfig.MaxConns = int32(pool.cfg.MaxConns)
+	poolConfig.MinConns = int32(pool.cfg.MinConns)
+	poolConfig.MaxConnLifetime = pool.cfg.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = pool.cfg.MaxConnIdleTime
+	poolConfig.HealthCheckPeriod = pool.cfg.HealthCheckPeriod
+
+	//connection is opened on first use, as database/sql does
+	poolConfig.LazyConnect = true
+
+	if pool.cfg.StatementCacheCapacity == 0 {
+		poolConfig.ConnConfig.BuildStatementCache = nil
+	} else {
+		mode := stmtcache.ModePrepare
+		if pool.cfg.StatementCacheMode == "describe" {
+			mode = stmtcache.ModeDescribe
+		}
+		capacity := pool.cfg.StatementCacheCapacity
+		poolConfig.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, mode, capacity)
+		}
+	}
+
+	pool.pool, err = pgxpool.ConnectConfig(context.Background(), poolConfig)
+	return err
+}
+
+func (pool *Pool) Close() error {
+	pool.pool.Close()
+	return nil
+}
+
+//WithTx runs fn in transaction, it is committed if fn returns nil and rolled back otherwise.
+//Transaction is rolled back automatically if ctx is done before commit
+func (pool *Pool) WithTx(ctx context.Context, opts TxOptions, fn func(tx Tx) error) error {
+	tx, err := pool.pool.BeginTx(ctx, opts.pgx())
+	if err != nil {
+		return err
+	}
+	return run(pgxExecutor{tx, ctx}, fn)
+}
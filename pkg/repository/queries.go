@@ -1,49 +1,102 @@
 package repository
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
+	"encoding/json"
 	"time"
 )
 
-type Transaction struct {
-	tx *sql.Tx
-}
-
 type Transfer struct {
+	ID int64
+	//minor units of Currency
 	Amount        int64
+	Currency      string
 	TransferredAt time.Time
 	Purpose       string
+	OpType        string
+	//user on the other side of transfer
+	Counterparty *int64
+	//id of operation in external service
+	ExternalRef *string
+	Metadata    map[string]string
+	//globally unique id of operation, both legs of transfer between users have the same one
+	OperationID string
+	//operation refunded by reversal, nil for other operation types
+	Reverses *string
 }
+
+//OperationEntry is history entry of operation together with user it belongs to
+type OperationEntry struct {
+	UserID int64
+	Transfer
+}
+
+//IdempotencyRecord is outcome of operation stored under caller's idempotency key
+type IdempotencyRecord struct {
+	Key string
+	//identifies request parameters, the same key can't be used for another request
+	Fingerprint string
+	//nil until operation made with the key is finished
+	Response  []byte
+	CreatedAt time.Time
+}
+
+//Balance is user's wallet in one currency, amounts are minor units of it
 type Balance struct {
-	Amount int64
+	Currency string
+	Amount   int64
+	//part of amount held by active reservations
+	Reserved int64
+}
+
+//queries are shared by every PostgreSQL implementation and run through transaction executor
+type queries struct {
+	exec executor
 }
 
-func (postgres *Postgres) UserExists(tx *Transaction, id int64) (bool, error) {
-	row := postgres.db.QueryRow("SELECT EXISTS(SELECT balance from UserBalance where id = $1)", id)
+func (queries queries) UserExists(ctx context.Context, id int64) (bool, error) {
+	row := queries.exec.queryRow(ctx, "SELECT EXISTS(SELECT id from Users where id = $1)", id)
 	var exists bool
 	err := row.Scan(&exists)
 	return exists, err
 }
 
-func (postgres *Postgres) GetUserBalance(tx *Transaction, id int64, forUpdate bool) (Balance, error) {
-	var accessType string
+//GetUserBalance returns sql.ErrNoRows if user has no wallet in currency
+func (queries queries) GetUserBalance(ctx context.Context, id int64, currency string, forUpdate bool) (Balance, error) {
+	//query text does not depend on id, so statement is prepared once and cached
+	query := "SELECT balance, reserved FROM UserBalance WHERE id = $1 AND currency = $2 FOR SHARE"
 	if forUpdate {
-		accessType = "FOR UPDATE"
-	} else {
-		accessType = "FOR SHARE"
+		query = "SELECT balance, reserved FROM UserBalance WHERE id = $1 AND currency = $2 FOR UPDATE"
 	}
+	row := queries.exec.queryRow(ctx, query, id, currency)
 
-	query := fmt.Sprintf("SELECT balance FROM UserBalance WHERE id = %d %s", id, accessType)
-	row := tx.tx.QueryRow(query)
+	balance := Balance{Currency: currency}
+	err := row.Scan(&balance.Amount, &balance.Reserved)
+	return balance, err
+}
+
+//GetUserBalances returns every wallet of user ordered by currency, they are not locked
+func (queries queries) GetUserBalances(ctx context.Context, id int64) ([]Balance, error) {
+	rows, err := queries.exec.query(ctx, "SELECT currency, balance, reserved FROM UserBalance WHERE id = $1 ORDER BY currency", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var balance int64 = 0
-	err := row.Scan(&balance)
-	return Balance{balance}, err
+	balances := make([]Balance, 0)
+	for rows.Next() {
+		var balance Balance
+		if err = rows.Scan(&balance.Currency, &balance.Amount, &balance.Reserved); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
 }
 
-func (postgres *Postgres) GetUserHistory(tx *Transaction, id int64) ([]Transfer, error) {
-	rows, err := tx.tx.Query("SELECT amount, transferred_at, purpose FROM UserTransfers where id = $1", id)
+func (queries queries) GetUserHistory(ctx context.Context, id int64, filter HistoryFilter, page HistoryPage) ([]Transfer, error) {
+	query, args := historyQuery(id, filter, page)
+	rows, err := queries.exec.query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -53,27 +106,138 @@ func (postgres *Postgres) GetUserHistory(tx *Transaction, id int64) ([]Transfer,
 
 	for rows.Next() {
 		var transfer Transfer
-		err = rows.Scan(&transfer.Amount, &transfer.TransferredAt, &transfer.Purpose)
-		if err != nil {
+		if err = scanTransfer(rows, &transfer); err != nil {
 			return nil, err
 		}
 		transfers = append(transfers, transfer)
 	}
-	return transfers, nil
+	return transfers, rows.Err()
+}
+
+//GetOperation returns every history entry of operation ordered by id, so sender goes before recipient.
+//Unknown operation gives empty result
+func (queries queries) GetOperation(ctx context.Context, operationID string) ([]OperationEntry, error) {
+	rows, err := queries.exec.query(ctx, "SELECT id, "+transferColumns+" FROM UserTransfers WHERE operation_id = $1 ORDER BY transfer_id", operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]OperationEntry, 0, 2)
+	for rows.Next() {
+		var entry OperationEntry
+		if err = scanTransfer(rows, &entry.Transfer, &entry.UserID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+//GetReversals returns every history entry of reversals made for operation ordered by id
+func (queries queries) GetReversals(ctx context.Context, operationID string) ([]OperationEntry, error) {
+	rows, err := queries.exec.query(ctx, "SELECT id, "+transferColumns+" FROM UserTransfers WHERE reverses = $1 ORDER BY transfer_id", operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]OperationEntry, 0)
+	for rows.Next() {
+		var entry OperationEntry
+		if err = scanTransfer(rows, &entry.Transfer, &entry.UserID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
 }
 
-func (postgres *Postgres) CreateUser(tx *Transaction, id int64) error {
-	_, err := tx.tx.Exec("INSERT INTO UserBalance (id, balance) VALUES ($1, 0)", id)
-	return err
+//CreateUser adds user without wallets, user which already exists is kept as it is,
+//so concurrent first creditings of the same user don't fail
+func (queries queries) CreateUser(ctx context.Context, id int64) error {
+	return queries.exec.exec(ctx, "INSERT INTO Users (id) VALUES ($1) ON CONFLICT (id) DO NOTHING", id)
 }
 
-func (postgres *Postgres) ChangeUserBalance(tx *Transaction, id int64, amount int64) error {
-	_, err := tx.tx.Exec("UPDATE UserBalance SET balance = balance + $1 WHERE id = $2", amount, id)
-	return err
+//CreateWallet opens empty wallet of existing user, wallet which already exists is kept as it is
+func (queries queries) CreateWallet(ctx context.Context, id int64, currency string) error {
+	return queries.exec.exec(ctx, `INSERT INTO UserBalance (id, currency, balance) VALUES ($1, $2, 0)
+		ON CONFLICT (id, currency) DO NOTHING`, id, currency)
 }
 
-func (postgres *Postgres) UpdateHistory(tx *Transaction, id int64, amount int64, purpose string) error {
-	_, err := tx.tx.Exec("INSERT INTO UserTransfers (id, amount, transferred_at, purpose) VALUES ($1, $2, $3, $4)",
-		id, amount, time.Now(), purpose)
-	return err
+func (queries queries) ChangeUserBalance(ctx context.Context, id int64, currency string, amount int64) error {
+	return queries.exec.exec(ctx, "UPDATE UserBalance SET balance = balance + $1 WHERE id = $2 AND currency = $3", amount, id, currency)
+}
+
+//UpdateHistory adds transfer to user's history, its id and time are set by repository, operation id by caller
+func (queries queries) UpdateHistory(ctx context.Context, id int64, transfer Transfer) error {
+	metadata, err := jsonText(transfer.Metadata)
+	if err != nil {
+		return err
+	}
+	return queries.exec.exec(ctx, `INSERT INTO UserTransfers (id, operation_id, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		id, transfer.OperationID, transfer.Amount, transfer.Currency, time.Now(), transfer.Purpose, transfer.OpType, transfer.Counterparty, transfer.ExternalRef,
+		metadata, transfer.Reverses)
+}
+
+//ClaimIdempotencyKey stores record unless its key already exists and returns stored record.
+//Row stays locked until transaction ends, so concurrent requests with the same key wait
+//for the first one to finish and see its outcome
+func (queries queries) ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error) {
+	err := queries.exec.exec(ctx, `INSERT INTO IdempotencyKeys (idempotency_key, fingerprint, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (idempotency_key) DO NOTHING`, record.Key, record.Fingerprint, record.CreatedAt)
+	if err != nil {
+		return IdempotencyRecord{}, err
+	}
+
+	row := queries.exec.queryRow(ctx, "SELECT fingerprint, response, created_at FROM IdempotencyKeys WHERE idempotency_key = $1 FOR UPDATE", record.Key)
+	stored := IdempotencyRecord{Key: record.Key}
+	err = row.Scan(&stored.Fingerprint, &stored.Response, &stored.CreatedAt)
+	return stored, err
+}
+
+//SaveIdempotencyKey overwrites record claimed by the same transaction
+func (queries queries) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	//response is passed as JSON text like metadata
+	var response interface{}
+	if record.Response != nil {
+		response = string(record.Response)
+	}
+	return queries.exec.exec(ctx, "UPDATE IdempotencyKeys SET fingerprint = $1, response = $2, created_at = $3 WHERE idempotency_key = $4",
+		record.Fingerprint, response, record.CreatedAt, record.Key)
+}
+
+//DeleteIdempotencyKeys deletes records created before given time
+func (queries queries) DeleteIdempotencyKeys(ctx context.Context, before time.Time) error {
+	return queries.exec.exec(ctx, "DELETE FROM IdempotencyKeys WHERE created_at < $1", before)
+}
+
+//jsonText encodes metadata as JSON text, so both drivers pass it the same way. Empty metadata is NULL
+func jsonText(metadata map[string]string) (interface{}, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+//transferColumns are read by scanTransfer, uuid is read as text so both drivers scan it into string
+const transferColumns = "transfer_id, operation_id::text, amount, currency, transferred_at, purpose, op_type, counterparty, external_ref, metadata, reverses::text"
+
+//scanTransfer reads transferColumns, columns selected before them are read into prefix
+func scanTransfer(row row, transfer *Transfer, prefix ...interface{}) error {
+	var metadata []byte
+	dest := append(prefix, &transfer.ID, &transfer.OperationID, &transfer.Amount, &transfer.Currency, &transfer.TransferredAt, &transfer.Purpose,
+		&transfer.OpType, &transfer.Counterparty, &transfer.ExternalRef, &metadata, &transfer.Reverses)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if metadata != nil {
+		return json.Unmarshal(metadata, &transfer.Metadata)
+	}
+	return nil
 }
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+//statuses of reservations, only active one holds money
+const (
+	ReservationActive   = "active"
+	ReservationCaptured = "captured"
+	ReservationReleased = "released"
+	ReservationExpired  = "expired"
+)
+
+//Reservation is money of user held until it is captured, released or expires
+type Reservation struct {
+	ID        string
+	UserID    int64
+	Amount    int64
+	Currency  string
+	Status    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	//set when reservation stops being active
+	FinishedAt *time.Time
+	//part of amount charged by capture and operation id of its history entry
+	Captured    int64
+	OperationID *string
+	Purpose     string
+	ExternalRef *string
+	Metadata    map[string]string
+}
+
+//CreateReservation stores new reservation, money must be held by ChangeUserReserved in the same transaction
+func (queries queries) CreateReservation(ctx context.Context, reservation Reservation) error {
+	metadata, err := jsonText(reservation.Metadata)
+	if err != nil {
+		return err
+	}
+	return queries.exec.exec(ctx, `INSERT INTO Reservations (reservation_id, user_id, amount, currency, status, created_at, expires_at, purpose,
+		external_ref, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		reservation.ID, reservation.UserID, reservation.Amount, reservation.Currency, reservation.Status, reservation.CreatedAt, reservation.ExpiresAt,
+		reservation.Purpose, reservation.ExternalRef, metadata)
+}
+
+//GetReservation returns sql.ErrNoRows for unknown reservation, row is locked until transaction ends if forUpdate is set
+func (queries queries) GetReservation(ctx context.Context, id string, forUpdate bool) (Reservation, error) {
+	query := "SELECT " + reservationColumns + " FROM Reservations WHERE reservation_id = $1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var reservation Reservation
+	err := scanReservation(queries.exec.queryRow(ctx, query, id), &reservation)
+	return reservation, err
+}
+
+//GetExpiredReservations returns up to limit active reservations which expired before given time.
+//They are locked, reservations locked by other transactions are skipped, so several workers
+//can release them at once
+func (queries queries) GetExpiredReservations(ctx context.Context, before time.Time, limit int) ([]Reservation, error) {
+	rows, err := queries.exec.query(ctx, "SELECT "+reservationColumns+` FROM Reservations
+		WHERE status = 'active' AND expires_at <= $1 ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := make([]Reservation, 0)
+	for rows.Next() {
+		var reservation Reservation
+		if err = scanReservation(rows, &reservation); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, rows.Err()
+}
+
+//FinishReservation saves status, finish time and captured part of reservation locked by the same transaction
+func (queries queries) FinishReservation(ctx context.Context, reservation Reservation) error {
+	return queries.exec.exec(ctx, "UPDATE Reservations SET status = $1, finished_at = $2, captured = $3, operation_id = $4 WHERE reservation_id = $5",
+		reservation.Status, reservation.FinishedAt, reservation.Captured, reservation.OperationID, reservation.ID)
+}
+
+//ChangeUserReserved changes money held by reservations in wallet, it can't exceed balance of the wallet
+func (queries queries) ChangeUserReserved(ctx context.Context, id int64, currency string, amount int64) error {
+	return queries.exec.exec(ctx, "UPDATE UserBalance SET reserved = reserved + $1 WHERE id = $2 AND currency = $3", amount, id, currency)
+}
+
+//reservationColumns are read by scanReservation, uuids are read as text like in transferColumns
+const reservationColumns = "reservation_id::text, user_id, amount, currency, status, created_at, expires_at, finished_at, captured, " +
+	"operation_id::text, purpose, external_ref, metadata"
+
+func scanReservation(row row, reservation *Reservation) error {
+	var purpose *string
+	var metadata []byte
+	err := row.Scan(&reservation.ID, &reservation.UserID, &reservation.Amount, &reservation.Currency, &reservation.Status, &reservation.CreatedAt,
+		&reservation.ExpiresAt, &reservation.FinishedAt, &reservation.Captured, &reservation.OperationID, &purpose,
+		&reservation.ExternalRef, &metadata)
+	if err != nil {
+		return err
+	}
+	if purpose != nil {
+		reservation.Purpose = *purpose
+	}
+	if metadata != nil {
+		return json.Unmarshal(metadata, &reservation.Metadata)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//statuses of schedules, only active one is executed
+const (
+	ScheduleActive    = "active"
+	ScheduleCompleted = "completed"
+	ScheduleCanceled  = "canceled"
+)
+
+//recurrences of schedules, one-time schedule has none
+const (
+	RecurrenceDaily   = "daily"
+	RecurrenceWeekly  = "weekly"
+	RecurrenceMonthly = "monthly"
+)
+
+//outcomes of schedule runs
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+//Schedule is transfer made by service at given time, once or repeatedly
+type Schedule struct {
+	ID          string
+	SenderID    int64
+	RecipientID int64
+	Amount      int64
+	Currency    string
+	//nil for one-time transfer
+	Recurrence *string
+	StartAt    time.Time
+	//due times already executed
+	Runs int
+	//nil when schedule is not active anymore
+	NextRunAt   *time.Time
+	Status      string
+	CreatedAt   time.Time
+	CanceledAt  *time.Time
+	Purpose     string
+	ExternalRef *string
+	Metadata    map[string]string
+}
+
+//SchedulePosition is place of schedule in sender's list, schedules created at the same time are ordered by id
+type SchedulePosition struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+//SchedulePage selects up to Limit schedules from newest to oldest, starting right after given position
+type SchedulePage struct {
+	//first page is returned if nil
+	After *SchedulePosition
+	Limit int
+}
+
+//Position returns place of schedule in sender's list
+func (schedule Schedule) Position() SchedulePosition {
+	return SchedulePosition{CreatedAt: schedule.CreatedAt, ID: schedule.ID}
+}
+
+//before tells if schedule at position a goes before b in sender's list
+func (a SchedulePosition) before(b SchedulePosition) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+//ScheduleRun is outcome of one due time of schedule
+type ScheduleRun struct {
+	ID          int64
+	ScheduleID  string
+	ScheduledAt time.Time
+	ExecutedAt  time.Time
+	Status      string
+	//set for succeeded run
+	OperationID *string
+	//set for failed run
+	Error *string
+}
+
+func (queries queries) CreateSchedule(ctx context.Context, schedule Schedule) error {
+	metadata, err := jsonText(schedule.Metadata)
+	if err != nil {
+		return err
+	}
+	return queries.exec.exec(ctx, `INSERT INTO Schedules (schedule_id, sender_id, recipient_id, amount, currency, recurrence, start_at, runs,
+		next_run_at, status, created_at, purpose, external_ref, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		schedule.ID, schedule.SenderID, schedule.RecipientID, schedule.Amount, schedule.Currency, schedule.Recurrence, schedule.StartAt, schedule.Runs,
+		schedule.NextRunAt, schedule.Status, schedule.CreatedAt, schedule.Purpose, schedule.ExternalRef, metadata)
+}
+
+//GetSchedule returns sql.ErrNoRows for unknown schedule, row is locked until transaction ends if forUpdate is set
+func (queries queries) GetSchedule(ctx context.Context, id string, forUpdate bool) (Schedule, error) {
+	query := "SELECT " + scheduleColumns + " FROM Schedules WHERE schedule_id = $1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var schedule Schedule
+	err := scanSchedule(queries.exec.queryRow(ctx, query, id), &schedule)
+	return schedule, err
+}
+
+//GetUserSchedules returns page of sender's schedules from newest to oldest, only ones in given status if it is set
+func (queries queries) GetUserSchedules(ctx context.Context, senderID int64, status string, page SchedulePage) ([]Schedule, error) {
+	query, args := userSchedulesQuery(senderID, status, page)
+	return queries.schedules(ctx, query, args...)
+}
+
+//userSchedulesQuery builds query served by index on (sender_id, created_at)
+func userSchedulesQuery(senderID int64, status string, page SchedulePage) (string, []interface{}) {
+	args := []interface{}{senderID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"sender_id = $1"}
+	if status != "" {
+		conditions = append(conditions, "status = "+arg(status))
+	}
+	if page.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(created_at, schedule_id) < (%s, %s)", arg(page.After.CreatedAt), arg(page.After.ID)))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM Schedules WHERE %s ORDER BY created_at DESC, schedule_id DESC LIMIT %s",
+		scheduleColumns, strings.Join(conditions, " AND "), arg(page.Limit))
+	return query, args
+}
+
+//GetDueSchedules returns up to limit active schedules which are due at given time, earliest first, except skipped ones.
+//They are locked, schedules locked by other transactions are skipped, so workers of several
+//service instances never execute the same schedule at once
+func (queries queries) GetDueSchedules(ctx context.Context, before time.Time, skip []string, limit int) ([]Schedule, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return queries.schedules(ctx, "SELECT "+scheduleColumns+` FROM Schedules
+		WHERE status = 'active' AND next_run_at <= $1 AND schedule_id::text <> ALL($2::text[])
+		ORDER BY next_run_at LIMIT $3 FOR UPDATE SKIP LOCKED`, before, skip, limit)
+}
+
+//UpdateSchedule saves progress and status of schedule locked by the same transaction
+func (queries queries) UpdateSchedule(ctx context.Context, schedule Schedule) error {
+	return queries.exec.exec(ctx, "UPDATE Schedules SET runs = $1, next_run_at = $2, status = $3, canceled_at = $4 WHERE schedule_id = $5",
+		schedule.Runs, schedule.NextRunAt, schedule.Status, schedule.CanceledAt, schedule.ID)
+}
+
+//AddScheduleRun stores outcome of due time, its id is set by repository
+func (queries queries) AddScheduleRun(ctx context.Context, run ScheduleRun) error {
+	return queries.exec.exec(ctx, `INSERT INTO ScheduleRuns (schedule_id, scheduled_at, executed_at, status, operation_id, error)
+		VALUES ($1, $2, $3, $4, $5, $6)`, run.ScheduleID, run.ScheduledAt, run.ExecutedAt, run.Status, run.OperationID, run.Error)
+}
+
+//GetScheduleRuns returns up to limit latest runs of schedule, newest first
+func (queries queries) GetScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]ScheduleRun, error) {
+	rows, err := queries.exec.query(ctx, `SELECT run_id, schedule_id::text, scheduled_at, executed_at, status, operation_id::text, error
+		FROM ScheduleRuns WHERE schedule_id = $1 ORDER BY run_id DESC LIMIT $2`, scheduleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]ScheduleRun, 0)
+	for rows.Next() {
+		var run ScheduleRun
+		err = rows.Scan(&run.ID, &run.ScheduleID, &run.ScheduledAt, &run.ExecutedAt, &run.Status, &run.OperationID, &run.Error)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (queries queries) schedules(ctx context.Context, query string, args ...interface{}) ([]Schedule, error) {
+	rows, err := queries.exec.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		var schedule Schedule
+		if err = scanSchedule(rows, &schedule); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+//scheduleColumns are read by scanSchedule, uuid is read as text like in transferColumns
+const scheduleColumns = "schedule_id::text, sender_id, recipient_id, amount, currency, recurrence, start_at, runs, next_run_at, status, " +
+	"created_at, canceled_at, purpose, external_ref, metadata"
+
+func scanSchedule(row row, schedule *Schedule) error {
+	var purpose *string
+	var metadata []byte
+	err := row.Scan(&schedule.ID, &schedule.SenderID, &schedule.RecipientID, &schedule.Amount, &schedule.Currency, &schedule.Recurrence, &schedule.StartAt,
+		&schedule.Runs, &schedule.NextRunAt, &schedule.Status, &schedule.CreatedAt, &schedule.CanceledAt, &purpose,
+		&schedule.ExternalRef, &metadata)
+	if err != nil {
+		return err
+	}
+	if purpose != nil {
+		schedule.Purpose = *purpose
+	}
+	if metadata != nil {
+		return json.Unmarshal(metadata, &schedule.Metadata)
+	}
+	return nil
+}
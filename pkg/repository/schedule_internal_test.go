@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserSchedulesQuery(t *testing.T) {
+	after := &SchedulePosition{CreatedAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), ID: "5f1d7b2e-8f43-4c1a-9d0e-2b6a3c4d5e6f"}
+
+	var tests = []struct {
+		name          string
+		status        string
+		page          SchedulePage
+		expectedQuery string
+		expectedArgs  []interface{}
+	}{
+		{
+			name: "first page",
+			page: SchedulePage{Limit: 10},
+			expectedQuery: "SELECT " + scheduleColumns + " FROM Schedules " +
+				"WHERE sender_id = $1 ORDER BY created_at DESC, schedule_id DESC LIMIT $2",
+			expectedArgs: []interface{}{int64(1), 10},
+		},
+		{
+			name:   "next page of active schedules",
+			status: ScheduleActive,
+			page:   SchedulePage{After: after, Limit: 10},
+			expectedQuery: "SELECT " + scheduleColumns + " FROM Schedules " +
+				"WHERE sender_id = $1 AND status = $2 AND (created_at, schedule_id) < ($3, $4) ORDER BY created_at DESC, schedule_id DESC LIMIT $5",
+			expectedArgs: []interface{}{int64(1), "active", after.CreatedAt, after.ID, 10},
+		},
+	}
+
+	spaces := regexp.MustCompile(`\s+`)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args := userSchedulesQuery(1, test.status, test.page)
+			assert.Equal(t, test.expectedQuery, strings.TrimSpace(spaces.ReplaceAllString(query, " ")))
+			assert.Equal(t, test.expectedArgs, args)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//IsolationLevel of transaction, zero value is PostgreSQL default read committed
+type IsolationLevel int
+
+const (
+	ReadCommitted IsolationLevel = iota
+	RepeatableRead
+	Serializable
+)
+
+//TxOptions of transaction opened by WithTx
+type TxOptions struct {
+	Isolation IsolationLevel
+	//every write in read only transaction fails
+	ReadOnly bool
+}
+
+//Tx runs queries inside transaction opened by WithTx. It is the only way to query repository,
+//so no query can run outside of transaction. Tx must not be used after fn given to WithTx returns
+type Tx interface {
+	UserExists(ctx context.Context, id int64) (bool, error)
+	GetUserBalance(ctx context.Context, id int64, currency string, forUpdate bool) (Balance, error)
+	GetUserBalances(ctx context.Context, id int64) ([]Balance, error)
+	GetUserHistory(ctx context.Context, id int64, filter HistoryFilter, page HistoryPage) ([]Transfer, error)
+	CreateUser(ctx context.Context, id int64) error
+	CreateWallet(ctx context.Context, id int64, currency string) error
+	ChangeUserBalance(ctx context.Context, id int64, currency string, amount int64) error
+	UpdateHistory(ctx context.Context, id int64, transfer Transfer) error
+	GetOperation(ctx context.Context, operationID string) ([]OperationEntry, error)
+	GetReversals(ctx context.Context, operationID string) ([]OperationEntry, error)
+	ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, error)
+	SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	DeleteIdempotencyKeys(ctx context.Context, before time.Time) error
+	ChangeUserReserved(ctx context.Context, id int64, currency string, amount int64) error
+	CreateReservation(ctx context.Context, reservation Reservation) error
+	GetReservation(ctx context.Context, id string, forUpdate bool) (Reservation, error)
+	GetExpiredReservations(ctx context.Context, before time.Time, limit int) ([]Reservation, error)
+	FinishReservation(ctx context.Context, reservation Reservation) error
+	CreateSchedule(ctx context.Context, schedule Schedule) error
+	GetSchedule(ctx context.Context, id string, forUpdate bool) (Schedule, error)
+	GetUserSchedules(ctx context.Context, senderID int64, status string, page SchedulePage) ([]Schedule, error)
+	GetDueSchedules(ctx context.Context, before time.Time, skip []string, limit int) ([]Schedule, error)
+	UpdateSchedule(ctx context.Context, schedule Schedule) error
+	AddScheduleRun(ctx context.Context, run ScheduleRun) error
+	GetScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]ScheduleRun, error)
+}
+
+//run finishes transaction opened by one of PostgreSQL implementations: it is committed if fn succeeds
+//and rolled back if fn fails or panics. Failed commit is returned, so changes which were not saved
+//are never reported as done
+func run(exec executor, fn func(tx Tx) error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			exec.rollback()
+			panic(recovered)
+		}
+	}()
+
+	if err := fn(queries{exec}); err != nil {
+		//error of fn tells more than error of rollback
+		exec.rollback()
+		return err
+	}
+	return exec.commit()
+}
+
+func (opts TxOptions) sql() *sql.TxOptions {
+	isolation := sql.LevelReadCommitted
+	switch opts.Isolation {
+	case RepeatableRead:
+		isolation = sql.LevelRepeatableRead
+	case Serializable:
+		isolation = sql.LevelSerializable
+	}
+	return &sql.TxOptions{Isolation: isolation, ReadOnly: opts.ReadOnly}
+}
+
+func (opts TxOptions) pgx() pgx.TxOptions {
+	pgxOpts := pgx.TxOptions{IsoLevel: pgx.ReadCommitted, AccessMode: pgx.ReadWrite}
+	switch opts.Isolation {
+	case RepeatableRead:
+		pgxOpts.IsoLevel = pgx.RepeatableRead
+	case Serializable:
+		pgxOpts.IsoLevel = pgx.Serializable
+	}
+	if opts.ReadOnly {
+		pgxOpts.AccessMode = pgx.ReadOnly
+	}
+	return pgxOpts
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"balance/pkg/service"
+	"errors"
+	"log"
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+var (
+	errInvalidParameters = errors.New("invalid request parameters")
+	errUnknownCurrency   = errors.New("unknown currency, see /currencies for supported ISO 4217 codes")
+)
+
+//detailedError has more than message to tell client, like results of every item of rejected batch
+type detailedError interface {
+	error
+	ErrorDetails() interface{}
+}
+
+//nonstandard status used when client closes connection before response is ready
+const statusClientClosedRequest = 499
+
+//errorStatuses maps errors returned by handlers to response status, errors wrapping them
+//get the same status. Every endpoint answers the same error with the same status
+var errorStatuses = []struct {
+	err  error
+	code int
+}{
+	//request can't be processed as it is
+	{errInvalidParameters, http.StatusBadRequest},
+	{errUnknownCurrency, http.StatusBadRequest},
+	{service.ErrInvalidCursor, http.StatusBadRequest},
+	{service.ErrInvalidFilter, http.StatusBadRequest},
+	{service.ErrInvalidDetails, http.StatusBadRequest},
+	{service.ErrInvalidIdempotencyKey, http.StatusBadRequest},
+	{service.ErrConvertCurrency, http.StatusBadRequest},
+	{service.ErrInvalidReservation, http.StatusBadRequest},
+	{service.ErrInvalidBatch, http.StatusBadRequest},
+	{service.ErrInvalidSchedule, http.StatusBadRequest},
+	//request is rejected by balance rules
+	{service.ErrNotEnoughMoney, http.StatusBadRequest},
+	{service.ErrCreatingWithNegativeAmount, http.StatusBadRequest},
+	{service.ErrBalanceOverflow, http.StatusBadRequest},
+
+	{service.ErrUserNotFound, http.StatusNotFound},
+	{service.ErrWalletNotFound, http.StatusNotFound},
+	{service.ErrOperationNotFound, http.StatusNotFound},
+	{service.ErrReservationNotFound, http.StatusNotFound},
+	{service.ErrReservationFinished, http.StatusConflict},
+	{service.ErrReservationExpired, http.StatusConflict},
+	{service.ErrScheduleNotFound, http.StatusNotFound},
+	{service.ErrScheduleFinished, http.StatusConflict},
+	{service.ErrOperationNotReversible, http.StatusConflict},
+	{service.ErrReversalExceedsOperation, http.StatusConflict},
+	{service.ErrIdempotencyKeyReused, http.StatusUnprocessableEntity},
+
+	{service.ErrOperationTimeout, http.StatusGatewayTimeout},
+	{service.ErrOperationCanceled, statusClientClosedRequest},
+	{service.ErrAccessDatabase, http.StatusInternalServerError},
+}
+
+//errorStatus returns status for error returned by handler, unknown errors are internal ones
+func errorStatus(err error) int {
+	for _, status := range errorStatuses {
+		if errors.Is(err, status.err) {
+			return status.code
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+//handleError is the only place errors are turned into responses, handlers just return them
+func (server *Server) handleError(err error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		return
+	}
+
+	var code int
+	var message string
+	var details interface{}
+	var httpErr *echo.HTTPError
+	var detailed detailedError
+	if errors.As(err, &httpErr) {
+		//errors of echo itself, like unknown route
+		code = httpErr.Code
+		message = http.StatusText(code)
+		if text, ok := httpErr.Message.(string); ok {
+			message = text
+		}
+	} else {
+		code = errorStatus(err)
+		message = err.Error()
+		if errors.As(err, &detailed) {
+			details = detailed.ErrorDetails()
+		}
+	}
+
+	if code >= http.StatusInternalServerError && code != http.StatusGatewayTimeout {
+		//cause of internal error is logged, but never shown to client
+		log.Printf("%s %s: %v", ctx.Request().Method, ctx.Request().URL.Path, cause(err))
+		if httpErr == nil && !errors.Is(err, service.ErrAccessDatabase) {
+			message = http.StatusText(code)
+			details = nil
+		}
+	}
+
+	if ctx.Request().Method == http.MethodHead {
+		err = ctx.NoContent(code)
+	} else {
+		err = ctx.JSON(code, errorResponse{message, details})
+	}
+	if err != nil {
+		log.Printf("sending error response: %v", err)
+	}
+}
+
+//cause returns error hidden by service error, so logs tell what actually failed
+func cause(err error) error {
+	var serviceErr *service.Error
+	if errors.As(err, &serviceErr) && serviceErr.Cause != nil {
+		return serviceErr.Cause
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"balance/pkg/config"
+	mock_service "balance/pkg/server/mocks"
+	"balance/pkg/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_HandleError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	server := New(mock_service.NewMockBalancer(mockCtrl), config.Server{Port: 1331})
+
+	var tests = []struct {
+		name            string
+		err             error
+		expectedCode    int
+		expectedMessage string
+		expectedDetails bool
+	}{
+		{name: "service error", err: service.ErrNotEnoughMoney, expectedCode: http.StatusBadRequest, expectedMessage: service.ErrNotEnoughMoney.Error()},
+		{name: "wrapped error", err: fmt.Errorf("reading balance: %w", service.ErrUserNotFound), expectedCode: http.StatusNotFound,
+			expectedMessage: "reading balance: " + service.ErrUserNotFound.Error()},
+		{name: "cause is not shown", err: &service.Error{Kind: service.ErrAccessDatabase, Cause: errors.New("password authentication failed")},
+			expectedCode: http.StatusInternalServerError, expectedMessage: service.ErrAccessDatabase.Error()},
+		{name: "timeout", err: &service.Error{Kind: service.ErrOperationTimeout}, expectedCode: http.StatusGatewayTimeout,
+			expectedMessage: service.ErrOperationTimeout.Error()},
+		{name: "rejected batch", err: &service.BatchError{Err: service.ErrNotEnoughMoney,
+			Results: []*service.BatchItemResult{{Recipient: 2, Status: service.BatchItemNotExecuted}}},
+			expectedCode: http.StatusBadRequest, expectedMessage: service.ErrNotEnoughMoney.Error(), expectedDetails: true},
+		{name: "unknown error", err: errors.New("dial tcp: connection refused"), expectedCode: http.StatusInternalServerError,
+			expectedMessage: http.StatusText(http.StatusInternalServerError)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			ctx := server.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), recorder)
+			server.HTTPErrorHandler(test.err, ctx)
+
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			var response errorResponse
+			if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response)) {
+				assert.Equal(t, test.expectedMessage, response.Message)
+				assert.Equal(t, test.expectedDetails, response.Details != nil)
+			}
+		})
+	}
+
+	t.Run("unknown route", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		var response errorResponse
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response)) {
+			assert.Equal(t, "Not Found", response.Message)
+		}
+	})
+}
@@ -1,148 +1,611 @@
 package server
 
 import (
+	"balance/pkg/currency"
 	"balance/pkg/service"
-	"errors"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
 	echo "github.com/labstack/echo/v4"
 )
 
-var (
-	errInvalidParameters = errors.New("invalid request parameters")
+//header with caller's key, requests with the same key are executed once
+const headerIdempotencyKey = "Idempotency-Key"
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
 )
 
+//seconds, bounds ttl which fits into time.Duration
+const maxReservationTTL = int64(100 * 365 * 24 * time.Hour / time.Second)
+
 //structures for getting data from requests and sending responses
 type errorResponse struct {
 	Message string `json:"message"`
+	//only for errors which have more to tell, like rejected batch
+	Details interface{} `json:"details,omitempty"`
 }
 
 type getData struct {
-	Id       int64  `param:"id"`
+	Id int64 `param:"id"`
+	//currency wallet is shown in, its own one if empty
 	Currency string `query:"currency"`
+	//wallet, default currency if empty
+	Wallet string `query:"wallet"`
 }
-type changeData struct {
-	Id     int64 `param:"id"`
-	Amount int64 `json:"amount"`
+type walletsData struct {
+	Id int64 `param:"id"`
 }
-type transferData struct {
-	SenderId    int64 `param:"id"`
+type historyData struct {
+	Id        int64     `param:"id"`
+	Limit     int       `query:"limit"`
+	Cursor    string    `query:"cursor"`
+	From      time.Time `query:"from"`
+	To        time.Time `query:"to"`
+	Direction string    `query:"direction"`
+	MinAmount *int64    `query:"min_amount"`
+	MaxAmount *int64    `query:"max_amount"`
+	OpType    string    `query:"op_type"`
+	Currency  string    `query:"currency"`
+	Sort      string    `query:"sort"`
+	Order     string    `query:"order"`
+}
+//details of operation given by caller, stored in history
+type detailsData struct {
+	Purpose  string            `json:"purpose"`
+	OrderId  string            `json:"order id"`
+	Metadata map[string]string `json:"metadata"`
+}
+type operationData struct {
+	OperationId string `param:"opId"`
+}
+type batchData struct {
+	SenderId  int64           `param:"id"`
+	Currency  string          `json:"currency"`
+	Transfers []batchItemData `json:"transfers"`
+}
+type batchItemData struct {
 	RecipientId int64 `json:"recipient"`
 	Amount      int64 `json:"amount"`
+	detailsData
+}
+type reverseData struct {
+	OperationId string `param:"opId"`
+	//zero refunds everything which is not refunded yet
+	Amount int64 `json:"amount"`
+	detailsData
+}
+type changeData struct {
+	Id       int64  `param:"id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	detailsData
+}
+type transferData struct {
+	SenderId    int64  `param:"id"`
+	RecipientId int64  `json:"recipient"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	detailsData
+}
+type reserveData struct {
+	Id       int64  `param:"id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	//seconds, zero means default ttl
+	TTL int64 `json:"ttl"`
+	detailsData
+}
+type reservationData struct {
+	Id            int64  `param:"id"`
+	ReservationId string `param:"reservationId"`
+}
+type captureData struct {
+	Id            int64  `param:"id"`
+	ReservationId string `param:"reservationId"`
+	//zero captures the whole reservation
+	Amount int64 `json:"amount"`
+	detailsData
+}
+type scheduleData struct {
+	SenderId    int64  `param:"id"`
+	RecipientId int64  `json:"recipient"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	//RFC 3339, zero means now
+	StartAt time.Time `json:"start at"`
+	//daily, weekly or monthly, empty means one-time transfer
+	Recurrence string `json:"recurrence"`
+	detailsData
+}
+type userSchedulesData struct {
+	SenderId int64  `param:"id"`
+	Limit    int    `query:"limit"`
+	Cursor   string `query:"cursor"`
+	Status   string `query:"status"`
+}
+type userScheduleData struct {
+	SenderId   int64  `param:"id"`
+	ScheduleId string `param:"scheduleId"`
+}
+
+func (data detailsData) details() service.OperationDetails {
+	return service.OperationDetails{Purpose: data.Purpose, OrderID: data.OrderId, Metadata: data.Metadata}
+}
+
+//walletCurrency checks currency of wallet given by client, empty one means default currency.
+//Unknown code would fail anyway, it is rejected before touching database and exchange rate provider
+func walletCurrency(code string) (string, error) {
+	if code == "" {
+		return service.DefaultCurrency, nil
+	}
+	if _, err := currency.Get(code); err != nil {
+		return "", errUnknownCurrency
+	}
+	return code, nil
 }
 
-//GET balance/users/<user id>?currency=<currency name>
-//returns error and balance struct in JSON
+//GET balance/users/<user id>?currency=<currency name>&wallet=<wallet's currency>
+//returns error and balance struct of wallet in JSON
 func (s *Server) getBalance(ctx echo.Context) error {
 	request := &getData{}
 	err := ctx.Bind(request)
 	if err != nil || request.Id < 0 {
-		return ctx.JSON(http.StatusBadRequest, errorResponse{errInvalidParameters.Error()})
+		return errInvalidParameters
 	}
 
+	if request.Wallet, err = walletCurrency(request.Wallet); err != nil {
+		return err
+	}
 	if request.Currency == "" {
-		request.Currency = "RUB"
+		request.Currency = request.Wallet
+	}
+	//unknown code would fail anyway, reject it before touching database and exchange rate provider
+	if _, err := currency.Get(request.Currency); err != nil {
+		return errUnknownCurrency
 	}
 
-	balanceStruct, err := s.service.GetBalance(request.Id, request.Currency)
-	if err == nil {
-		return ctx.JSON(http.StatusOK, balanceStruct)
+	balanceStruct, err := s.service.GetBalance(ctx.Request().Context(), request.Id, request.Wallet, request.Currency)
+	if err != nil {
+		return err
 	}
+	return ctx.JSON(http.StatusOK, balanceStruct)
+}
 
-	var code int
-	switch err {
-	case service.ErrUserNotFound:
-		code = http.StatusNotFound
-	case service.ErrConvertCurrency:
-		code = http.StatusBadRequest
+//GET balance/users/<user id>/wallets
+//returns error and balance struct of every wallet of user in JSON
+func (s *Server) getWallets(ctx echo.Context) error {
+	request := &walletsData{}
+	err := ctx.Bind(request)
+	if err != nil || request.Id < 0 {
+		return errInvalidParameters
+	}
 
-	default:
-		code = http.StatusInternalServerError
+	balances, err := s.service.GetBalances(ctx.Request().Context(), request.Id)
+	if err != nil {
+		return err
 	}
-	return ctx.JSON(code, errorResponse{err.Error()})
+	return ctx.JSON(http.StatusOK, balances)
 }
 
-//GET balance/users/<user id>/history
-//returns error and user's transfers in JSON
+//GET balance/users/<user id>/history?limit=<page size>&cursor=<next_cursor of previous page>
+//filters: from=<RFC 3339 time>&to=<RFC 3339 time>&direction=<credit|debit>&min_amount=<minor units>&max_amount=<minor units>&op_type=<deposit|withdrawal|transfer_in|transfer_out|adjustment>&currency=<wallet's currency>
+//sorting: sort=<date|amount>&order=<asc|desc>
+//returns error and page of user's transfers, newest first by default, in JSON
 func (s *Server) getHistory(ctx echo.Context) error {
-	request := &getData{}
+	request := &historyData{}
 	err := ctx.Bind(request)
-	if err != nil || request.Id < 0 {
-		return ctx.JSON(http.StatusBadRequest, errorResponse{errInvalidParameters.Error()})
+	if err != nil || request.Id < 0 || request.Limit < 0 || request.Limit > maxPageLimit {
+		return errInvalidParameters
 	}
 
-	transfers, err := s.service.GetHistory(request.Id)
+	if request.Limit == 0 {
+		request.Limit = defaultPageLimit
+	}
 
-	if err == nil {
-		return ctx.JSON(http.StatusOK, transfers)
+	filter := service.HistoryFilter{
+		From:      request.From,
+		To:        request.To,
+		Direction: service.Direction(request.Direction),
+		MinAmount: request.MinAmount,
+		MaxAmount: request.MaxAmount,
+		OpType:    service.OperationType(request.OpType),
+		Currency:  request.Currency,
+		SortBy:    service.HistorySort(request.Sort),
+	}
+	switch request.Order {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return errInvalidParameters
+	}
+	if err := filter.Validate(); err != nil {
+		return err
 	}
 
-	var code int
-	switch err {
-	case service.ErrUserNotFound:
-		code = http.StatusNotFound
+	page, err := s.service.GetHistory(ctx.Request().Context(), request.Id, filter, request.Limit, request.Cursor)
 
-	default:
-		code = http.StatusInternalServerError
+	if err != nil {
+		return err
 	}
-	return ctx.JSON(code, errorResponse{err.Error()})
+	return ctx.JSON(http.StatusOK, page)
 }
 
 //PUT balance/users/<user id>
-//JSON: amount: <amount of kopecks>
+//JSON: amount: <amount of minor units>, optional currency of wallet (RUB by default), purpose, order id and metadata
+//optional Idempotency-Key header, repeated request with the same key gets the first response
 //returns error and changed balance struct in JSON
 func (s *Server) changeBalance(ctx echo.Context) error {
 	request := &changeData{}
 	err := ctx.Bind(request)
 	if err != nil || request.Id < 0 {
-		return ctx.JSON(http.StatusBadRequest, errorResponse{errInvalidParameters.Error()})
+		return errInvalidParameters
 	}
 
-	balanceStruct, err := s.service.ChangeBalance(request.Id, request.Amount)
-
-	if err == nil {
-		return ctx.JSON(http.StatusOK, balanceStruct)
+	if request.Currency, err = walletCurrency(request.Currency); err != nil {
+		return err
+	}
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
 	}
 
-	var code int
-	switch err {
-	case service.ErrNotEnoughMoney:
-		fallthrough
-	case service.ErrCreatingWithNegativeAmount:
-		code = http.StatusBadRequest
+	balanceStruct, err := s.service.ChangeBalance(ctx.Request().Context(), request.Id, request.Amount, request.Currency, details, idempotencyKey)
 
-	default:
-		code = http.StatusInternalServerError
+	if err != nil {
+		return err
 	}
-	return ctx.JSON(code, errorResponse{err.Error()})
+	return ctx.JSON(http.StatusOK, balanceStruct)
 }
 
 //PUT balance/users/<user id>/transfer
-//JSON amount: <amount of kopeks> recipient: <recipient's id>
+//JSON amount: <amount of minor units> recipient: <recipient's id>, optional currency of wallets (RUB by default), purpose, order id and metadata
+//optional Idempotency-Key header, repeated request with the same key gets the first response
 //returns error and changed balance struct of sender in JSON
 func (s *Server) transfer(ctx echo.Context) error {
 	request := &transferData{}
 	err := ctx.Bind(request)
 	//check for self-transfer, negative transfer and invalid ids
 	if err != nil || request.SenderId < 0 || request.RecipientId < 0 || request.SenderId == request.RecipientId || request.Amount <= 0 {
-		return ctx.JSON(http.StatusBadRequest, errorResponse{errInvalidParameters.Error()})
+		return errInvalidParameters
+	}
+
+	if request.Currency, err = walletCurrency(request.Currency); err != nil {
+		return err
+	}
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+
+	balanceStruct, err := s.service.Transfer(ctx.Request().Context(), request.SenderId, request.RecipientId, request.Amount, request.Currency,
+		details, idempotencyKey)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, balanceStruct)
+}
+
+//PUT balance/users/<user id>/transfer/batch
+//JSON transfers: array of transfers with amount: <amount of minor units> recipient: <recipient's id>, optional purpose, order id and metadata,
+//optional currency of wallets (RUB by default) for every transfer
+//optional Idempotency-Key header, repeated request with the same key gets the first response
+//every transfer is made or none of them, returns error and result of every transfer with sender's balance in JSON
+func (s *Server) transferBatch(ctx echo.Context) error {
+	request := &batchData{}
+	err := ctx.Bind(request)
+	if err != nil || request.SenderId < 0 {
+		return errInvalidParameters
+	}
+	if request.Currency, err = walletCurrency(request.Currency); err != nil {
+		return err
+	}
+
+	items := make([]service.BatchItem, 0, len(request.Transfers))
+	for _, transfer := range request.Transfers {
+		if transfer.RecipientId < 0 || transfer.RecipientId == request.SenderId || transfer.Amount <= 0 {
+			return errInvalidParameters
+		}
+		details := transfer.details()
+		if err := details.Validate(); err != nil {
+			return err
+		}
+		items = append(items, service.BatchItem{RecipientID: transfer.RecipientId, Amount: transfer.Amount, Details: details})
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+
+	batch, err := s.service.TransferBatch(ctx.Request().Context(), request.SenderId, request.Currency, items, idempotencyKey)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, batch)
+}
+
+//GET operations/<operation id>
+//returns error and operation with every history entry it made in JSON, transfer has sender's and recipient's entries
+func (s *Server) getOperation(ctx echo.Context) error {
+	request := &operationData{}
+	err := ctx.Bind(request)
+	if err != nil {
+		return errInvalidParameters
+	}
+	operationID, err := uuid.Parse(request.OperationId)
+	if err != nil {
+		return errInvalidParameters
+	}
+
+	operation, err := s.service.GetOperation(ctx.Request().Context(), operationID.String())
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, operation)
+}
+
+//POST balance/users/<user id>/reservations
+//JSON: amount: <amount of minor units>, optional currency of wallet (RUB by default), ttl: <seconds>, purpose, order id and metadata
+//optional Idempotency-Key header, repeated request with the same key gets the first response
+//returns error and created reservation in JSON
+func (s *Server) reserve(ctx echo.Context) error {
+	request := &reserveData{}
+	err := ctx.Bind(request)
+	//ttl must fit into time.Duration, allowed one is checked by service
+	if err != nil || request.Id < 0 || request.Amount <= 0 || request.TTL < 0 || request.TTL > maxReservationTTL {
+		return errInvalidParameters
 	}
 
-	balanceStruct, err := s.service.Transfer(request.SenderId, request.RecipientId, request.Amount)
+	if request.Currency, err = walletCurrency(request.Currency); err != nil {
+		return err
+	}
+
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+
+	ttl := time.Duration(request.TTL) * time.Second
+
+	reservation, err := s.service.Reserve(ctx.Request().Context(), request.Id, request.Amount, request.Currency, ttl, details, idempotencyKey)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, reservation)
+}
+
+//GET balance/users/<user id>/reservations/<reservation id>
+//returns error and reservation in JSON
+func (s *Server) getReservation(ctx echo.Context) error {
+	request := &reservationData{}
+	if err := ctx.Bind(request); err != nil {
+		return errInvalidParameters
+	}
+	reservationID, err := parseUserItemID(request.Id, request.ReservationId)
+	if err != nil {
+		return err
+	}
+
+	reservation, err := s.service.GetReservation(ctx.Request().Context(), request.Id, reservationID)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, reservation)
+}
+
+//POST balance/users/<user id>/reservations/<reservation id>/capture
+//JSON: optional amount: <amount of kopecks>, purpose, order id and metadata of withdrawal
+//returns error and captured reservation in JSON
+func (s *Server) captureReservation(ctx echo.Context) error {
+	request := &captureData{}
+	if err := ctx.Bind(request); err != nil || request.Amount < 0 {
+		return errInvalidParameters
+	}
+	reservationID, err := parseUserItemID(request.Id, request.ReservationId)
+	if err != nil {
+		return err
+	}
+
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+
+	reservation, err := s.service.CaptureReservation(ctx.Request().Context(), request.Id, reservationID, request.Amount, details)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, reservation)
+}
+
+//POST balance/users/<user id>/reservations/<reservation id>/release
+//returns error and released reservation in JSON
+func (s *Server) releaseReservation(ctx echo.Context) error {
+	request := &reservationData{}
+	if err := ctx.Bind(request); err != nil {
+		return errInvalidParameters
+	}
+	reservationID, err := parseUserItemID(request.Id, request.ReservationId)
+	if err != nil {
+		return err
+	}
+
+	reservation, err := s.service.ReleaseReservation(ctx.Request().Context(), request.Id, reservationID)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, reservation)
+}
+
+//parseUserItemID checks path params of user's reservation or schedule and returns its id in canonical form
+func parseUserItemID(userID int64, raw string) (string, error) {
+	if userID < 0 {
+		return "", errInvalidParameters
+	}
+	itemID, err := uuid.Parse(raw)
+	if err != nil {
+		return "", errInvalidParameters
+	}
+	return itemID.String(), nil
+}
 
-	if err == nil {
-		return ctx.JSON(http.StatusOK, balanceStruct)
+//POST balance/users/<user id>/schedules
+//JSON: recipient: <recipient id>, amount: <amount of minor units>, optional currency of wallets (RUB by default),
+//start at: <RFC 3339 time>, recurrence: <daily|weekly|monthly>, purpose, order id and metadata of transfers
+//optional Idempotency-Key header, repeated request with the same key gets the first response
+//returns error and created schedule in JSON
+func (s *Server) createSchedule(ctx echo.Context) error {
+	request := &scheduleData{}
+	err := ctx.Bind(request)
+	if err != nil || request.SenderId < 0 || request.RecipientId < 0 || request.Amount <= 0 {
+		return errInvalidParameters
 	}
 
-	var code int
-	switch err {
-	case service.ErrNotEnoughMoney:
-		fallthrough
-	case service.ErrUserNotFound:
-		code = http.StatusBadRequest
+	if request.Currency, err = walletCurrency(request.Currency); err != nil {
+		return err
+	}
 
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+
+	schedule, err := s.service.CreateSchedule(ctx.Request().Context(), request.SenderId, request.RecipientId, request.Amount,
+		request.Currency, request.StartAt, service.Recurrence(request.Recurrence), details, idempotencyKey)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusCreated, schedule)
+}
+
+//GET balance/users/<user id>/schedules?limit=<page size>&cursor=<next_cursor of previous page>&status=<active|completed|canceled>
+//returns error and page of schedules created by user, newest first, in JSON
+func (s *Server) getSchedules(ctx echo.Context) error {
+	request := &userSchedulesData{}
+	err := ctx.Bind(request)
+	if err != nil || request.SenderId < 0 || request.Limit < 0 || request.Limit > maxPageLimit {
+		return errInvalidParameters
+	}
+
+	if request.Limit == 0 {
+		request.Limit = defaultPageLimit
+	}
+	status := service.ScheduleStatus(request.Status)
+	switch status {
+	case "", service.ScheduleActive, service.ScheduleCompleted, service.ScheduleCanceled:
 	default:
-		code = http.StatusInternalServerError
+		return errInvalidParameters
+	}
+
+	page, err := s.service.GetSchedules(ctx.Request().Context(), request.SenderId, status, request.Limit, request.Cursor)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, page)
+}
+
+//GET balance/users/<user id>/schedules/<schedule id>
+//returns error and schedule with its latest runs in JSON
+func (s *Server) getSchedule(ctx echo.Context) error {
+	request := &userScheduleData{}
+	if err := ctx.Bind(request); err != nil {
+		return errInvalidParameters
 	}
-	return ctx.JSON(code, errorResponse{err.Error()})
+	scheduleID, err := parseUserItemID(request.SenderId, request.ScheduleId)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := s.service.GetSchedule(ctx.Request().Context(), request.SenderId, scheduleID)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, schedule)
+}
+
+//POST balance/users/<user id>/schedules/<schedule id>/cancel
+//returns error and canceled schedule in JSON
+func (s *Server) cancelSchedule(ctx echo.Context) error {
+	request := &userScheduleData{}
+	if err := ctx.Bind(request); err != nil {
+		return errInvalidParameters
+	}
+	scheduleID, err := parseUserItemID(request.SenderId, request.ScheduleId)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := s.service.CancelSchedule(ctx.Request().Context(), request.SenderId, scheduleID)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, schedule)
+}
+
+//POST operations/<operation id>/reverse
+//JSON: optional amount: <amount of kopecks>, purpose, order id and metadata
+//optional Idempotency-Key header, repeated request with the same key gets the first response
+//returns error and reversal operation with every history entry it made in JSON
+func (s *Server) reverseOperation(ctx echo.Context) error {
+	request := &reverseData{}
+	err := ctx.Bind(request)
+	if err != nil || request.Amount < 0 {
+		return errInvalidParameters
+	}
+	operationID, err := uuid.Parse(request.OperationId)
+	if err != nil {
+		return errInvalidParameters
+	}
+
+	details := request.details()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+	idempotencyKey := ctx.Request().Header.Get(headerIdempotencyKey)
+	if err := service.ValidateIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+
+	reversal, err := s.service.ReverseOperation(ctx.Request().Context(), operationID.String(), request.Amount, details, idempotencyKey)
+
+	if err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, reversal)
+}
+
+//GET currencies
+//returns currencies balance can be converted to with their names and minor units in JSON
+func (s *Server) getCurrencies(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, currency.All())
 }
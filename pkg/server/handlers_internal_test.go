@@ -1,19 +1,34 @@
 package server
 
 import (
+	"balance/pkg/config"
+	"balance/pkg/currency"
+	"balance/pkg/exchange"
+	"balance/pkg/repository"
 	mock_service "balance/pkg/server/mocks"
 	"balance/pkg/service"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	echo "github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
+//handle runs handler like echo does, so returned error is answered by server's error handler
+func handle(server Server, ctx echo.Context, handler echo.HandlerFunc) {
+	if err := handler(ctx); err != nil {
+		server.HTTPErrorHandler(err, ctx)
+	}
+}
+
 func TestHandlers_GetBalance(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -21,18 +36,18 @@ func TestHandlers_GetBalance(t *testing.T) {
 	mockService := mock_service.NewMockBalancer(mockCtrl)
 
 	//default currency & RUB currency explicitly
-	mockService.EXPECT().GetBalance(int64(1), "RUB").Return(&service.Balance{}, nil).Times(2)
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(1), "RUB", "RUB").Return(&service.Balance{}, nil).Times(2)
 	//USD currency
-	mockService.EXPECT().GetBalance(int64(2), "USD").Return(&service.Balance{}, nil).Times(1)
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(2), "RUB", "USD").Return(&service.Balance{}, nil).Times(1)
 	//non existing user
-	mockService.EXPECT().GetBalance(int64(3), "RUB").Return(nil, service.ErrUserNotFound).Times(1)
-	//invalid currency
-	mockService.EXPECT().GetBalance(int64(1), "123").Return(nil, service.ErrConvertCurrency).Times(1)
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(3), "RUB", "RUB").Return(nil, service.ErrUserNotFound).Times(1)
+	//currency rate is unknown to provider
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(1), "RUB", "EUR").Return(nil, service.ErrConvertCurrency).Times(1)
 	//internal error
-	mockService.EXPECT().GetBalance(int64(4), "RUB").Return(nil, service.ErrAccessDatabase).Times(1)
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(4), "RUB", "RUB").Return(nil, service.ErrAccessDatabase).Times(1)
 
-	server := New(mockService)
-	go server.Start(1324)
+	server := New(mockService, config.Server{Port: 1324})
+	go server.Start()
 
 	type input struct {
 		id       string
@@ -52,6 +67,9 @@ func TestHandlers_GetBalance(t *testing.T) {
 		{name: "USD currency", testInput: input{id: "2", currency: "USD"}, expectedCode: http.StatusOK},
 		{name: "non existing user", testInput: input{id: "3", currency: "RUB"}, expectedCode: http.StatusNotFound},
 		{name: "invalid currency", testInput: input{id: "1", currency: "123"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown currency", testInput: input{id: "1", currency: "XYZ"}, expectedCode: http.StatusBadRequest},
+		{name: "lowercase currency", testInput: input{id: "1", currency: "usd"}, expectedCode: http.StatusBadRequest},
+		{name: "conversion failure", testInput: input{id: "1", currency: "EUR"}, expectedCode: http.StatusBadRequest},
 
 		{name: "internal error", testInput: input{id: "4", currency: "RUB"}, expectedCode: http.StatusInternalServerError},
 	}
@@ -73,31 +91,113 @@ func TestHandlers_GetBalance(t *testing.T) {
 		ctx.SetParamValues(test.testInput.id)
 
 		t.Run(test.name, func(t *testing.T) {
-			if assert.NoError(t, server.getBalance(ctx)) {
-				assert.Equal(t, test.expectedCode, recorder.Code)
-			}
+			handle(server, ctx, server.getBalance)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_GetWalletBalance(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//USD wallet in its own currency
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(2), "USD", "USD").Return(&service.Balance{}, nil).Times(1)
+	//USD wallet converted to RUB
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(2), "USD", "RUB").Return(&service.Balance{}, nil).Times(1)
+	//user has no wallet in currency
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(5), "EUR", "EUR").Return(nil, service.ErrWalletNotFound).Times(1)
+
+	server := New(mockService, config.Server{Port: 1337})
+
+	var tests = []struct {
+		name         string
+		id           string
+		query        string
+		expectedCode int
+	}{
+		{name: "USD wallet", id: "2", query: "wallet=USD", expectedCode: http.StatusOK},
+		{name: "USD wallet in RUB", id: "2", query: "wallet=USD&currency=RUB", expectedCode: http.StatusOK},
+		{name: "no wallet in currency", id: "5", query: "wallet=EUR", expectedCode: http.StatusNotFound},
+		{name: "unknown wallet currency", id: "2", query: "wallet=XYZ", expectedCode: http.StatusBadRequest},
+		{name: "lowercase wallet currency", id: "2", query: "wallet=usd", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/?"+test.query, nil)
+		recorder := httptest.NewRecorder()
+		ctx := server.NewContext(request, recorder)
+		ctx.SetPath(UserBalancePath)
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(test.id)
+
+		t.Run(test.name, func(t *testing.T) {
+			handle(server, ctx, server.getBalance)
+			assert.Equal(t, test.expectedCode, recorder.Code)
 		})
 	}
 }
 
+func TestHandlers_GetCurrencies(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	server := New(mock_service.NewMockBalancer(mockCtrl), config.Server{Port: 1329})
+
+	request := httptest.NewRequest(http.MethodGet, "/"+CurrenciesPath, nil)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var currencies []currency.Currency
+	if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &currencies)) {
+		assert.Contains(t, currencies, currency.Currency{Code: "JPY", Name: "Yen", MinorUnits: 0})
+		assert.Equal(t, currency.All(), currencies)
+	}
+}
+
 func TestHandlers_GetHistory(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockService := mock_service.NewMockBalancer(mockCtrl)
 
-	//regular history
-	mockService.EXPECT().GetHistory(int64(1)).Return([]*service.Transfer{}, nil).Times(1)
+	//regular history with default limit
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(1), service.HistoryFilter{}, defaultPageLimit, "").Return(&service.HistoryPage{}, nil).Times(1)
+	//next page
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(1), service.HistoryFilter{}, 10, "next").Return(&service.HistoryPage{}, nil).Times(1)
+	//invalid cursor
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(1), service.HistoryFilter{}, defaultPageLimit, "invalid").Return(nil, service.ErrInvalidCursor).Times(1)
+	//every filter and sorting
+	minAmount, maxAmount := int64(100), int64(500)
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(6), service.HistoryFilter{
+		From:      time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:        time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+		Direction: service.DirectionDebit,
+		MinAmount: &minAmount,
+		MaxAmount: &maxAmount,
+		OpType:    service.OperationTransferOut,
+		Currency:  "USD",
+		SortBy:    service.SortByAmount,
+		Ascending: true,
+	}, defaultPageLimit, "").Return(&service.HistoryPage{}, nil).Times(1)
 	//non existing user
-	mockService.EXPECT().GetHistory(int64(2)).Return(nil, service.ErrUserNotFound).Times(1)
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(2), service.HistoryFilter{}, defaultPageLimit, "").Return(nil, service.ErrUserNotFound).Times(1)
 	//internal error
-	mockService.EXPECT().GetHistory(int64(3)).Return(nil, service.ErrAccessDatabase).Times(1)
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(3), service.HistoryFilter{}, defaultPageLimit, "").Return(nil, service.ErrAccessDatabase).Times(1)
+	//timeout
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(4), service.HistoryFilter{}, defaultPageLimit, "").Return(nil, service.ErrOperationTimeout).Times(1)
+	//canceled by client
+	mockService.EXPECT().GetHistory(gomock.Any(), int64(5), service.HistoryFilter{}, defaultPageLimit, "").Return(nil, service.ErrOperationCanceled).Times(1)
 
-	server := New(mockService)
-	go server.Start(1325)
+	server := New(mockService, config.Server{Port: 1325})
+	go server.Start()
 
 	type input struct {
-		id string
+		id    string
+		query string
 	}
 	var tests = []struct {
 		name         string
@@ -107,25 +207,68 @@ func TestHandlers_GetHistory(t *testing.T) {
 		{name: "too long id", testInput: input{id: "12345678987654123123415235231324234"}, expectedCode: http.StatusBadRequest},
 		{name: "negative id", testInput: input{id: "-4"}, expectedCode: http.StatusBadRequest},
 		{name: "string id", testInput: input{id: "stringid"}, expectedCode: http.StatusBadRequest},
+		{name: "negative limit", testInput: input{id: "1", query: "limit=-1"}, expectedCode: http.StatusBadRequest},
+		{name: "too big limit", testInput: input{id: "1", query: "limit=1001"}, expectedCode: http.StatusBadRequest},
+		{name: "string limit", testInput: input{id: "1", query: "limit=ten"}, expectedCode: http.StatusBadRequest},
 
 		{name: "regular history", testInput: input{id: "1"}, expectedCode: http.StatusOK},
+		{name: "next page", testInput: input{id: "1", query: "limit=10&cursor=next"}, expectedCode: http.StatusOK},
+		{name: "invalid cursor", testInput: input{id: "1", query: "cursor=invalid"}, expectedCode: http.StatusBadRequest},
+		{name: "every filter and sorting", testInput: input{id: "6", query: "from=2022-01-01T00:00:00Z&to=2022-02-01T00:00:00Z&direction=debit" +
+			"&min_amount=100&max_amount=500&op_type=transfer_out&currency=USD&sort=amount&order=asc"}, expectedCode: http.StatusOK},
+		{name: "invalid time", testInput: input{id: "1", query: "from=yesterday"}, expectedCode: http.StatusBadRequest},
+		{name: "empty time range", testInput: input{id: "1", query: "from=2022-02-01T00:00:00Z&to=2022-01-01T00:00:00Z"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown direction", testInput: input{id: "1", query: "direction=up"}, expectedCode: http.StatusBadRequest},
+		{name: "negative amount bound", testInput: input{id: "1", query: "min_amount=-1"}, expectedCode: http.StatusBadRequest},
+		{name: "empty amount range", testInput: input{id: "1", query: "min_amount=500&max_amount=100"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown operation type", testInput: input{id: "1", query: "op_type=gift"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown currency", testInput: input{id: "1", query: "currency=XYZ"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown sort", testInput: input{id: "1", query: "sort=purpose"}, expectedCode: http.StatusBadRequest},
+		{name: "unknown order", testInput: input{id: "1", query: "order=random"}, expectedCode: http.StatusBadRequest},
 		{name: "non existing user", testInput: input{id: "2"}, expectedCode: http.StatusNotFound},
 
 		{name: "internal error", testInput: input{id: "3"}, expectedCode: http.StatusInternalServerError},
+		{name: "timeout", testInput: input{id: "4"}, expectedCode: http.StatusGatewayTimeout},
+		{name: "canceled by client", testInput: input{id: "5"}, expectedCode: statusClientClosedRequest},
 	}
 
 	for _, test := range tests {
-		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request := httptest.NewRequest(http.MethodGet, "/?"+test.testInput.query, nil)
 		recorder := httptest.NewRecorder()
 		ctx := server.NewContext(request, recorder)
-		ctx.SetPath(UserBalancePath)
+		ctx.SetPath(UserBalanceHistoryPath)
 		ctx.SetParamNames("id")
 		ctx.SetParamValues(test.testInput.id)
 
 		t.Run(test.name, func(t *testing.T) {
-			if assert.NoError(t, server.getHistory(ctx)) {
-				assert.Equal(t, test.expectedCode, recorder.Code)
-			}
+			handle(server, ctx, server.getHistory)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+//history of unknown user is told from empty one by real service, not by mock
+func TestHandlers_GetHistoryOfUnknownUser(t *testing.T) {
+	svc := service.New(repository.NewMemory(), exchange.NewFake(), config.Default().Service)
+	_, err := svc.ChangeBalance(context.Background(), 1, 100, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	server := New(svc, config.Server{Port: 1338})
+
+	var tests = []struct {
+		name         string
+		path         string
+		expectedCode int
+	}{
+		{name: "existing user", path: "/balance/users/1/history", expectedCode: http.StatusOK},
+		{name: "unknown user", path: "/balance/users/2/history", expectedCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
 		})
 	}
 }
@@ -136,22 +279,39 @@ func TestHandlers_ChangeBalance(t *testing.T) {
 
 	mockService := mock_service.NewMockBalancer(mockCtrl)
 	//positive value
-	mockService.EXPECT().ChangeBalance(int64(1), int64(100)).Return(&service.Balance{}, nil).Times(1)
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(1), int64(100), "RUB", service.OperationDetails{}, "").Return(&service.Balance{}, nil).Times(1)
 	//negative value
-	mockService.EXPECT().ChangeBalance(int64(1), int64(-100)).Return(&service.Balance{}, nil).Times(1)
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(1), int64(-100), "RUB", service.OperationDetails{}, "").Return(&service.Balance{}, nil).Times(1)
 	//not enough money
-	mockService.EXPECT().ChangeBalance(int64(2), int64(-10000)).Return(nil, service.ErrNotEnoughMoney).Times(1)
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(2), int64(-10000), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrNotEnoughMoney).Times(1)
 	//creating new account with negative amount
-	mockService.EXPECT().ChangeBalance(int64(3), int64(-100)).Return(nil, service.ErrCreatingWithNegativeAmount).Times(1)
-	//internal error
-	mockService.EXPECT().ChangeBalance(int64(4), int64(1)).Return(nil, service.ErrBalanceOverflow).Times(1)
-
-	server := New(mockService)
-	go server.Start(1326)
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(3), int64(-100), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrCreatingWithNegativeAmount).Times(1)
+	//balance overflow
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(4), int64(1), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrBalanceOverflow).Times(1)
+	//internal error, wrapped errors get status of error they wrap
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(7), int64(1), "RUB", service.OperationDetails{}, "").
+		Return(nil, fmt.Errorf("saving history: %w", service.ErrAccessDatabase)).Times(1)
+	//caller's details
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(5), int64(100), "RUB", service.OperationDetails{
+		Purpose:  "order payment",
+		OrderID:  "A-1",
+		Metadata: map[string]string{"channel": "web"},
+	}, "").Return(&service.Balance{}, nil).Times(1)
+	//idempotency key
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(6), int64(100), "RUB", service.OperationDetails{}, "key-1").Return(&service.Balance{}, nil).Times(1)
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(6), int64(200), "RUB", service.OperationDetails{}, "key-1").Return(nil, service.ErrIdempotencyKeyReused).Times(1)
+	//wallet in another currency
+	mockService.EXPECT().ChangeBalance(gomock.Any(), int64(8), int64(100), "USD", service.OperationDetails{}, "").Return(&service.Balance{}, nil).Times(1)
+
+	server := New(mockService, config.Server{Port: 1326})
+	go server.Start()
 
 	type input struct {
 		id     string
 		amount string
+		//added to JSON body
+		details        string
+		idempotencyKey string
 	}
 	var tests = []struct {
 		name         string
@@ -168,13 +328,35 @@ func TestHandlers_ChangeBalance(t *testing.T) {
 		{name: "string id", testInput: input{id: "stringid", amount: "1"}, expectedCode: http.StatusBadRequest},
 		{name: "invalid amount", testInput: input{id: "1", amount: "stringamount"}, expectedCode: http.StatusBadRequest},
 
-		{name: "internal error", testInput: input{id: "4", amount: "1"}, expectedCode: http.StatusInternalServerError},
+		{name: "balance overflow", testInput: input{id: "4", amount: "1"}, expectedCode: http.StatusBadRequest},
+		{name: "internal error", testInput: input{id: "7", amount: "1"}, expectedCode: http.StatusInternalServerError},
+
+		{name: "caller's details", testInput: input{id: "5", amount: "100",
+			details: `, "purpose": "order payment", "order id": "A-1", "metadata": {"channel": "web"}`}, expectedCode: http.StatusOK},
+		{name: "too long purpose", testInput: input{id: "5", amount: "100",
+			details: fmt.Sprintf(`, "purpose": "%s"`, strings.Repeat("a", 257))}, expectedCode: http.StatusBadRequest},
+		{name: "too many metadata keys", testInput: input{id: "5", amount: "100",
+			details: `, "metadata": {"1":"","2":"","3":"","4":"","5":"","6":"","7":"","8":"","9":"","10":"","11":"","12":"","13":"","14":"","15":"","16":"","17":""}`},
+			expectedCode: http.StatusBadRequest},
+		{name: "metadata is not string map", testInput: input{id: "5", amount: "100", details: `, "metadata": {"count": 1}`}, expectedCode: http.StatusBadRequest},
+
+		{name: "idempotency key", testInput: input{id: "6", amount: "100", idempotencyKey: "key-1"}, expectedCode: http.StatusOK},
+		{name: "idempotency key reused", testInput: input{id: "6", amount: "200", idempotencyKey: "key-1"}, expectedCode: http.StatusUnprocessableEntity},
+		{name: "too long idempotency key", testInput: input{id: "6", amount: "100", idempotencyKey: strings.Repeat("k", 256)}, expectedCode: http.StatusBadRequest},
+		{name: "non printable idempotency key", testInput: input{id: "6", amount: "100", idempotencyKey: "key\t1"}, expectedCode: http.StatusBadRequest},
+		{name: "reserved idempotency key", testInput: input{id: "6", amount: "100", idempotencyKey: "internal:schedule 1 run 0"}, expectedCode: http.StatusBadRequest},
+
+		{name: "wallet in another currency", testInput: input{id: "8", amount: "100", details: `, "currency": "USD"`}, expectedCode: http.StatusOK},
+		{name: "unknown currency", testInput: input{id: "8", amount: "100", details: `, "currency": "XYZ"`}, expectedCode: http.StatusBadRequest},
 	}
 
 	for _, test := range tests {
-		jsonBody := strings.NewReader(fmt.Sprintf(`{ "amount": %s }`, test.testInput.amount))
+		jsonBody := strings.NewReader(fmt.Sprintf(`{ "amount": %s %s }`, test.testInput.amount, test.testInput.details))
 		request := httptest.NewRequest(http.MethodPut, "/", jsonBody)
 		request.Header.Set("Content-Type", "application/json")
+		if test.testInput.idempotencyKey != "" {
+			request.Header.Set(headerIdempotencyKey, test.testInput.idempotencyKey)
+		}
 
 		recorder := httptest.NewRecorder()
 		ctx := server.NewContext(request, recorder)
@@ -183,9 +365,8 @@ func TestHandlers_ChangeBalance(t *testing.T) {
 		ctx.SetParamValues(test.testInput.id)
 
 		t.Run(test.name, func(t *testing.T) {
-			if assert.NoError(t, server.changeBalance(ctx)) {
-				assert.Equal(t, test.expectedCode, recorder.Code)
-			}
+			handle(server, ctx, server.changeBalance)
+			assert.Equal(t, test.expectedCode, recorder.Code)
 		})
 	}
 }
@@ -197,21 +378,31 @@ func TestHandlers_Transfer(t *testing.T) {
 	mockService := mock_service.NewMockBalancer(mockCtrl)
 
 	//regular transfer
-	mockService.EXPECT().Transfer(int64(1), int64(2), int64(100)).Return(&service.Balance{}, nil).Times(1)
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(2), int64(100), "RUB", service.OperationDetails{}, "").Return(&service.Balance{}, nil).Times(1)
 	//not enough money
-	mockService.EXPECT().Transfer(int64(1), int64(4), int64(1000000)).Return(nil, service.ErrNotEnoughMoney).Times(1)
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(4), int64(1000000), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrNotEnoughMoney).Times(1)
 	//non existing user
-	mockService.EXPECT().Transfer(int64(1), int64(5), int64(100)).Return(nil, service.ErrUserNotFound).Times(1)
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(5), int64(100), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrUserNotFound).Times(1)
 	//internal error
-	mockService.EXPECT().Transfer(int64(1), int64(6), int64(100)).Return(nil, service.ErrAccessDatabase).Times(1)
-
-	server := New(mockService)
-	go server.Start(1327)
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(6), int64(100), "RUB", service.OperationDetails{}, "").Return(nil, service.ErrAccessDatabase).Times(1)
+	//caller's details
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(7), int64(100), "RUB", service.OperationDetails{Purpose: "gift", OrderID: "B-2"}, "").
+		Return(&service.Balance{}, nil).Times(1)
+	//idempotency key reused for another request
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(8), int64(100), "RUB", service.OperationDetails{}, "key-2").Return(nil, service.ErrIdempotencyKeyReused).Times(1)
+	//wallets in another currency
+	mockService.EXPECT().Transfer(gomock.Any(), int64(1), int64(9), int64(100), "USD", service.OperationDetails{}, "").Return(&service.Balance{}, nil).Times(1)
+
+	server := New(mockService, config.Server{Port: 1327})
+	go server.Start()
 
 	type input struct {
 		senderId    string
 		recipientId string
 		amount      string
+		//added to JSON body
+		details        string
+		idempotencyKey string
 	}
 	var tests = []struct {
 		name         string
@@ -220,7 +411,7 @@ func TestHandlers_Transfer(t *testing.T) {
 	}{
 		{name: "regular transfer", testInput: input{senderId: "1", recipientId: "2", amount: "100"}, expectedCode: http.StatusOK},
 		{name: "not enough money", testInput: input{senderId: "1", recipientId: "4", amount: "1000000"}, expectedCode: http.StatusBadRequest},
-		{name: "non existing user", testInput: input{senderId: "1", recipientId: "5", amount: "100"}, expectedCode: http.StatusBadRequest},
+		{name: "non existing user", testInput: input{senderId: "1", recipientId: "5", amount: "100"}, expectedCode: http.StatusNotFound},
 
 		{name: "too long id", testInput: input{senderId: "12345678987654123123415235231324234", recipientId: "1", amount: "1"}, expectedCode: http.StatusBadRequest},
 		{name: "negative id", testInput: input{senderId: "-5", recipientId: "1", amount: "1"}, expectedCode: http.StatusBadRequest},
@@ -230,12 +421,31 @@ func TestHandlers_Transfer(t *testing.T) {
 		{name: "bad amount", testInput: input{senderId: "1", recipientId: "2", amount: "stringamount"}, expectedCode: http.StatusBadRequest},
 
 		{name: "internal error", testInput: input{senderId: "1", recipientId: "6", amount: "100"}, expectedCode: http.StatusInternalServerError},
+
+		{name: "caller's details", testInput: input{senderId: "1", recipientId: "7", amount: "100", details: `, "purpose": "gift", "order id": "B-2"`},
+			expectedCode: http.StatusOK},
+		{name: "too long order id", testInput: input{senderId: "1", recipientId: "7", amount: "100",
+			details: fmt.Sprintf(`, "order id": "%s"`, strings.Repeat("1", 65))}, expectedCode: http.StatusBadRequest},
+
+		{name: "idempotency key reused", testInput: input{senderId: "1", recipientId: "8", amount: "100", idempotencyKey: "key-2"},
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "too long idempotency key", testInput: input{senderId: "1", recipientId: "8", amount: "100", idempotencyKey: strings.Repeat("k", 256)},
+			expectedCode: http.StatusBadRequest},
+
+		{name: "wallets in another currency", testInput: input{senderId: "1", recipientId: "9", amount: "100", details: `, "currency": "USD"`},
+			expectedCode: http.StatusOK},
+		{name: "unknown currency", testInput: input{senderId: "1", recipientId: "9", amount: "100", details: `, "currency": "usd"`},
+			expectedCode: http.StatusBadRequest},
 	}
 
 	for _, test := range tests {
-		jsonBody := strings.NewReader(fmt.Sprintf(`{ "recipient": %s, "amount": %s }`, test.testInput.recipientId, test.testInput.amount))
+		jsonBody := strings.NewReader(fmt.Sprintf(`{ "recipient": %s, "amount": %s %s }`,
+			test.testInput.recipientId, test.testInput.amount, test.testInput.details))
 		request := httptest.NewRequest(http.MethodPut, "/", jsonBody)
 		request.Header.Set("Content-Type", "application/json")
+		if test.testInput.idempotencyKey != "" {
+			request.Header.Set(headerIdempotencyKey, test.testInput.idempotencyKey)
+		}
 
 		recorder := httptest.NewRecorder()
 		ctx := server.NewContext(request, recorder)
@@ -244,9 +454,413 @@ func TestHandlers_Transfer(t *testing.T) {
 		ctx.SetParamValues(test.testInput.senderId)
 
 		t.Run(test.name, func(t *testing.T) {
-			if assert.NoError(t, server.transfer(ctx)) {
-				assert.Equal(t, test.expectedCode, recorder.Code)
+			handle(server, ctx, server.transfer)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_GetWallets(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//every wallet of user
+	mockService.EXPECT().GetBalances(gomock.Any(), int64(1)).Return([]*service.Balance{{Currency: "RUB"}, {Currency: "USD"}}, nil).Times(1)
+	//non existing user
+	mockService.EXPECT().GetBalances(gomock.Any(), int64(2)).Return(nil, service.ErrUserNotFound).Times(1)
+	//internal error
+	mockService.EXPECT().GetBalances(gomock.Any(), int64(3)).Return(nil, service.ErrAccessDatabase).Times(1)
+
+	server := New(mockService, config.Server{Port: 1336})
+
+	var tests = []struct {
+		name         string
+		id           string
+		expectedCode int
+	}{
+		{name: "every wallet", id: "1", expectedCode: http.StatusOK},
+		{name: "non existing user", id: "2", expectedCode: http.StatusNotFound},
+		{name: "internal error", id: "3", expectedCode: http.StatusInternalServerError},
+
+		{name: "negative id", id: "-1", expectedCode: http.StatusBadRequest},
+		{name: "string id", id: "stringid", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/balance/users/"+test.id+"/wallets", nil)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			if test.expectedCode == http.StatusOK {
+				var wallets []service.Balance
+				assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &wallets))
+				assert.Len(t, wallets, 2)
+			}
+		})
+	}
+}
+
+func TestHandlers_GetOperation(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const operationID = "5f0c2b9e-8f43-4c3a-9d7e-2a1b3c4d5e6f"
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//existing operation, id is passed in canonical form
+	mockService.EXPECT().GetOperation(gomock.Any(), operationID).Return(&service.Operation{ID: operationID}, nil).Times(2)
+	//unknown operation
+	mockService.EXPECT().GetOperation(gomock.Any(), "00000000-0000-0000-0000-000000000000").Return(nil, service.ErrOperationNotFound).Times(1)
+	//internal error
+	mockService.EXPECT().GetOperation(gomock.Any(), "11111111-1111-1111-1111-111111111111").Return(nil, service.ErrAccessDatabase).Times(1)
+
+	server := New(mockService, config.Server{Port: 1330})
+
+	var tests = []struct {
+		name         string
+		operationID  string
+		expectedCode int
+	}{
+		{name: "existing operation", operationID: operationID, expectedCode: http.StatusOK},
+		{name: "upper case id", operationID: strings.ToUpper(operationID), expectedCode: http.StatusOK},
+		{name: "unknown operation", operationID: "00000000-0000-0000-0000-000000000000", expectedCode: http.StatusNotFound},
+		{name: "internal error", operationID: "11111111-1111-1111-1111-111111111111", expectedCode: http.StatusInternalServerError},
+
+		{name: "not uuid", operationID: "12345", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/operations/"+test.operationID, nil)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_Reservations(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const reservationID = "5f0c2b9e-8f43-4c3a-9d7e-2a1b3c4d5e6f"
+	const unknownID = "00000000-0000-0000-0000-000000000000"
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//ttl is given in seconds, zero means default one
+	mockService.EXPECT().Reserve(gomock.Any(), int64(1), int64(100), "RUB", 60*time.Second, service.OperationDetails{Purpose: "order"}, "hold-1").
+		Return(&service.Reservation{ID: reservationID}, nil).Times(1)
+	mockService.EXPECT().Reserve(gomock.Any(), int64(1), int64(100), "RUB", time.Duration(0), service.OperationDetails{}, "").
+		Return(&service.Reservation{ID: reservationID}, nil).Times(1)
+	mockService.EXPECT().Reserve(gomock.Any(), int64(1), int64(100), "USD", time.Duration(0), service.OperationDetails{}, "").
+		Return(&service.Reservation{ID: reservationID}, nil).Times(1)
+	mockService.EXPECT().Reserve(gomock.Any(), int64(2), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrNotEnoughMoney).Times(1)
+	mockService.EXPECT().Reserve(gomock.Any(), int64(1), int64(100), "RUB", 1000*time.Hour, gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrInvalidReservation).Times(1)
+
+	mockService.EXPECT().GetReservation(gomock.Any(), int64(1), reservationID).Return(&service.Reservation{ID: reservationID}, nil).Times(2)
+	mockService.EXPECT().GetReservation(gomock.Any(), int64(1), unknownID).Return(nil, service.ErrReservationNotFound).Times(1)
+
+	//zero amount captures the whole reservation
+	mockService.EXPECT().CaptureReservation(gomock.Any(), int64(1), reservationID, int64(0), service.OperationDetails{}).
+		Return(&service.Reservation{ID: reservationID}, nil).Times(1)
+	mockService.EXPECT().CaptureReservation(gomock.Any(), int64(1), reservationID, int64(50), service.OperationDetails{OrderID: "A-1"}).
+		Return(nil, service.ErrReservationFinished).Times(1)
+	mockService.EXPECT().CaptureReservation(gomock.Any(), int64(2), reservationID, int64(0), service.OperationDetails{}).
+		Return(nil, service.ErrReservationExpired).Times(1)
+
+	mockService.EXPECT().ReleaseReservation(gomock.Any(), int64(1), reservationID).Return(&service.Reservation{ID: reservationID}, nil).Times(1)
+	mockService.EXPECT().ReleaseReservation(gomock.Any(), int64(1), unknownID).Return(nil, service.ErrAccessDatabase).Times(1)
+
+	server := New(mockService, config.Server{Port: 1332})
+
+	var tests = []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		idempotencyKey string
+		expectedCode   int
+	}{
+		{name: "reserve", method: http.MethodPost, path: "/balance/users/1/reservations",
+			body: `{"amount": 100, "ttl": 60, "purpose": "order"}`, idempotencyKey: "hold-1", expectedCode: http.StatusCreated},
+		{name: "reserve with default ttl", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100}`,
+			expectedCode: http.StatusCreated},
+		{name: "reserve in USD wallet", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100, "currency": "USD"}`,
+			expectedCode: http.StatusCreated},
+		{name: "reserve in unknown currency", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100, "currency": "XYZ"}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "reserve more than available", method: http.MethodPost, path: "/balance/users/2/reservations", body: `{"amount": 100}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "too long ttl", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100, "ttl": 3600000}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "ttl overflow", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100, "ttl": 9223372036854775807}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "negative ttl", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 100, "ttl": -1}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "zero amount", method: http.MethodPost, path: "/balance/users/1/reservations", body: `{"amount": 0}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "negative id", method: http.MethodPost, path: "/balance/users/-1/reservations", body: `{"amount": 100}`,
+			expectedCode: http.StatusBadRequest},
+
+		{name: "get reservation", method: http.MethodGet, path: "/balance/users/1/reservations/" + reservationID, expectedCode: http.StatusOK},
+		{name: "upper case id", method: http.MethodGet, path: "/balance/users/1/reservations/" + strings.ToUpper(reservationID),
+			expectedCode: http.StatusOK},
+		{name: "unknown reservation", method: http.MethodGet, path: "/balance/users/1/reservations/" + unknownID,
+			expectedCode: http.StatusNotFound},
+		{name: "not uuid", method: http.MethodGet, path: "/balance/users/1/reservations/12345", expectedCode: http.StatusBadRequest},
+
+		{name: "capture whole reservation", method: http.MethodPost, path: "/balance/users/1/reservations/" + reservationID + "/capture",
+			expectedCode: http.StatusOK},
+		{name: "capture finished reservation", method: http.MethodPost, path: "/balance/users/1/reservations/" + reservationID + "/capture",
+			body: `{"amount": 50, "order id": "A-1"}`, expectedCode: http.StatusConflict},
+		{name: "capture expired reservation", method: http.MethodPost, path: "/balance/users/2/reservations/" + reservationID + "/capture",
+			expectedCode: http.StatusConflict},
+		{name: "negative capture", method: http.MethodPost, path: "/balance/users/1/reservations/" + reservationID + "/capture",
+			body: `{"amount": -50}`, expectedCode: http.StatusBadRequest},
+
+		{name: "release", method: http.MethodPost, path: "/balance/users/1/reservations/" + reservationID + "/release", expectedCode: http.StatusOK},
+		{name: "internal error", method: http.MethodPost, path: "/balance/users/1/reservations/" + unknownID + "/release",
+			expectedCode: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := test.body
+			if body == "" {
+				body = "{}"
+			}
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if test.idempotencyKey != "" {
+				request.Header.Set(headerIdempotencyKey, test.idempotencyKey)
+			}
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_ReverseOperation(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const operationID = "5f0c2b9e-8f43-4c3a-9d7e-2a1b3c4d5e6f"
+	const reversedID = "00000000-0000-0000-0000-000000000000"
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//zero amount refunds the rest of operation
+	mockService.EXPECT().ReverseOperation(gomock.Any(), operationID, int64(0), service.OperationDetails{}, "").
+		Return(&service.Operation{}, nil).Times(2)
+	mockService.EXPECT().ReverseOperation(gomock.Any(), operationID, int64(100), service.OperationDetails{OrderID: "R-1"}, "refund-1").
+		Return(&service.Operation{}, nil).Times(1)
+	mockService.EXPECT().ReverseOperation(gomock.Any(), operationID, int64(1000000), gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrReversalExceedsOperation).Times(1)
+	mockService.EXPECT().ReverseOperation(gomock.Any(), operationID, int64(500), gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrNotEnoughMoney).Times(1)
+	mockService.EXPECT().ReverseOperation(gomock.Any(), reversedID, gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrOperationNotReversible).Times(1)
+	mockService.EXPECT().ReverseOperation(gomock.Any(), "11111111-1111-1111-1111-111111111111", gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, service.ErrOperationNotFound).Times(1)
+
+	server := New(mockService, config.Server{Port: 1333})
+
+	var tests = []struct {
+		name           string
+		operationID    string
+		body           string
+		idempotencyKey string
+		expectedCode   int
+	}{
+		{name: "full refund", operationID: operationID, body: `{}`, expectedCode: http.StatusOK},
+		{name: "upper case id", operationID: strings.ToUpper(operationID), body: `{}`, expectedCode: http.StatusOK},
+		{name: "partial refund", operationID: operationID, body: `{"amount": 100, "order id": "R-1"}`, idempotencyKey: "refund-1",
+			expectedCode: http.StatusOK},
+		{name: "refunds exceed operation", operationID: operationID, body: `{"amount": 1000000}`, expectedCode: http.StatusConflict},
+		{name: "recipient spent money", operationID: operationID, body: `{"amount": 500}`, expectedCode: http.StatusBadRequest},
+		{name: "reversal of reversal", operationID: reversedID, body: `{}`, expectedCode: http.StatusConflict},
+		{name: "unknown operation", operationID: "11111111-1111-1111-1111-111111111111", body: `{}`, expectedCode: http.StatusNotFound},
+
+		{name: "negative amount", operationID: operationID, body: `{"amount": -1}`, expectedCode: http.StatusBadRequest},
+		{name: "not uuid", operationID: "12345", body: `{}`, expectedCode: http.StatusBadRequest},
+		{name: "too long order id", operationID: operationID, body: fmt.Sprintf(`{"order id": "%s"}`, strings.Repeat("1", 65)),
+			expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/operations/"+test.operationID+"/reverse", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/json")
+			if test.idempotencyKey != "" {
+				request.Header.Set(headerIdempotencyKey, test.idempotencyKey)
+			}
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_TransferBatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	//every transfer keeps its own details
+	mockService.EXPECT().TransferBatch(gomock.Any(), int64(1), "RUB", []service.BatchItem{
+		{RecipientID: 2, Amount: 100, Details: service.OperationDetails{Purpose: "Salary"}},
+		{RecipientID: 3, Amount: 200},
+	}, "payroll-1").Return(&service.BatchTransfer{}, nil).Times(1)
+	//rejected batch
+	mockService.EXPECT().TransferBatch(gomock.Any(), int64(2), "RUB", gomock.Any(), "").
+		Return(nil, &service.BatchError{Err: service.ErrUserNotFound}).Times(1)
+	mockService.EXPECT().TransferBatch(gomock.Any(), int64(3), "RUB", gomock.Any(), "").
+		Return(nil, &service.BatchError{Err: service.ErrNotEnoughMoney}).Times(1)
+	//too large batch
+	mockService.EXPECT().TransferBatch(gomock.Any(), int64(4), "RUB", gomock.Any(), "").
+		Return(nil, service.ErrInvalidBatch).Times(1)
+	//wallets in another currency
+	mockService.EXPECT().TransferBatch(gomock.Any(), int64(5), "USD", gomock.Any(), "").
+		Return(&service.BatchTransfer{}, nil).Times(1)
+
+	server := New(mockService, config.Server{Port: 1334})
+
+	var tests = []struct {
+		name           string
+		senderId       string
+		body           string
+		idempotencyKey string
+		expectedCode   int
+	}{
+		{name: "batch", senderId: "1", body: `{"transfers": [{"recipient": 2, "amount": 100, "purpose": "Salary"}, {"recipient": 3, "amount": 200}]}`,
+			idempotencyKey: "payroll-1", expectedCode: http.StatusOK},
+		{name: "unknown recipient", senderId: "2", body: `{"transfers": [{"recipient": 5, "amount": 100}]}`, expectedCode: http.StatusNotFound},
+		{name: "not enough money", senderId: "3", body: `{"transfers": [{"recipient": 5, "amount": 100}]}`, expectedCode: http.StatusBadRequest},
+		{name: "too large batch", senderId: "4", body: `{"transfers": [{"recipient": 5, "amount": 100}]}`, expectedCode: http.StatusBadRequest},
+
+		{name: "transferring to oneself", senderId: "1", body: `{"transfers": [{"recipient": 1, "amount": 100}]}`, expectedCode: http.StatusBadRequest},
+		{name: "zero amount", senderId: "1", body: `{"transfers": [{"recipient": 2, "amount": 0}]}`, expectedCode: http.StatusBadRequest},
+		{name: "negative recipient", senderId: "1", body: `{"transfers": [{"recipient": -2, "amount": 100}]}`, expectedCode: http.StatusBadRequest},
+		{name: "negative sender", senderId: "-1", body: `{"transfers": [{"recipient": 2, "amount": 100}]}`, expectedCode: http.StatusBadRequest},
+		{name: "too long order id", senderId: "1", body: fmt.Sprintf(`{"transfers": [{"recipient": 2, "amount": 100, "order id": "%s"}]}`,
+			strings.Repeat("1", 65)), expectedCode: http.StatusBadRequest},
+		{name: "not array", senderId: "1", body: `{"transfers": {"recipient": 2, "amount": 100}}`, expectedCode: http.StatusBadRequest},
+		{name: "wallets in another currency", senderId: "5", body: `{"currency": "USD", "transfers": [{"recipient": 2, "amount": 100}]}`,
+			expectedCode: http.StatusOK},
+		{name: "unknown currency", senderId: "5", body: `{"currency": "XYZ", "transfers": [{"recipient": 2, "amount": 100}]}`,
+			expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPut, "/balance/users/"+test.senderId+"/transfer/batch", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/json")
+			if test.idempotencyKey != "" {
+				request.Header.Set(headerIdempotencyKey, test.idempotencyKey)
+			}
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestHandlers_Schedules(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const scheduleID = "7a1d4c2e-3b5f-4e6a-8c9d-0e1f2a3b4c5d"
+	const unknownID = "00000000-0000-0000-0000-000000000000"
+	startAt := time.Date(2030, time.January, 31, 9, 0, 0, 0, time.UTC)
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	mockService.EXPECT().CreateSchedule(gomock.Any(), int64(1), int64(2), int64(500), "RUB", startAt, service.RecurrenceMonthly,
+		service.OperationDetails{Purpose: "rent"}, "rent-1").Return(&service.Schedule{ID: scheduleID}, nil).Times(1)
+	//zero start means now
+	mockService.EXPECT().CreateSchedule(gomock.Any(), int64(1), int64(2), int64(500), "RUB", time.Time{}, service.RecurrenceNone,
+		service.OperationDetails{}, "").Return(&service.Schedule{ID: scheduleID}, nil).Times(1)
+	mockService.EXPECT().CreateSchedule(gomock.Any(), int64(1), int64(2), int64(500), "RUB", gomock.Any(), service.Recurrence("yearly"),
+		gomock.Any(), gomock.Any()).Return(nil, service.ErrInvalidSchedule).Times(1)
+	mockService.EXPECT().CreateSchedule(gomock.Any(), int64(1), int64(2), int64(500), "USD", time.Time{}, service.RecurrenceNone,
+		service.OperationDetails{}, "").Return(&service.Schedule{ID: scheduleID}, nil).Times(1)
+	mockService.EXPECT().CreateSchedule(gomock.Any(), int64(1), int64(3), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).Return(nil, service.ErrUserNotFound).Times(1)
+
+	mockService.EXPECT().GetSchedules(gomock.Any(), int64(1), service.ScheduleStatus(""), defaultPageLimit, "").
+		Return(&service.SchedulePage{Schedules: []*service.Schedule{{ID: scheduleID}}}, nil).Times(1)
+	mockService.EXPECT().GetSchedules(gomock.Any(), int64(1), service.ScheduleActive, 10, "next").
+		Return(&service.SchedulePage{Schedules: []*service.Schedule{}}, nil).Times(1)
+	mockService.EXPECT().GetSchedules(gomock.Any(), int64(1), gomock.Any(), gomock.Any(), "invalid").Return(nil, service.ErrInvalidCursor).Times(1)
+	mockService.EXPECT().GetSchedule(gomock.Any(), int64(1), scheduleID).Return(&service.Schedule{ID: scheduleID}, nil).Times(1)
+	mockService.EXPECT().GetSchedule(gomock.Any(), int64(1), unknownID).Return(nil, service.ErrScheduleNotFound).Times(1)
+
+	mockService.EXPECT().CancelSchedule(gomock.Any(), int64(1), scheduleID).Return(&service.Schedule{ID: scheduleID}, nil).Times(1)
+	mockService.EXPECT().CancelSchedule(gomock.Any(), int64(2), scheduleID).Return(nil, service.ErrScheduleFinished).Times(1)
+
+	server := New(mockService, config.Server{Port: 1335})
+
+	var tests = []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		idempotencyKey string
+		expectedCode   int
+	}{
+		{name: "create schedule", method: http.MethodPost, path: "/balance/users/1/schedules", idempotencyKey: "rent-1",
+			body: `{"recipient": 2, "amount": 500, "start at": "2030-01-31T09:00:00Z", "recurrence": "monthly", "purpose": "rent"}`, expectedCode: http.StatusCreated},
+		{name: "one-time transfer now", method: http.MethodPost, path: "/balance/users/1/schedules", body: `{"recipient": 2, "amount": 500}`,
+			expectedCode: http.StatusCreated},
+		{name: "transfer between USD wallets", method: http.MethodPost, path: "/balance/users/1/schedules",
+			body: `{"recipient": 2, "amount": 500, "currency": "USD"}`, expectedCode: http.StatusCreated},
+		{name: "unknown currency", method: http.MethodPost, path: "/balance/users/1/schedules",
+			body: `{"recipient": 2, "amount": 500, "currency": "XYZ"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown recurrence", method: http.MethodPost, path: "/balance/users/1/schedules",
+			body: `{"recipient": 2, "amount": 500, "recurrence": "yearly"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown recipient", method: http.MethodPost, path: "/balance/users/1/schedules", body: `{"recipient": 3, "amount": 500}`,
+			expectedCode: http.StatusNotFound},
+		{name: "not RFC 3339 start", method: http.MethodPost, path: "/balance/users/1/schedules",
+			body: `{"recipient": 2, "amount": 500, "start at": "31.01.2030"}`, expectedCode: http.StatusBadRequest},
+		{name: "zero amount", method: http.MethodPost, path: "/balance/users/1/schedules", body: `{"recipient": 2, "amount": 0}`,
+			expectedCode: http.StatusBadRequest},
+		{name: "negative recipient", method: http.MethodPost, path: "/balance/users/1/schedules", body: `{"recipient": -2, "amount": 500}`,
+			expectedCode: http.StatusBadRequest},
+
+		{name: "list schedules", method: http.MethodGet, path: "/balance/users/1/schedules", expectedCode: http.StatusOK},
+		{name: "list with negative id", method: http.MethodGet, path: "/balance/users/-1/schedules", expectedCode: http.StatusBadRequest},
+		{name: "list active page", method: http.MethodGet, path: "/balance/users/1/schedules?status=active&limit=10&cursor=next", expectedCode: http.StatusOK},
+		{name: "list with invalid cursor", method: http.MethodGet, path: "/balance/users/1/schedules?cursor=invalid", expectedCode: http.StatusBadRequest},
+		{name: "list with unknown status", method: http.MethodGet, path: "/balance/users/1/schedules?status=paused", expectedCode: http.StatusBadRequest},
+		{name: "list with too large limit", method: http.MethodGet, path: "/balance/users/1/schedules?limit=1001", expectedCode: http.StatusBadRequest},
+		{name: "get schedule", method: http.MethodGet, path: "/balance/users/1/schedules/" + scheduleID, expectedCode: http.StatusOK},
+		{name: "unknown schedule", method: http.MethodGet, path: "/balance/users/1/schedules/" + unknownID, expectedCode: http.StatusNotFound},
+		{name: "not uuid", method: http.MethodGet, path: "/balance/users/1/schedules/12345", expectedCode: http.StatusBadRequest},
+
+		{name: "cancel", method: http.MethodPost, path: "/balance/users/1/schedules/" + scheduleID + "/cancel", expectedCode: http.StatusOK},
+		{name: "cancel finished schedule", method: http.MethodPost, path: "/balance/users/2/schedules/" + scheduleID + "/cancel",
+			expectedCode: http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := test.body
+			if body == "" {
+				body = "{}"
+			}
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if test.idempotencyKey != "" {
+				request.Header.Set(headerIdempotencyKey, test.idempotencyKey)
 			}
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, test.expectedCode, recorder.Code)
 		})
 	}
 }
@@ -1,17 +1,19 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: model.go
+// Source: pkg/server/server.go
 
 // Package mock_service is a generated GoMock package.
 package mock_service
 
 import (
 	service "balance/pkg/service"
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
 
-// MockBalancer is a mock of Balancer interface.
+// MockBalancer is a mock of BalanceService interface.
 type MockBalancer struct {
 	ctrl     *gomock.Controller
 	recorder *MockBalancerMockRecorder
@@ -34,62 +36,242 @@ func (m *MockBalancer) EXPECT() *MockBalancerMockRecorder {
 	return m.recorder
 }
 
+// CancelSchedule mocks base method.
+func (m *MockBalancer) CancelSchedule(ctx context.Context, senderID int64, scheduleID string) (*service.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelSchedule", ctx, senderID, scheduleID)
+	ret0, _ := ret[0].(*service.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CancelSchedule indicates an expected call of CancelSchedule.
+func (mr *MockBalancerMockRecorder) CancelSchedule(ctx, senderID, scheduleID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelSchedule", reflect.TypeOf((*MockBalancer)(nil).CancelSchedule), ctx, senderID, scheduleID)
+}
+
+// CaptureReservation mocks base method.
+func (m *MockBalancer) CaptureReservation(ctx context.Context, userID int64, reservationID string, amount int64, details service.OperationDetails) (*service.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CaptureReservation", ctx, userID, reservationID, amount, details)
+	ret0, _ := ret[0].(*service.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CaptureReservation indicates an expected call of CaptureReservation.
+func (mr *MockBalancerMockRecorder) CaptureReservation(ctx, userID, reservationID, amount, details interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CaptureReservation", reflect.TypeOf((*MockBalancer)(nil).CaptureReservation), ctx, userID, reservationID, amount, details)
+}
+
 // ChangeBalance mocks base method.
-func (m *MockBalancer) ChangeBalance(id, amount int64) (*service.Balance, error) {
+func (m *MockBalancer) ChangeBalance(ctx context.Context, id, amount int64, currency string, details service.OperationDetails, idempotencyKey string) (*service.Balance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ChangeBalance", id, amount)
+	ret := m.ctrl.Call(m, "ChangeBalance", ctx, id, amount, currency, details, idempotencyKey)
 	ret0, _ := ret[0].(*service.Balance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // ChangeBalance indicates an expected call of ChangeBalance.
-func (mr *MockBalancerMockRecorder) ChangeBalance(id, amount interface{}) *gomock.Call {
+func (mr *MockBalancerMockRecorder) ChangeBalance(ctx, id, amount, currency, details, idempotencyKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeBalance", reflect.TypeOf((*MockBalancer)(nil).ChangeBalance), ctx, id, amount, currency, details, idempotencyKey)
+}
+
+// CreateSchedule mocks base method.
+func (m *MockBalancer) CreateSchedule(ctx context.Context, senderID, recipientID, amount int64, currency string, startAt time.Time, recurrence service.Recurrence, details service.OperationDetails, idempotencyKey string) (*service.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSchedule", ctx, senderID, recipientID, amount, currency, startAt, recurrence, details, idempotencyKey)
+	ret0, _ := ret[0].(*service.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateSchedule indicates an expected call of CreateSchedule.
+func (mr *MockBalancerMockRecorder) CreateSchedule(ctx, senderID, recipientID, amount, currency, startAt, recurrence, details, idempotencyKey interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeBalance", reflect.TypeOf((*MockBalancer)(nil).ChangeBalance), id, amount)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSchedule", reflect.TypeOf((*MockBalancer)(nil).CreateSchedule), ctx, senderID, recipientID, amount, currency, startAt, recurrence, details, idempotencyKey)
 }
 
 // GetBalance mocks base method.
-func (m *MockBalancer) GetBalance(id int64, currency string) (*service.Balance, error) {
+func (m *MockBalancer) GetBalance(ctx context.Context, id int64, currency, convertTo string) (*service.Balance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetBalance", id, currency)
+	ret := m.ctrl.Call(m, "GetBalance", ctx, id, currency, convertTo)
 	ret0, _ := ret[0].(*service.Balance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetBalance indicates an expected call of GetBalance.
-func (mr *MockBalancerMockRecorder) GetBalance(id, currency interface{}) *gomock.Call {
+func (mr *MockBalancerMockRecorder) GetBalance(ctx, id, currency, convertTo interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBalance", reflect.TypeOf((*MockBalancer)(nil).GetBalance), id, currency)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBalance", reflect.TypeOf((*MockBalancer)(nil).GetBalance), ctx, id, currency, convertTo)
+}
+
+// GetBalances mocks base method.
+func (m *MockBalancer) GetBalances(ctx context.Context, id int64) ([]*service.Balance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBalances", ctx, id)
+	ret0, _ := ret[0].([]*service.Balance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBalances indicates an expected call of GetBalances.
+func (mr *MockBalancerMockRecorder) GetBalances(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBalances", reflect.TypeOf((*MockBalancer)(nil).GetBalances), ctx, id)
 }
 
 // GetHistory mocks base method.
-func (m *MockBalancer) GetHistory(id int64) ([]*service.Transfer, error) {
+func (m *MockBalancer) GetHistory(ctx context.Context, id int64, filter service.HistoryFilter, limit int, cursor string) (*service.HistoryPage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetHistory", id)
-	ret0, _ := ret[0].([]*service.Transfer)
+	ret := m.ctrl.Call(m, "GetHistory", ctx, id, filter, limit, cursor)
+	ret0, _ := ret[0].(*service.HistoryPage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetHistory indicates an expected call of GetHistory.
-func (mr *MockBalancerMockRecorder) GetHistory(id interface{}) *gomock.Call {
+func (mr *MockBalancerMockRecorder) GetHistory(ctx, id, filter, limit, cursor interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockBalancer)(nil).GetHistory), ctx, id, filter, limit, cursor)
+}
+
+// GetOperation mocks base method.
+func (m *MockBalancer) GetOperation(ctx context.Context, operationID string) (*service.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOperation", ctx, operationID)
+	ret0, _ := ret[0].(*service.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOperation indicates an expected call of GetOperation.
+func (mr *MockBalancerMockRecorder) GetOperation(ctx, operationID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOperation", reflect.TypeOf((*MockBalancer)(nil).GetOperation), ctx, operationID)
+}
+
+// GetReservation mocks base method.
+func (m *MockBalancer) GetReservation(ctx context.Context, userID int64, reservationID string) (*service.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReservation", ctx, userID, reservationID)
+	ret0, _ := ret[0].(*service.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReservation indicates an expected call of GetReservation.
+func (mr *MockBalancerMockRecorder) GetReservation(ctx, userID, reservationID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockBalancer)(nil).GetHistory), id)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReservation", reflect.TypeOf((*MockBalancer)(nil).GetReservation), ctx, userID, reservationID)
+}
+
+// GetSchedule mocks base method.
+func (m *MockBalancer) GetSchedule(ctx context.Context, senderID int64, scheduleID string) (*service.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSchedule", ctx, senderID, scheduleID)
+	ret0, _ := ret[0].(*service.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSchedule indicates an expected call of GetSchedule.
+func (mr *MockBalancerMockRecorder) GetSchedule(ctx, senderID, scheduleID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSchedule", reflect.TypeOf((*MockBalancer)(nil).GetSchedule), ctx, senderID, scheduleID)
+}
+
+// GetSchedules mocks base method.
+func (m *MockBalancer) GetSchedules(ctx context.Context, senderID int64, status service.ScheduleStatus, limit int, cursor string) (*service.SchedulePage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSchedules", ctx, senderID, status, limit, cursor)
+	ret0, _ := ret[0].(*service.SchedulePage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSchedules indicates an expected call of GetSchedules.
+func (mr *MockBalancerMockRecorder) GetSchedules(ctx, senderID, status, limit, cursor interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSchedules", reflect.TypeOf((*MockBalancer)(nil).GetSchedules), ctx, senderID, status, limit, cursor)
+}
+
+// ReleaseReservation mocks base method.
+func (m *MockBalancer) ReleaseReservation(ctx context.Context, userID int64, reservationID string) (*service.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseReservation", ctx, userID, reservationID)
+	ret0, _ := ret[0].(*service.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReleaseReservation indicates an expected call of ReleaseReservation.
+func (mr *MockBalancerMockRecorder) ReleaseReservation(ctx, userID, reservationID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseReservation", reflect.TypeOf((*MockBalancer)(nil).ReleaseReservation), ctx, userID, reservationID)
+}
+
+// Reserve mocks base method.
+func (m *MockBalancer) Reserve(ctx context.Context, id, amount int64, currency string, ttl time.Duration, details service.OperationDetails, idempotencyKey string) (*service.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reserve", ctx, id, amount, currency, ttl, details, idempotencyKey)
+	ret0, _ := ret[0].(*service.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Reserve indicates an expected call of Reserve.
+func (mr *MockBalancerMockRecorder) Reserve(ctx, id, amount, currency, ttl, details, idempotencyKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reserve", reflect.TypeOf((*MockBalancer)(nil).Reserve), ctx, id, amount, currency, ttl, details, idempotencyKey)
+}
+
+// ReverseOperation mocks base method.
+func (m *MockBalancer) ReverseOperation(ctx context.Context, operationID string, amount int64, details service.OperationDetails, idempotencyKey string) (*service.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReverseOperation", ctx, operationID, amount, details, idempotencyKey)
+	ret0, _ := ret[0].(*service.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReverseOperation indicates an expected call of ReverseOperation.
+func (mr *MockBalancerMockRecorder) ReverseOperation(ctx, operationID, amount, details, idempotencyKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReverseOperation", reflect.TypeOf((*MockBalancer)(nil).ReverseOperation), ctx, operationID, amount, details, idempotencyKey)
 }
 
 // Transfer mocks base method.
-func (m *MockBalancer) Transfer(senderId, recipientId, amount int64) (*service.Balance, error) {
+func (m *MockBalancer) Transfer(ctx context.Context, senderId, recipientId, amount int64, currency string, details service.OperationDetails, idempotencyKey string) (*service.Balance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Transfer", senderId, recipientId, amount)
+	ret := m.ctrl.Call(m, "Transfer", ctx, senderId, recipientId, amount, currency, details, idempotencyKey)
 	ret0, _ := ret[0].(*service.Balance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Transfer indicates an expected call of Transfer.
-func (mr *MockBalancerMockRecorder) Transfer(senderId, recipientId, amount interface{}) *gomock.Call {
+func (mr *MockBalancerMockRecorder) Transfer(ctx, senderId, recipientId, amount, currency, details, idempotencyKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transfer", reflect.TypeOf((*MockBalancer)(nil).Transfer), ctx, senderId, recipientId, amount, currency, details, idempotencyKey)
+}
+
+// TransferBatch mocks base method.
+func (m *MockBalancer) TransferBatch(ctx context.Context, senderID int64, currency string, items []service.BatchItem, idempotencyKey string) (*service.BatchTransfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferBatch", ctx, senderID, currency, items, idempotencyKey)
+	ret0, _ := ret[0].(*service.BatchTransfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransferBatch indicates an expected call of TransferBatch.
+func (mr *MockBalancerMockRecorder) TransferBatch(ctx, senderID, currency, items, idempotencyKey interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transfer", reflect.TypeOf((*MockBalancer)(nil).Transfer), senderId, recipientId, amount)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferBatch", reflect.TypeOf((*MockBalancer)(nil).TransferBatch), ctx, senderID, currency, items, idempotencyKey)
 }
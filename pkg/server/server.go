@@ -1,42 +1,120 @@
 package server
 
 import (
+	"balance/pkg/config"
 	"balance/pkg/service"
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	echo "github.com/labstack/echo/v4"
 )
 
 const (
 	UserBalancePath         string = "balance/users/:id"
+	UserWalletsPath         string = "balance/users/:id/wallets"
 	UserBalanceHistoryPath  string = "balance/users/:id/history"
 	UserBalanceTransferPath string = "balance/users/:id/transfer"
+	UserBalanceBatchPath    string = "balance/users/:id/transfer/batch"
+	CurrenciesPath          string = "currencies"
+	OperationPath           string = "operations/:opId"
+	OperationReversePath    string = "operations/:opId/reverse"
+	ReservationsPath        string = "balance/users/:id/reservations"
+	ReservationPath         string = "balance/users/:id/reservations/:reservationId"
+	ReservationCapturePath  string = "balance/users/:id/reservations/:reservationId/capture"
+	ReservationReleasePath  string = "balance/users/:id/reservations/:reservationId/release"
+	SchedulesPath           string = "balance/users/:id/schedules"
+	SchedulePath            string = "balance/users/:id/schedules/:scheduleId"
+	ScheduleCancelPath      string = "balance/users/:id/schedules/:scheduleId/cancel"
 )
 
 type BalanceService interface {
-	GetBalance(id int64, currency string) (*service.Balance, error)
-	GetHistory(id int64) ([]*service.Transfer, error)
-	ChangeBalance(id int64, amount int64) (*service.Balance, error)
-	Transfer(senderId int64, recipientId int64, amount int64) (*service.Balance, error)
+	GetBalance(ctx context.Context, id int64, currency string, convertTo string) (*service.Balance, error)
+	GetBalances(ctx context.Context, id int64) ([]*service.Balance, error)
+	GetHistory(ctx context.Context, id int64, filter service.HistoryFilter, limit int, cursor string) (*service.HistoryPage, error)
+	ChangeBalance(ctx context.Context, id int64, amount int64, currency string, details service.OperationDetails, idempotencyKey string) (*service.Balance, error)
+	Transfer(ctx context.Context, senderId int64, recipientId int64, amount int64, currency string, details service.OperationDetails,
+		idempotencyKey string) (*service.Balance, error)
+	TransferBatch(ctx context.Context, senderID int64, currency string, items []service.BatchItem, idempotencyKey string) (*service.BatchTransfer, error)
+	GetOperation(ctx context.Context, operationID string) (*service.Operation, error)
+	Reserve(ctx context.Context, id int64, amount int64, currency string, ttl time.Duration, details service.OperationDetails,
+		idempotencyKey string) (*service.Reservation, error)
+	GetReservation(ctx context.Context, userID int64, reservationID string) (*service.Reservation, error)
+	CaptureReservation(ctx context.Context, userID int64, reservationID string, amount int64, details service.OperationDetails) (*service.Reservation, error)
+	ReleaseReservation(ctx context.Context, userID int64, reservationID string) (*service.Reservation, error)
+	ReverseOperation(ctx context.Context, operationID string, amount int64, details service.OperationDetails, idempotencyKey string) (*service.Operation, error)
+	CreateSchedule(ctx context.Context, senderID int64, recipientID int64, amount int64, currency string, startAt time.Time,
+		recurrence service.Recurrence, details service.OperationDetails, idempotencyKey string) (*service.Schedule, error)
+	GetSchedules(ctx context.Context, senderID int64, status service.ScheduleStatus, limit int, cursor string) (*service.SchedulePage, error)
+	GetSchedule(ctx context.Context, senderID int64, scheduleID string) (*service.Schedule, error)
+	CancelSchedule(ctx context.Context, senderID int64, scheduleID string) (*service.Schedule, error)
 }
 
 type Server struct {
 	*echo.Echo
 	service BalanceService
+	cfg     config.Server
+	//handlers which have not returned yet, so their transactions are still open
+	inFlight *sync.WaitGroup
 }
 
-func New(service BalanceService) Server {
-	server := Server{echo.New(), service}
+func New(service BalanceService, cfg config.Server) Server {
+	server := Server{echo.New(), service, cfg, &sync.WaitGroup{}}
+
+	server.HTTPErrorHandler = server.handleError
+	server.Use(server.trackInFlight)
 
 	server.GET(UserBalancePath, server.getBalance)
+	server.GET(UserWalletsPath, server.getWallets)
 	server.GET(UserBalanceHistoryPath, server.getHistory)
 	server.PUT(UserBalancePath, server.changeBalance)
 	server.PUT(UserBalanceTransferPath, server.transfer)
+	server.PUT(UserBalanceBatchPath, server.transferBatch)
+	server.GET(CurrenciesPath, server.getCurrencies)
+	server.GET(OperationPath, server.getOperation)
+	server.POST(OperationReversePath, server.reverseOperation)
+	server.POST(ReservationsPath, server.reserve)
+	server.GET(ReservationPath, server.getReservation)
+	server.POST(ReservationCapturePath, server.captureReservation)
+	server.POST(ReservationReleasePath, server.releaseReservation)
+	server.POST(SchedulesPath, server.createSchedule)
+	server.GET(SchedulesPath, server.getSchedules)
+	server.GET(SchedulePath, server.getSchedule)
+	server.POST(ScheduleCancelPath, server.cancelSchedule)
 
 	return server
 }
 
-func (server *Server) Start(port int) error {
-	server.Logger.Fatal(server.Echo.Start(fmt.Sprintf(":%d", port)))
-	return nil
+//Start blocks until server is stopped. Stopping with Shutdown is not an error
+func (server *Server) Start() error {
+	err := server.Echo.Start(fmt.Sprintf(":%d", server.cfg.Port))
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+//Shutdown stops accepting new connections and waits for in-flight requests until ctx is done.
+//If requests do not finish in time, connections are closed forcibly.
+//Closing connections cancels requests' contexts, so handlers abort database queries.
+//In both cases it returns only after every handler has returned, so no transaction is left open
+func (server *Server) Shutdown(ctx context.Context) error {
+	err := server.Echo.Shutdown(ctx)
+	if err != nil {
+		server.Echo.Close()
+	}
+
+	server.inFlight.Wait()
+	return err
+}
+
+func (server *Server) trackInFlight(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		server.inFlight.Add(1)
+		defer server.inFlight.Done()
+		return next(ctx)
+	}
 }
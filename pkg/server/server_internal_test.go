@@ -0,0 +1,61 @@
+package server
+
+import (
+	"balance/pkg/config"
+	mock_service "balance/pkg/server/mocks"
+	"balance/pkg/service"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockService := mock_service.NewMockBalancer(mockCtrl)
+
+	started := make(chan struct{})
+	//slow request which is in flight when shutdown begins
+	mockService.EXPECT().GetBalance(gomock.Any(), int64(1), "RUB", "RUB").DoAndReturn(func(ctx context.Context, id int64, currency string, convertTo string) (*service.Balance, error) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return &service.Balance{}, nil
+	}).Times(1)
+
+	server := New(mockService, config.Server{Port: 1328})
+	server.HideBanner = true
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+
+	responseCode := make(chan int, 1)
+	go func() {
+		for {
+			response, err := http.Get("http://localhost:1328/balance/users/1")
+			if err == nil {
+				response.Body.Close()
+				responseCode <- response.StatusCode
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, server.Shutdown(ctx))
+	assert.NoError(t, <-serverErr)
+	assert.Equal(t, http.StatusOK, <-responseCode)
+}
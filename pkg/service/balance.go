@@ -1,26 +1,89 @@
 package service
 
-import "math"
+import (
+	"balance/pkg/currency"
+	"math"
+)
 
+//Balance is money user can spend: withdraw, transfer or reserve
 type Balance struct {
-	PrimaryValue   int64  `json:"primary value"`
-	SecondaryValue int8   `json:"secondary value"`
+	PrimaryValue int64 `json:"primary value"`
+	//minor units, their number in primary unit depends on currency
+	SecondaryValue int64  `json:"secondary value"`
 	Currency       string `json:"currency"`
+	//set only when balance is converted from default currency
+	ExchangeRate *ExchangeRate `json:"exchange rate,omitempty"`
+	//id of operation which changed balance, set only by balance changes and transfers
+	OperationID string `json:"operation id,omitempty"`
+	//set only by GetBalance: money held by active reservations, it can't be spent,
+	//and sum of it and value above
+	Reserved *Amount `json:"reserved,omitempty"`
+	Total    *Amount `json:"total,omitempty"`
 }
 
-func newBalance(secondary int64, currency string) (*Balance, error) {
+//Amount of money split like balance value
+type Amount struct {
+	PrimaryValue   int64 `json:"primary value"`
+	SecondaryValue int64 `json:"secondary value"`
+}
+
+func newBalance(secondary int64, code string) (*Balance, error) {
 	if secondary < 0 {
 		return nil, ErrNegativeBalance
 	}
 
-	return &Balance{secondary / 100, int8(secondary % 100), currency}, nil
+	units, err := currency.Get(code)
+	if err != nil {
+		return nil, wrap(ErrConvertCurrency, err)
+	}
+
+	primary, minor := units.Split(secondary)
+	return &Balance{PrimaryValue: primary, SecondaryValue: minor, Currency: code}, nil
+}
+
+func newAmount(secondary int64, code string) (*Amount, error) {
+	balance, err := newBalance(secondary, code)
+	if err != nil {
+		return nil, err
+	}
+	return &Amount{PrimaryValue: balance.PrimaryValue, SecondaryValue: balance.SecondaryValue}, nil
+}
+
+//setReserved sets reserved and total amounts from reserved minor units of balance's currency
+func (balance *Balance) setReserved(reserved int64) error {
+	available, err := balance.ConvertToSecondary()
+	if err != nil {
+		return err
+	}
+	if reserved > math.MaxInt64-available {
+		return ErrBalanceOverflow
+	}
+	if balance.Reserved, err = newAmount(reserved, balance.Currency); err != nil {
+		return err
+	}
+	balance.Total, err = newAmount(available+reserved, balance.Currency)
+	return err
+}
+
+//reserved returns minor units held by reservations, zero if they are not set
+func (balance *Balance) reserved() (int64, error) {
+	if balance.Reserved == nil {
+		return 0, nil
+	}
+	reserved := Balance{PrimaryValue: balance.Reserved.PrimaryValue, SecondaryValue: balance.Reserved.SecondaryValue, Currency: balance.Currency}
+	return reserved.ConvertToSecondary()
 }
 
 func (balance *Balance) ConvertToSecondary() (int64, error) {
+	units, err := currency.Get(balance.Currency)
+	if err != nil {
+		return 0, wrap(ErrConvertCurrency, err)
+	}
+
 	//signed overflow
-	if balance.PrimaryValue > math.MaxInt64/100 {
+	secondary, ok := units.Join(balance.PrimaryValue, balance.SecondaryValue)
+	if !ok {
 		return 0, ErrBalanceOverflow
 	}
-
-	return balance.PrimaryValue*100 + int64(balance.SecondaryValue), nil
+	return secondary, nil
 }
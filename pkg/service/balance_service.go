@@ -1,290 +1,557 @@
 package service
 
 import (
+	"balance/pkg/config"
+	"balance/pkg/currency"
 	"balance/pkg/repository"
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"io"
 	"math"
-	"net/http"
 
-	"github.com/tidwall/gjson"
+	"github.com/google/uuid"
 )
 
-var (
-	ErrAccessDatabase             = errors.New("error while accessing database")
-	ErrUserNotFound               = errors.New("user with such id doesn't exist")
-	ErrNegativeBalance            = errors.New("negative balance value")
-	ErrNotEnoughMoney             = errors.New("trying to withdraw more money than account has")
-	ErrCreatingWithNegativeAmount = errors.New("trying to withdraw money from non-existing account")
-	ErrBalanceOverflow            = errors.New("balance overflow")
-	ErrConvertCurrency            = errors.New("error converting to currency")
-)
-
-const (
-	defaultCurrency = "RUB"
-	exchangeApiKey  = "9cfd3862d7643187e74d"
-)
+//DefaultCurrency is currency of wallet used when caller doesn't choose one,
+//reservations and schedules move money only in it
+const DefaultCurrency = "RUB"
 
 type Repository interface {
 	Open() error
 	Close() error
-	BeginTransaction() (*repository.Transaction, error)
-	Commit(tx *repository.Transaction) error
-	Rollback(tx *repository.Transaction) error
-
-	UserExists(tx *repository.Transaction, id int64) (bool, error)
-	GetUserBalance(tx *repository.Transaction, id int64, forUpdate bool) (repository.Balance, error)
-	GetUserHistory(tx *repository.Transaction, id int64) ([]repository.Transfer, error)
-	CreateUser(tx *repository.Transaction, id int64) error
-	ChangeUserBalance(tx *repository.Transaction, id int64, amount int64) error
-	UpdateHistory(tx *repository.Transaction, id int64, amount int64, purpose string) error
+	//WithTx runs fn in transaction which is committed if fn returns nil, failed commit is returned as error
+	WithTx(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error
 }
 
+//transactions which only read data
+var readOnly = repository.TxOptions{ReadOnly: true}
+
 type BalanceService struct {
-	repo Repository
+	repo  Repository
+	rates *rateCache
+	cfg   config.Service
 }
 
-func New(repository Repository) *BalanceService {
-	return &BalanceService{repo: repository}
+func New(repository Repository, rates ExchangeRateProvider, cfg config.Service) *BalanceService {
+	return &BalanceService{repo: repository, rates: newRateCache(rates, cfg), cfg: cfg}
+}
+
+//dbError hides database error details from caller, but tells if operation
+//failed because it was canceled or ran out of time, or can be retried
+func dbError(ctx context.Context, err error) error {
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return ctxErr
+	}
+	if conflict(err) {
+		return wrap(errConflict, err)
+	}
+	return wrap(ErrAccessDatabase, err)
+}
+
+//inTx runs fn in repository transaction. Errors of fn are returned as is, errors of
+//beginning or committing transaction are hidden like other database errors
+func (bs *BalanceService) inTx(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error {
+	var fnErr error
+	err := bs.repo.WithTx(ctx, opts, func(tx repository.Tx) error {
+		fnErr = fn(tx)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	return nil
+}
+
+func contextError(ctx context.Context) error {
+	switch err := ctx.Err(); err {
+	case context.DeadlineExceeded:
+		return wrap(ErrOperationTimeout, err)
+	case context.Canceled:
+		return wrap(ErrOperationCanceled, err)
+	}
+	return nil
 }
 
 //Helper function for accessing database. Since other functions such as update balance need to
-//access database for actual values but do not want to start new transaction, there is this function
-func (bs *BalanceService) getBalance(tx *repository.Transaction, id int64, currency string, forUpdate bool) (*Balance, error) {
-	secondaryBalance, err := bs.repo.GetUserBalance(tx, id, forUpdate)
+//access database for actual values but do not want to start new transaction, there is this function.
+//Balance is money available to user in wallet's currency, reserved money is not included
+func (bs *BalanceService) getBalance(ctx context.Context, tx repository.Tx, id int64, currency string, forUpdate bool) (*Balance, error) {
+	secondaryBalance, err := bs.userBalance(ctx, tx, id, currency, forUpdate)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return nil, ErrUserNotFound
-		}
+		return nil, err
+	}
 
-		return nil, ErrAccessDatabase
+	balance, err := newBalance(secondaryBalance.Amount-secondaryBalance.Reserved, currency)
+	if err != nil {
+		return nil, err
 	}
 
-	//convert value stored in database to needed currency
-	if currency != defaultCurrency {
-		url := fmt.Sprintf("https://free.currconv.com/api/v7/convert?q=%s_%s&compact=ultra&apiKey=%s", defaultCurrency, currency, exchangeApiKey)
-		response, err := http.Get(url)
-		if err != nil || response.StatusCode != http.StatusOK {
-			return nil, ErrConvertCurrency
-		}
+	return balance, nil
+}
 
-		jsonBytes, err := io.ReadAll(response.Body)
-		if err != nil {
-			return nil, ErrConvertCurrency
+//userBalance returns wallet as it is stored: total amount and its reserved part in minor units of wallet's currency.
+//Missing wallet is ErrWalletNotFound if user has other ones and ErrUserNotFound otherwise
+func (bs *BalanceService) userBalance(ctx context.Context, tx repository.Tx, id int64, currency string, forUpdate bool) (repository.Balance, error) {
+	balance, err := tx.GetUserBalance(ctx, id, currency, forUpdate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			exists, existsErr := tx.UserExists(ctx, id)
+			if existsErr != nil {
+				return repository.Balance{}, dbError(ctx, existsErr)
+			}
+			if exists {
+				return repository.Balance{}, wrap(ErrWalletNotFound, err)
+			}
+			return repository.Balance{}, wrap(ErrUserNotFound, err)
 		}
 
-		exchangeRateValue := gjson.Get(string(jsonBytes), fmt.Sprintf("%s_%s", defaultCurrency, currency))
-		exchangeRate := exchangeRateValue.Float()
+		return repository.Balance{}, dbError(ctx, err)
+	}
+	return balance, nil
+}
+
+//walletBalance is userBalance where missing wallet of existing user is empty one, it is not locked
+func (bs *BalanceService) walletBalance(ctx context.Context, tx repository.Tx, id int64, currency string, forUpdate bool) (repository.Balance, bool, error) {
+	balance, err := bs.userBalance(ctx, tx, id, currency, forUpdate)
+	if errors.Is(err, ErrWalletNotFound) {
+		return repository.Balance{Currency: currency}, false, nil
+	}
+	return balance, err == nil, err
+}
 
-		if exchangeRate > 1.0 && int64(float64(math.MaxInt64)/exchangeRate) < secondaryBalance.Amount {
-			return nil, ErrBalanceOverflow
-		}
+//convertBalance converts balance from its currency, it must not be called inside transaction
+//because exchange rate provider may be slow
+func (bs *BalanceService) convertBalance(ctx context.Context, balance *Balance, code string, mode RoundingMode) (*Balance, error) {
+	from, err := currency.Get(balance.Currency)
+	if err != nil {
+		return nil, wrap(ErrConvertCurrency, err)
+	}
+	to, err := currency.Get(code)
+	if err != nil {
+		return nil, wrap(ErrConvertCurrency, err)
+	}
 
-		secondaryBalance = repository.Balance{Amount: int64(float64(secondaryBalance.Amount) * exchangeRate)}
+	amount, err := balance.ConvertToSecondary()
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := balance.reserved()
+	if err != nil {
+		return nil, err
 	}
 
-	balance, err := newBalance(secondaryBalance.Amount, currency)
+	exchangeRate, err := bs.rates.Rate(ctx, from.Code, to.Code)
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, wrap(ErrConvertCurrency, err)
+	}
+
+	convertedAmount, err := convertAmount(amount, from, to, exchangeRate.Rate, mode)
 	if err != nil {
 		return nil, err
 	}
 
-	return balance, nil
+	converted, err := newBalance(convertedAmount, to.Code)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Reserved != nil {
+		//reserved part is converted on its own, so total is exactly sum of converted parts
+		convertedReserved, err := convertAmount(reserved, from, to, exchangeRate.Rate, mode)
+		if err != nil {
+			return nil, err
+		}
+		if err := converted.setReserved(convertedReserved); err != nil {
+			return nil, err
+		}
+	}
+	converted.ExchangeRate = &exchangeRate
+	return converted, nil
 }
 
 //params must be validated:
-//id mist be >= 0
-func (bs *BalanceService) GetBalance(id int64, currency string) (*Balance, error) {
-	tx, err := bs.repo.BeginTransaction()
+//id mist be >= 0, currency and convertTo must be known currency codes.
+//Wallet in currency is returned converted to convertTo unless it is empty or the same currency
+func (bs *BalanceService) GetBalance(ctx context.Context, id int64, currency string, convertTo string) (*Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.BalanceTimeout)
+	defer cancel()
+
+	var balance *Balance
+	err := bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		stored, err := bs.userBalance(ctx, tx, id, currency, false)
+		if err != nil {
+			return err
+		}
+		balance, err = storedBalance(stored)
+		return err
+	})
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return nil, err
 	}
-	defer func() {
-		if err == nil {
-			bs.repo.Commit(tx)
-		} else {
-			bs.repo.Rollback(tx)
-		}
-	}()
 
-	balance, err := bs.getBalance(tx, id, currency, false)
-	return balance, err
+	//transaction is already finished here
+	if convertTo != "" && convertTo != currency {
+		return bs.convertBalance(ctx, balance, convertTo, RoundHalfEven)
+	}
+	return balance, nil
 }
 
 //params must be validated:
-//id mist be >= 0
-func (bs *BalanceService) GetHistory(id int64) ([]*Transfer, error) {
-	tx, err := bs.repo.BeginTransaction()
+//id mist be >= 0.
+//Every wallet of user is returned ordered by currency, user without wallets gets empty list
+func (bs *BalanceService) GetBalances(ctx context.Context, id int64) ([]*Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.BalanceTimeout)
+	defer cancel()
+
+	var balances []*Balance
+	err := bs.inTx(ctx, readOnly, func(tx repository.Tx) error {
+		exists, err := tx.UserExists(ctx, id)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+
+		stored, err := tx.GetUserBalances(ctx, id)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		balances = make([]*Balance, 0, len(stored))
+		for _, wallet := range stored {
+			balance, err := storedBalance(wallet)
+			if err != nil {
+				return err
+			}
+			balances = append(balances, balance)
+		}
+		return nil
+	})
+	return balances, err
+}
+
+//storedBalance is wallet with available, reserved and total money
+func storedBalance(stored repository.Balance) (*Balance, error) {
+	balance, err := newBalance(stored.Amount-stored.Reserved, stored.Currency)
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return nil, err
 	}
-	defer func() {
-		if err == nil {
-			bs.repo.Commit(tx)
-		} else {
-			bs.repo.Rollback(tx)
-		}
-	}()
+	if err := balance.setReserved(stored.Reserved); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
 
-	dbTransfers, err := bs.repo.GetUserHistory(tx, id)
+//params must be validated:
+//id mist be >= 0, limit must be positive, filter must pass Validate.
+//Transfers are returned in filter's order, cursor is empty for the first page
+//and is taken from previous page's NextCursor for next ones
+func (bs *BalanceService) GetHistory(ctx context.Context, id int64, filter HistoryFilter, limit int, cursor string) (*HistoryPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.HistoryTimeout)
+	defer cancel()
+
+	//one more transfer tells if there is next page
+	dbPage := repository.HistoryPage{OrderBy: filter.order(), Ascending: filter.Ascending, Limit: limit + 1}
+	after, err := decodeCursor(dbPage, cursor)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return nil, ErrUserNotFound
+		return nil, err
+	}
+	dbPage.After = after
+
+	var dbTransfers []repository.Transfer
+	err = bs.inTx(ctx, readOnly, func(tx repository.Tx) error {
+		//history of unknown user is empty, so user is checked first
+		exists, err := tx.UserExists(ctx, id)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		if !exists {
+			return ErrUserNotFound
 		}
 
-		return nil, ErrAccessDatabase
+		dbTransfers, err = tx.GetUserHistory(ctx, id, filter.repositoryFilter(), dbPage)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	transfers := make([]*Transfer, 0)
+	page := &HistoryPage{Transfers: make([]*Transfer, 0, limit)}
+	if len(dbTransfers) > limit {
+		dbTransfers = dbTransfers[:limit]
+		page.NextCursor = encodeCursor(dbPage, dbTransfers[limit-1].Position())
+	}
 	for _, dbTransfer := range dbTransfers {
-		transfer, err := newTransfer(dbTransfer.Amount, dbTransfer.TransferredAt, dbTransfer.Purpose)
+		transfer, err := newTransfer(dbTransfer)
 		if err != nil {
 			return nil, err
 		}
 
-		transfers = append(transfers, transfer)
+		page.Transfers = append(page.Transfers, transfer)
 	}
-	return transfers, nil
+	return page, nil
 }
 
 //params must be validated:
-//id must be >= 0
-func (bs *BalanceService) ChangeBalance(id int64, amount int64) (*Balance, error) {
-	tx, err := bs.repo.BeginTransaction()
+//id must be >= 0, currency must be known currency code, details and idempotency key must pass validation.
+//Amount is in minor units of currency, wallet in it is opened with the first crediting.
+//Repeated request with the same idempotency key gets outcome of the first one
+func (bs *BalanceService) ChangeBalance(ctx context.Context, id int64, amount int64, currency string, details OperationDetails, idempotencyKey string) (*Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	request := changeRequest{ID: id, Amount: amount, Currency: currency, Details: details}
+	var result outcome
+	//the whole transaction is run again if it is aborted because of concurrent ones
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newOutcome(bs.changeBalance(ctx, tx, id, amount, currency, details))
+			})
+			return err
+		})
+	})
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return nil, err
 	}
-	defer func() {
-		if err == nil {
-			bs.repo.Commit(tx)
-		} else {
-			bs.repo.Rollback(tx)
-		}
-	}()
+	//transaction is committed even if operation failed, so its outcome is stored with the key
+	return result.result()
+}
 
-	balanceStruct, err := bs.getBalance(tx, id, defaultCurrency, true)
+func (bs *BalanceService) changeBalance(ctx context.Context, tx repository.Tx, id int64, amount int64, currency string, details OperationDetails) (*Balance, error) {
+	stored, err := bs.userBalance(ctx, tx, id, currency, true)
 
 	if err != nil {
-		if err != ErrUserNotFound {
+		userMissing := errors.Is(err, ErrUserNotFound)
+		if !userMissing && !errors.Is(err, ErrWalletNotFound) {
 			return nil, err
 		}
 
-		//user doesn't exist, try to create new account
-		if amount < 0 {
+		//user or wallet doesn't exist, try to create new one
+		if amount < 0 && userMissing {
 			return nil, ErrCreatingWithNegativeAmount
 		}
+		//missing wallet is empty one
+		if amount < 0 {
+			return nil, ErrNotEnoughMoney
+		}
 
 		//new account is created with first money crediting
-		err = bs.repo.CreateUser(tx, id)
+		if userMissing {
+			err = tx.CreateUser(ctx, id)
+			if err != nil {
+				return nil, dbError(ctx, err)
+			}
+		}
+		err = tx.CreateWallet(ctx, id, currency)
 		if err != nil {
-			return nil, ErrAccessDatabase
+			return nil, dbError(ctx, err)
 		}
 
-		balanceStruct, err = bs.getBalance(tx, id, defaultCurrency, true)
+		stored, err = bs.userBalance(ctx, tx, id, currency, true)
 		if err != nil {
 			return nil, err
 		}
-		//user was successfully created, continue money processing
+		//wallet was successfully created, continue money processing
 	}
 
 	//user is already existing here
 
-	balanceSecondary, err := balanceStruct.ConvertToSecondary()
-	if err != nil {
-		return nil, err
-	}
-
-	if amount < 0 && balanceSecondary+amount < 0 {
+	//reserved money can't be withdrawn, but it is still stored in balance
+	if amount < 0 && stored.Amount-stored.Reserved+amount < 0 {
 		return nil, ErrNotEnoughMoney
 	}
 
-	if amount > 0 && math.MaxInt64-amount < balanceSecondary {
+	if amount > 0 && math.MaxInt64-amount < stored.Amount {
 		return nil, ErrBalanceOverflow
 	}
 
+	var operationID string
 	if amount != 0 {
-		err = bs.repo.ChangeUserBalance(tx, id, amount)
+		operationID = uuid.NewString()
+		err = tx.ChangeUserBalance(ctx, id, currency, amount)
 		if err != nil {
-			return nil, ErrAccessDatabase
+			return nil, dbError(ctx, err)
 		}
 
-		err = bs.repo.UpdateHistory(tx, id, amount, "External service operation")
+		opType := repository.OpDeposit
+		if amount < 0 {
+			opType = repository.OpWithdrawal
+		}
+		err = tx.UpdateHistory(ctx, id, repository.Transfer{
+			OperationID: operationID,
+			Amount:      amount,
+			Currency:    currency,
+			Purpose:     details.purpose("External service operation"),
+			OpType:      opType,
+			ExternalRef: details.externalRef(),
+			Metadata:    details.Metadata,
+		})
 		if err != nil {
-			return nil, ErrAccessDatabase
+			return nil, dbError(ctx, err)
 		}
 	}
 
 	//get record and return successfully
-	balanceStruct, err = bs.getBalance(tx, id, defaultCurrency, false)
+	balanceStruct, err := bs.getBalance(ctx, tx, id, currency, false)
 	if err != nil {
 		return nil, err
 	}
 
+	balanceStruct.OperationID = operationID
 	return balanceStruct, nil
 }
 
 //params must be validated:
-//both ids should be >= 0, ids should not be equal, amount should be positive value
-func (bs *BalanceService) Transfer(senderId int64, recipientId int64, amount int64) (*Balance, error) {
-	tx, err := bs.repo.BeginTransaction()
+//both ids should be >= 0, ids should not be equal, amount should be positive value,
+//currency must be known currency code, details and idempotency key must pass validation.
+//Money is moved between wallets in currency, recipient's wallet is opened if it doesn't exist.
+//Repeated request with the same idempotency key gets outcome of the first one
+func (bs *BalanceService) Transfer(ctx context.Context, senderId int64, recipientId int64, amount int64, currency string, details OperationDetails, idempotencyKey string) (*Balance, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.TransferTimeout)
+	defer cancel()
+
+	request := transferRequest{SenderID: senderId, RecipientID: recipientId, Amount: amount, Currency: currency, Details: details}
+	var result outcome
+	//the whole transaction is run again if it is aborted because of concurrent ones
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newOutcome(bs.transfer(ctx, tx, senderId, recipientId, amount, currency, details))
+			})
+			return err
+		})
+	})
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return nil, err
 	}
-	defer func() {
-		if err == nil {
-			bs.repo.Commit(tx)
-		} else {
-			bs.repo.Rollback(tx)
-		}
-	}()
+	//transaction is committed even if operation failed, so its outcome is stored with the key
+	return result.result()
+}
 
-	senderBalanceStruct, err := bs.getBalance(tx, senderId, defaultCurrency, true)
-	if err != nil {
-		return nil, err
+func (bs *BalanceService) transfer(ctx context.Context, tx repository.Tx, senderId int64, recipientId int64, amount int64, currency string, details OperationDetails) (*Balance, error) {
+	//rows are locked in id order, so concurrent transfers in opposite directions don't deadlock
+	first, second := senderId, recipientId
+	if second < first {
+		first, second = second, first
 	}
-	senderBalance, err := senderBalanceStruct.ConvertToSecondary()
-	if err != nil {
-		return nil, err
+	balances := make(map[int64]repository.Balance, 2)
+	var recipientWallet bool
+	for _, id := range []int64{first, second} {
+		balance, exists, err := bs.walletBalance(ctx, tx, id, currency, true)
+		if err != nil {
+			//new account is not created, user cannot transfer money to
+			//non-existing person
+			return nil, err
+		}
+		balances[id] = balance
+		if id == recipientId {
+			recipientWallet = exists
+		}
 	}
-	if senderBalance < amount {
+
+	//reserved money can't be transferred
+	if sender := balances[senderId]; sender.Amount-sender.Reserved < amount {
 		return nil, ErrNotEnoughMoney
 	}
+	if math.MaxInt64-amount < balances[recipientId].Amount {
+		return nil, ErrBalanceOverflow
+	}
 
-	recipientBalanceStruct, err := bs.getBalance(tx, recipientId, defaultCurrency, true)
+	//wallet is opened only after every check, so rejection writes nothing
+	if !recipientWallet {
+		if err := tx.CreateWallet(ctx, recipientId, currency); err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+	operationID, err := bs.moveMoney(ctx, tx, senderId, recipientId, amount, currency, details)
 	if err != nil {
-		//new account is not created, user cannot transfer money to
-		//non-existing person
 		return nil, err
 	}
-	recipientBalance, err := recipientBalanceStruct.ConvertToSecondary()
+
+	senderBalanceStruct, err := bs.getBalance(ctx, tx, senderId, currency, false)
 	if err != nil {
 		return nil, err
 	}
-	if math.MaxInt64-amount < recipientBalance {
-		return nil, ErrBalanceOverflow
-	}
+	senderBalanceStruct.OperationID = operationID
+	return senderBalanceStruct, nil
+}
 
-	err = bs.repo.ChangeUserBalance(tx, senderId, amount*-1)
+//moveMoney writes both legs of transfer, balances must be locked and checked by caller
+//and both wallets in currency must exist
+func (bs *BalanceService) moveMoney(ctx context.Context, tx repository.Tx, senderId int64, recipientId int64, amount int64, currency string,
+	details OperationDetails) (string, error) {
+	//both legs of transfer are one operation
+	operationID := uuid.NewString()
+
+	err := tx.ChangeUserBalance(ctx, senderId, currency, amount*-1)
 	if err != nil {
-		return nil, err
+		return "", dbError(ctx, err)
 	}
-	err = bs.repo.UpdateHistory(tx, senderId, amount*-1, fmt.Sprintf("Transferred to %d", recipientId))
+	err = tx.UpdateHistory(ctx, senderId, repository.Transfer{
+		OperationID:  operationID,
+		Amount:       amount * -1,
+		Currency:     currency,
+		Purpose:      details.purpose(fmt.Sprintf("Transferred to %d", recipientId)),
+		OpType:       repository.OpTransferOut,
+		Counterparty: &recipientId,
+		ExternalRef:  details.externalRef(),
+		Metadata:     details.Metadata,
+	})
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return "", dbError(ctx, err)
 	}
 
-	err = bs.repo.ChangeUserBalance(tx, recipientId, amount)
+	err = tx.ChangeUserBalance(ctx, recipientId, currency, amount)
 	if err != nil {
-		return nil, err
+		return "", dbError(ctx, err)
 	}
-	err = bs.repo.UpdateHistory(tx, recipientId, amount, fmt.Sprintf("Transferred from %d", senderId))
+	err = tx.UpdateHistory(ctx, recipientId, repository.Transfer{
+		OperationID:  operationID,
+		Amount:       amount,
+		Currency:     currency,
+		Purpose:      details.purpose(fmt.Sprintf("Transferred from %d", senderId)),
+		OpType:       repository.OpTransferIn,
+		Counterparty: &senderId,
+		ExternalRef:  details.externalRef(),
+		Metadata:     details.Metadata,
+	})
 	if err != nil {
-		return nil, ErrAccessDatabase
+		return "", dbError(ctx, err)
 	}
+	return operationID, nil
+}
 
-	senderBalanceStruct, err = bs.getBalance(tx, senderId, defaultCurrency, false)
+//params must be validated:
+//operationID must be UUID in canonical form
+func (bs *BalanceService) GetOperation(ctx context.Context, operationID string) (*Operation, error) {
+	//lookup reads history, so it shares history timeout
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.HistoryTimeout)
+	defer cancel()
+
+	var entries []repository.OperationEntry
+	err := bs.inTx(ctx, readOnly, func(tx repository.Tx) (err error) {
+		entries, err = tx.GetOperation(ctx, operationID)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return senderBalanceStruct, nil
+	if len(entries) == 0 {
+		return nil, ErrOperationNotFound
+	}
+
+	return newOperation(operationID, entries)
 }
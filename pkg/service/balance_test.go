@@ -1,69 +1,102 @@
 package service_test
 
 import (
+	"balance/pkg/config"
+	"balance/pkg/exchange"
 	"balance/pkg/repository"
 	"balance/pkg/service"
 	mock_repository "balance/pkg/service/mocks"
+	"context"
+	"database/sql"
 	"errors"
 	"math"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
+func testRates() *exchange.Fake {
+	rates := exchange.NewFake()
+	rates.Set("RUB", "USD", 0.0135)
+	rates.Set("RUB", "VND", 305.5)
+	return rates
+}
+
+//newMockRepository runs every transaction with the same mocked Tx
+func newMockRepository(mockCtrl *gomock.Controller) (*mock_repository.MockRepository, *mock_repository.MockTx) {
+	mockRepository := mock_repository.NewMockRepository(mockCtrl)
+	mockTx := mock_repository.NewMockTx(mockCtrl)
+	mockRepository.EXPECT().WithTx(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error {
+			return fn(mockTx)
+		}).AnyTimes()
+	return mockRepository, mockTx
+}
+
 func TestBalance_GetBalance(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	mockRepository := mock_repository.NewMockRepository(mockCtrl)
-	mockRepository.EXPECT().BeginTransaction().Return(&repository.Transaction{}, nil).AnyTimes()
-	mockRepository.EXPECT().Commit(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().Rollback(gomock.Any()).Return(nil).AnyTimes()
+	mockRepository, mockTx := newMockRepository(mockCtrl)
 
 	//default currency
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(1), false).Return(repository.Balance{Amount: 100}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", false).Return(repository.Balance{Currency: "RUB", Amount: 100}, nil).Times(1)
 	//usd currency
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(2), false).Return(repository.Balance{Amount: 100}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(2), "RUB", false).Return(repository.Balance{Currency: "RUB", Amount: 100}, nil).Times(1)
 	//invalid currency
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(3), false).Return(repository.Balance{Amount: 100}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(3), "RUB", false).Return(repository.Balance{Currency: "RUB", Amount: 100}, nil).Times(1)
 	//non existing user
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(4), false).Return(repository.Balance{}, errors.New("sql: no rows in result set")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(4), "RUB", false).Return(repository.Balance{}, sql.ErrNoRows).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(4)).Return(false, nil).Times(1)
 	//balance overflow when converting
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(5), false).Return(repository.Balance{Amount: math.MaxInt64 - 1}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(5), "RUB", false).Return(repository.Balance{Currency: "RUB", Amount: math.MaxInt64 - 1}, nil).Times(1)
 	//internal error
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(6), false).Return(repository.Balance{}, errors.New("any error")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(6), "RUB", false).Return(repository.Balance{}, errors.New("any error")).Times(1)
+	//exchange rate provider failure
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(7), "RUB", false).Return(repository.Balance{Currency: "RUB", Amount: 100}, nil).Times(1)
+	//user has no wallet in currency
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(8), "USD", false).Return(repository.Balance{}, sql.ErrNoRows).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(8)).Return(true, nil).Times(1)
+	//wallet in foreign currency
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(9), "USD", false).Return(repository.Balance{Currency: "USD", Amount: 100}, nil).Times(1)
 
-	svc := service.New(mockRepository)
+	rates := testRates()
+	rates.Fail("RUB", "EUR", exchange.ErrRateUnavailable)
+	svc := service.New(mockRepository, rates, config.Default().Service)
 
 	type input struct {
-		id       int64
-		currency string
+		id        int64
+		currency  string
+		convertTo string
 	}
 	var tests = []struct {
 		name        string
 		testInput   input
 		expectedErr error
 	}{
-		{name: "default currency", testInput: input{id: 1, currency: "RUB"}, expectedErr: nil},
-		{name: "usd currency", testInput: input{id: 2, currency: "USD"}, expectedErr: nil},
-		{name: "invalid currency", testInput: input{id: 3, currency: "123"}, expectedErr: service.ErrConvertCurrency},
+		{name: "default currency", testInput: input{id: 1, currency: "RUB", convertTo: "RUB"}, expectedErr: nil},
+		{name: "usd currency", testInput: input{id: 2, currency: "RUB", convertTo: "USD"}, expectedErr: nil},
+		{name: "invalid currency", testInput: input{id: 3, currency: "RUB", convertTo: "123"}, expectedErr: service.ErrConvertCurrency},
 		{name: "non existing user", testInput: input{id: 4, currency: "RUB"}, expectedErr: service.ErrUserNotFound},
-		{name: "balance overflow when converting", testInput: input{id: 5, currency: "VND"}, expectedErr: service.ErrBalanceOverflow},
+		{name: "balance overflow when converting", testInput: input{id: 5, currency: "RUB", convertTo: "VND"}, expectedErr: service.ErrBalanceOverflow},
 		{name: "internal error", testInput: input{id: 6, currency: "RUB"}, expectedErr: service.ErrAccessDatabase},
+		{name: "exchange rate provider failure", testInput: input{id: 7, currency: "RUB", convertTo: "EUR"}, expectedErr: service.ErrConvertCurrency},
+		{name: "user has no wallet in currency", testInput: input{id: 8, currency: "USD"}, expectedErr: service.ErrWalletNotFound},
+		{name: "wallet in foreign currency", testInput: input{id: 9, currency: "USD"}, expectedErr: nil},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			_, err := svc.GetBalance(test.testInput.id, test.testInput.currency)
-
-			//some test may fail because of external API (too many requests for free api key)
-			//if so, wait until API will be accessible again to test
-			if err != test.expectedErr && err == service.ErrConvertCurrency {
-				assert.Fail(t, "External API failure, error converting currency")
+			balance, err := svc.GetBalance(context.Background(), test.testInput.id, test.testInput.currency, test.testInput.convertTo)
+			assert.ErrorIs(t, err, test.expectedErr)
+			if err == nil && test.testInput.convertTo == "" {
+				assert.Equal(t, test.testInput.currency, balance.Currency)
 			}
-
-			assert.Equal(t, test.expectedErr, err)
 		})
 	}
 }
@@ -72,22 +105,23 @@ func TestBalance_GetHistory(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	mockRepository := mock_repository.NewMockRepository(mockCtrl)
-	mockRepository.EXPECT().BeginTransaction().Return(&repository.Transaction{}, nil).AnyTimes()
-	mockRepository.EXPECT().Commit(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().Rollback(gomock.Any()).Return(nil).AnyTimes()
+	mockRepository, mockTx := newMockRepository(mockCtrl)
 
-	//regular query
-	mockRepository.EXPECT().GetUserHistory(gomock.Any(), int64(1)).Return([]repository.Transfer{}, nil).Times(1)
-	//non existing user
-	mockRepository.EXPECT().GetUserHistory(gomock.Any(), int64(2)).Return([]repository.Transfer{}, errors.New("sql: no rows in result set")).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(1)).Return(true, nil).AnyTimes()
+	//regular query, one more transfer is requested to know if there is next page
+	mockTx.EXPECT().GetUserHistory(gomock.Any(), int64(1), repository.HistoryFilter{}, repository.HistoryPage{Limit: 11}).Return([]repository.Transfer{}, nil).Times(1)
+	//non existing user has no history rows, it is told by user check
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(2)).Return(false, nil).Times(1)
 	//internal error
-	mockRepository.EXPECT().GetUserHistory(gomock.Any(), int64(3)).Return([]repository.Transfer{}, errors.New("any error")).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(3)).Return(true, nil).Times(1)
+	mockTx.EXPECT().GetUserHistory(gomock.Any(), int64(3), gomock.Any(), gomock.Any()).Return([]repository.Transfer{}, errors.New("any error")).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(4)).Return(false, errors.New("any error")).Times(1)
 
-	svc := service.New(mockRepository)
+	svc := service.New(mockRepository, testRates(), config.Default().Service)
 
 	type input struct {
-		id int64
+		id     int64
+		cursor string
 	}
 	var tests = []struct {
 		name        string
@@ -97,12 +131,52 @@ func TestBalance_GetHistory(t *testing.T) {
 		{name: "regular query", testInput: input{id: 1}, expectedErr: nil},
 		{name: "non existing user", testInput: input{id: 2}, expectedErr: service.ErrUserNotFound},
 		{name: "internal error", testInput: input{id: 3}, expectedErr: service.ErrAccessDatabase},
+		{name: "internal error checking user", testInput: input{id: 4}, expectedErr: service.ErrAccessDatabase},
+		{name: "cursor is not base64", testInput: input{id: 1, cursor: "!!!"}, expectedErr: service.ErrInvalidCursor},
+		{name: "cursor is not json", testInput: input{id: 1, cursor: "bm90IGpzb24"}, expectedErr: service.ErrInvalidCursor},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := svc.GetHistory(context.Background(), test.testInput.id, service.HistoryFilter{}, 10, test.testInput.cursor)
+			assert.ErrorIs(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestBalance_Cancellation(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRepository, mockTx := newMockRepository(mockCtrl)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(1)).Return(true, nil).AnyTimes()
+	//query is blocked until context is done, as database driver does
+	mockTx.EXPECT().GetUserHistory(gomock.Any(), int64(1), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, id int64, filter repository.HistoryFilter, page repository.HistoryPage) ([]repository.Transfer, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}).AnyTimes()
+
+	cfg := config.Default().Service
+	cfg.HistoryTimeout = 10 * time.Millisecond
+	svc := service.New(mockRepository, testRates(), cfg)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var tests = []struct {
+		name        string
+		ctx         context.Context
+		expectedErr error
+	}{
+		{name: "canceled by caller", ctx: canceled, expectedErr: service.ErrOperationCanceled},
+		{name: "operation timeout", ctx: context.Background(), expectedErr: service.ErrOperationTimeout},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			_, err := svc.GetHistory(test.testInput.id)
-			assert.Equal(t, test.expectedErr, err)
+			_, err := svc.GetHistory(test.ctx, 1, service.HistoryFilter{}, 10, "")
+			assert.ErrorIs(t, err, test.expectedErr)
 		})
 	}
 }
@@ -111,40 +185,55 @@ func TestBalance_ChangeBalance(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	mockRepository := mock_repository.NewMockRepository(mockCtrl)
-	mockRepository.EXPECT().BeginTransaction().Return(&repository.Transaction{}, nil).AnyTimes()
-	mockRepository.EXPECT().Commit(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().Rollback(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().UpdateHistory(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	mockRepository, mockTx := newMockRepository(mockCtrl)
+	mockTx.EXPECT().UpdateHistory(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 	//add money to balance
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(1), false).Return(repository.Balance{Amount: 200}, nil).Times(1).After(
-		mockRepository.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), int64(100)).Return(nil).Times(1).After(
-			mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(1), true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", false).Return(repository.Balance{Amount: 200}, nil).Times(1).After(
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), "RUB", int64(100)).Return(nil).Times(1).After(
+			mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
 	//get money from balance
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(2), false).Return(repository.Balance{Amount: 0}, nil).Times(1).After(
-		mockRepository.EXPECT().ChangeUserBalance(gomock.Any(), int64(2), int64(-100)).Return(nil).Times(1).After(
-			mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(2), true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(2), "RUB", false).Return(repository.Balance{Amount: 0}, nil).Times(1).After(
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(2), "RUB", int64(-100)).Return(nil).Times(1).After(
+			mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(2), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
 	//create account
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(3), false).Return(repository.Balance{Amount: 100}, nil).Times(1).After(
-		mockRepository.EXPECT().ChangeUserBalance(gomock.Any(), int64(3), int64(100)).Return(nil).Times(1).After(
-			mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(3), true).Return(repository.Balance{Amount: 0}, nil).Times(1).After(
-				mockRepository.EXPECT().CreateUser(gomock.Any(), int64(3)).Return(nil).Times(1).After(
-					mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(3), true).Return(repository.Balance{}, errors.New("sql: no rows in result set")).Times(1)))))
+	gomock.InOrder(
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(3), "RUB", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1),
+		mockTx.EXPECT().UserExists(gomock.Any(), int64(3)).Return(false, nil).Times(1),
+		mockTx.EXPECT().CreateUser(gomock.Any(), int64(3)).Return(nil).Times(1),
+		mockTx.EXPECT().CreateWallet(gomock.Any(), int64(3), "RUB").Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(3), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(3), "RUB", int64(100)).Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(3), "RUB", false).Return(repository.Balance{Amount: 100}, nil).Times(1),
+	)
 	//try to create with negative amount
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(4), true).Return(repository.Balance{}, errors.New("sql: no rows in result set")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(4), "RUB", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(4)).Return(false, nil).Times(1)
 	//trying to withdraw more than account has
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(5), true).Return(repository.Balance{Amount: 0}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(5), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1)
 	//trying to add too much money
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(6), true).Return(repository.Balance{Amount: math.MaxInt64 - 1}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(6), "RUB", true).Return(repository.Balance{Amount: math.MaxInt64 - 1}, nil).Times(1)
 	//internal error
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(7), true).Return(repository.Balance{}, errors.New("any error")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(7), "RUB", true).Return(repository.Balance{}, errors.New("any error")).Times(1)
+	//open wallet in another currency
+	gomock.InOrder(
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(8), "USD", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1),
+		mockTx.EXPECT().UserExists(gomock.Any(), int64(8)).Return(true, nil).Times(1),
+		mockTx.EXPECT().CreateWallet(gomock.Any(), int64(8), "USD").Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(8), "USD", true).Return(repository.Balance{Currency: "USD"}, nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(8), "USD", int64(100)).Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(8), "USD", false).Return(repository.Balance{Currency: "USD", Amount: 100}, nil).Times(1),
+	)
+	//withdraw from wallet which doesn't exist
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(9), "USD", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(9)).Return(true, nil).Times(1)
 
-	svc := service.New(mockRepository)
+	svc := service.New(mockRepository, testRates(), config.Default().Service)
 
 	type input struct {
-		id     int64
-		amount int64
+		id       int64
+		amount   int64
+		currency string
 	}
 	type output struct {
 		balance *service.Balance
@@ -155,21 +244,26 @@ func TestBalance_ChangeBalance(t *testing.T) {
 		testInput      input
 		expectedOutput output
 	}{
-		{name: "add money to balance", testInput: input{id: 1, amount: 100}, expectedOutput: output{&service.Balance{2, 0, "RUB"}, nil}},
-		{name: "get money from balance", testInput: input{id: 2, amount: -100}, expectedOutput: output{&service.Balance{0, 0, "RUB"}, nil}},
-		{name: "create account", testInput: input{id: 3, amount: 100}, expectedOutput: output{&service.Balance{1, 0, "RUB"}, nil}},
+		{name: "add money to balance", testInput: input{id: 1, amount: 100, currency: "RUB"}, expectedOutput: output{&service.Balance{PrimaryValue: 2, SecondaryValue: 0, Currency: "RUB"}, nil}},
+		{name: "get money from balance", testInput: input{id: 2, amount: -100, currency: "RUB"}, expectedOutput: output{&service.Balance{PrimaryValue: 0, SecondaryValue: 0, Currency: "RUB"}, nil}},
+		{name: "create account", testInput: input{id: 3, amount: 100, currency: "RUB"}, expectedOutput: output{&service.Balance{PrimaryValue: 1, SecondaryValue: 0, Currency: "RUB"}, nil}},
 
-		{name: "try to create with negative amount", testInput: input{id: 4, amount: -100}, expectedOutput: output{nil, service.ErrCreatingWithNegativeAmount}},
-		{name: "trying to withdraw more than account has", testInput: input{id: 5, amount: -100}, expectedOutput: output{nil, service.ErrNotEnoughMoney}},
-		{name: "trying to add too much money", testInput: input{id: 6, amount: 100}, expectedOutput: output{nil, service.ErrBalanceOverflow}},
-		{name: "internal error", testInput: input{id: 7, amount: 100}, expectedOutput: output{nil, service.ErrAccessDatabase}},
+		{name: "try to create with negative amount", testInput: input{id: 4, amount: -100, currency: "RUB"}, expectedOutput: output{nil, service.ErrCreatingWithNegativeAmount}},
+		{name: "trying to withdraw more than account has", testInput: input{id: 5, amount: -100, currency: "RUB"}, expectedOutput: output{nil, service.ErrNotEnoughMoney}},
+		{name: "trying to add too much money", testInput: input{id: 6, amount: 100, currency: "RUB"}, expectedOutput: output{nil, service.ErrBalanceOverflow}},
+		{name: "internal error", testInput: input{id: 7, amount: 100, currency: "RUB"}, expectedOutput: output{nil, service.ErrAccessDatabase}},
+		{name: "open wallet in another currency", testInput: input{id: 8, amount: 100, currency: "USD"}, expectedOutput: output{&service.Balance{PrimaryValue: 1, SecondaryValue: 0, Currency: "USD"}, nil}},
+		{name: "withdraw from wallet which doesn't exist", testInput: input{id: 9, amount: -100, currency: "USD"}, expectedOutput: output{nil, service.ErrNotEnoughMoney}},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			balance, err := svc.ChangeBalance(test.testInput.id, test.testInput.amount)
-			assert.Equal(t, test.expectedOutput.err, err)
+			balance, err := svc.ChangeBalance(context.Background(), test.testInput.id, test.testInput.amount, test.testInput.currency, service.OperationDetails{}, "")
+			assert.ErrorIs(t, err, test.expectedOutput.err)
 			if err == nil {
+				_, parseErr := uuid.Parse(balance.OperationID)
+				assert.NoError(t, parseErr, "operation gets unique id")
+				balance.OperationID = ""
 				assert.Equal(t, test.expectedOutput.balance, balance)
 			}
 		})
@@ -180,34 +274,53 @@ func TestBalance_Transfer(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	mockRepository := mock_repository.NewMockRepository(mockCtrl)
-	mockRepository.EXPECT().BeginTransaction().Return(&repository.Transaction{}, nil).AnyTimes()
-	mockRepository.EXPECT().Commit(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().Rollback(gomock.Any()).Return(nil).AnyTimes()
-	mockRepository.EXPECT().UpdateHistory(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	mockRepository, mockTx := newMockRepository(mockCtrl)
+	mockTx.EXPECT().UpdateHistory(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 	//regular transfer
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(1), false).Return(repository.Balance{Amount: 0}, nil).Times(1).After(
-		mockRepository.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), int64(-100)).Return(nil).Times(1).After(
-			mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(1), true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", false).Return(repository.Balance{Amount: 0}, nil).Times(1).After(
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), "RUB", int64(-100)).Return(nil).Times(1).After(
+			mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1)))
 
-	mockRepository.EXPECT().ChangeUserBalance(gomock.Any(), int64(2), int64(100)).Return(nil).Times(1).After(
-		mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(2), true).Return(repository.Balance{Amount: 0}, nil).Times(1))
+	mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(2), "RUB", int64(100)).Return(nil).Times(1).After(
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(2), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1))
 	//transfer to non existing user
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(3), true).Return(repository.Balance{Amount: 100}, nil).Times(1)
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(4), true).Return(repository.Balance{}, errors.New("sql: no rows in result set")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(3), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(4), "RUB", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1)
+	mockTx.EXPECT().UserExists(gomock.Any(), int64(4)).Return(false, nil).Times(1)
 
 	//trying to withdraw more than account has
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(5), true).Return(repository.Balance{Amount: 0}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(5), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(6), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1)
+
+	//transfer to user with lower id locks recipient first
+	gomock.InOrder(
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(11), "RUB", true).Return(repository.Balance{Amount: 0}, nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(12), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(12), "RUB", int64(-100)).Return(nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(11), "RUB", int64(100)).Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(12), "RUB", false).Return(repository.Balance{Amount: 0}, nil).Times(1),
+	)
 
 	//trying to add too much money
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(7), true).Return(repository.Balance{Amount: 100}, nil).Times(1)
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(8), true).Return(repository.Balance{Amount: math.MaxInt64 - 1}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(7), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(8), "RUB", true).Return(repository.Balance{Amount: math.MaxInt64 - 1}, nil).Times(1)
 
 	//internal error
-	mockRepository.EXPECT().GetUserBalance(gomock.Any(), int64(9), true).Return(repository.Balance{}, errors.New("any error")).Times(1)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(9), "RUB", true).Return(repository.Balance{}, errors.New("any error")).Times(1)
+
+	//recipient's wallet is opened after every check
+	gomock.InOrder(
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(13), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(14), "RUB", true).Return(repository.Balance{}, sql.ErrNoRows).Times(1),
+		mockTx.EXPECT().UserExists(gomock.Any(), int64(14)).Return(true, nil).Times(1),
+		mockTx.EXPECT().CreateWallet(gomock.Any(), int64(14), "RUB").Return(nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(13), "RUB", int64(-100)).Return(nil).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(14), "RUB", int64(100)).Return(nil).Times(1),
+		mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(13), "RUB", false).Return(repository.Balance{Amount: 0}, nil).Times(1),
+	)
 
-	svc := service.New(mockRepository)
+	svc := service.New(mockRepository, testRates(), config.Default().Service)
 
 	type input struct {
 		senderId    int64
@@ -223,22 +336,1132 @@ func TestBalance_Transfer(t *testing.T) {
 		testInput      input
 		expectedOutput output
 	}{
-		{name: "regular transfer", testInput: input{senderId: 1, recipientId: 2, amount: 100}, expectedOutput: output{&service.Balance{0, 0, "RUB"}, nil}},
+		{name: "regular transfer", testInput: input{senderId: 1, recipientId: 2, amount: 100}, expectedOutput: output{&service.Balance{PrimaryValue: 0, SecondaryValue: 0, Currency: "RUB"}, nil}},
 
 		{name: "transfer to non existing user", testInput: input{senderId: 3, recipientId: 4, amount: 100}, expectedOutput: output{nil, service.ErrUserNotFound}},
 		{name: "trying to withdraw more than account has", testInput: input{senderId: 5, recipientId: 6, amount: 100}, expectedOutput: output{nil, service.ErrNotEnoughMoney}},
+		{name: "transfer to user with lower id", testInput: input{senderId: 12, recipientId: 11, amount: 100}, expectedOutput: output{&service.Balance{PrimaryValue: 0, SecondaryValue: 0, Currency: "RUB"}, nil}},
 		{name: "trying to add too much money", testInput: input{senderId: 7, recipientId: 8, amount: 100}, expectedOutput: output{nil, service.ErrBalanceOverflow}},
 
 		{name: "internal error", testInput: input{senderId: 9, recipientId: 10, amount: 100}, expectedOutput: output{nil, service.ErrAccessDatabase}},
+		{name: "recipient without wallet", testInput: input{senderId: 13, recipientId: 14, amount: 100}, expectedOutput: output{&service.Balance{PrimaryValue: 0, SecondaryValue: 0, Currency: "RUB"}, nil}},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			balance, err := svc.Transfer(test.testInput.senderId, test.testInput.recipientId, test.testInput.amount)
-			assert.Equal(t, test.expectedOutput.err, err)
+			balance, err := svc.Transfer(context.Background(), test.testInput.senderId, test.testInput.recipientId, test.testInput.amount, "RUB", service.OperationDetails{}, "")
+			assert.ErrorIs(t, err, test.expectedOutput.err)
 			if err == nil {
+				_, parseErr := uuid.Parse(balance.OperationID)
+				assert.NoError(t, parseErr, "operation gets unique id")
+				balance.OperationID = ""
 				assert.Equal(t, test.expectedOutput.balance, balance)
 			}
 		})
 	}
 }
+
+func TestBalance_ConcurrentTransfers(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	_, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 1, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//concurrent transfers must not overdraw sender, only 33 of them fit into balance
+	const transfers = 50
+	results := make(chan error, transfers)
+	for i := 0; i < transfers; i++ {
+		go func() {
+			_, err := svc.Transfer(ctx, 1, 2, 30, "RUB", service.OperationDetails{}, "")
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < transfers; i++ {
+		err := <-results
+		if err == nil {
+			succeeded++
+		} else {
+			assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+		}
+	}
+	assert.Equal(t, 33, succeeded)
+
+	sender, err := svc.GetBalance(ctx, 1, "RUB", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &service.Balance{PrimaryValue: 0, SecondaryValue: 10, Currency: "RUB",
+		Reserved: &service.Amount{}, Total: &service.Amount{SecondaryValue: 10}}, sender)
+	recipient, err := svc.GetBalance(ctx, 2, "RUB", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &service.Balance{PrimaryValue: 9, SecondaryValue: 91, Currency: "RUB",
+		Reserved: &service.Amount{}, Total: &service.Amount{PrimaryValue: 9, SecondaryValue: 91}}, recipient)
+
+	history, err := svc.GetHistory(ctx, 2, service.HistoryFilter{}, 100, "")
+	assert.NoError(t, err)
+	assert.Len(t, history.Transfers, 34)
+}
+
+//racingUsers holds creation of users until given number of transactions try to create them,
+//so every one of them has seen that user doesn't exist yet
+type racingUsers struct {
+	*repository.Memory
+	mu      *sync.Mutex
+	waiting *int
+	ready   chan struct{}
+}
+
+func (racing racingUsers) WithTx(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error {
+	return racing.Memory.WithTx(ctx, opts, func(tx repository.Tx) error {
+		return fn(racingUserTx{tx, racing})
+	})
+}
+
+type racingUserTx struct {
+	repository.Tx
+	racing racingUsers
+}
+
+func (tx racingUserTx) CreateUser(ctx context.Context, id int64) error {
+	tx.racing.mu.Lock()
+	*tx.racing.waiting--
+	if *tx.racing.waiting == 0 {
+		close(tx.racing.ready)
+	}
+	tx.racing.mu.Unlock()
+	<-tx.racing.ready
+	return tx.Tx.CreateUser(ctx, id)
+}
+
+func TestBalance_ConcurrentFirstCredits(t *testing.T) {
+	const credits = 2
+	waiting := credits
+	memory := racingUsers{repository.NewMemory(), &sync.Mutex{}, &waiting, make(chan struct{})}
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	//both creditings find no user and create it at once
+	results := make(chan error, credits)
+	for i := 0; i < credits; i++ {
+		go func() {
+			_, err := svc.ChangeBalance(ctx, 7, 100, "RUB", service.OperationDetails{}, "")
+			results <- err
+		}()
+	}
+	for i := 0; i < credits; i++ {
+		assert.NoError(t, <-results)
+	}
+
+	balance, err := svc.GetBalance(ctx, 7, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), balance.PrimaryValue)
+	}
+}
+
+func TestBalance_HistoryPagination(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	const operations = 7
+	for i := 1; i <= operations; i++ {
+		_, err := svc.ChangeBalance(ctx, 1, int64(i*100), "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	//pages are read until there is no next cursor, every transfer is seen once from newest to oldest
+	var amounts []int64
+	var pages int
+	cursor := ""
+	for {
+		page, err := svc.GetHistory(ctx, 1, service.HistoryFilter{}, 3, cursor)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pages++
+		assert.LessOrEqual(t, len(page.Transfers), 3)
+		for _, transfer := range page.Transfers {
+			amounts = append(amounts, transfer.PrimaryValue)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []int64{7, 6, 5, 4, 3, 2, 1}, amounts)
+
+	//page ending exactly at the last transfer has no next cursor
+	page, err := svc.GetHistory(ctx, 1, service.HistoryFilter{}, operations, "")
+	assert.NoError(t, err)
+	assert.Len(t, page.Transfers, operations)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestBalance_HistoryFilter(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	//history of user 1 in kopeks: +1000, -300 (transfer), +200, -100 (transfer), -500
+	_, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 1, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, 1, 2, 300, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 1, 200, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, 1, 2, 100, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 1, -500, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	amount := func(value int64) *int64 {
+		return &value
+	}
+	var tests = []struct {
+		name            string
+		filter          service.HistoryFilter
+		expectedAmounts []int64
+	}{
+		{name: "newest first", filter: service.HistoryFilter{}, expectedAmounts: []int64{-500, -100, 200, -300, 1000}},
+		{name: "oldest first", filter: service.HistoryFilter{Ascending: true}, expectedAmounts: []int64{1000, -300, 200, -100, -500}},
+		{name: "credits", filter: service.HistoryFilter{Direction: service.DirectionCredit}, expectedAmounts: []int64{200, 1000}},
+		{name: "debits", filter: service.HistoryFilter{Direction: service.DirectionDebit}, expectedAmounts: []int64{-500, -100, -300}},
+		{name: "outgoing transfers", filter: service.HistoryFilter{OpType: service.OperationTransferOut}, expectedAmounts: []int64{-100, -300}},
+		{name: "deposits", filter: service.HistoryFilter{OpType: service.OperationDeposit}, expectedAmounts: []int64{200, 1000}},
+		{name: "withdrawals", filter: service.HistoryFilter{OpType: service.OperationWithdrawal}, expectedAmounts: []int64{-500}},
+		{name: "amount range", filter: service.HistoryFilter{MinAmount: amount(200), MaxAmount: amount(500)}, expectedAmounts: []int64{-500, 200, -300}},
+		{name: "largest first", filter: service.HistoryFilter{SortBy: service.SortByAmount}, expectedAmounts: []int64{1000, -500, -300, 200, -100}},
+		{name: "smallest debits first", filter: service.HistoryFilter{Direction: service.DirectionDebit, SortBy: service.SortByAmount, Ascending: true},
+			expectedAmounts: []int64{-100, -300, -500}},
+		{name: "time range", filter: service.HistoryFilter{From: time.Now().Add(time.Hour)}, expectedAmounts: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.NoError(t, test.filter.Validate())
+
+			//pages of two transfers check that cursor follows the order
+			var amounts []int64
+			cursor := ""
+			for {
+				page, err := svc.GetHistory(ctx, 1, test.filter, 2, cursor)
+				if !assert.NoError(t, err) {
+					return
+				}
+				for _, transfer := range page.Transfers {
+					amounts = append(amounts, transfer.PrimaryValue*100+transfer.SecondaryValue)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			assert.Equal(t, test.expectedAmounts, amounts)
+		})
+	}
+
+	//operation type and counterparty are recorded explicitly
+	page, err := svc.GetHistory(ctx, 2, service.HistoryFilter{}, 10, "")
+	assert.NoError(t, err)
+	if assert.Len(t, page.Transfers, 3) {
+		assert.Equal(t, service.OperationTransferIn, page.Transfers[0].OpType)
+		assert.Equal(t, int64(1), *page.Transfers[0].Counterparty)
+		assert.Equal(t, service.OperationDeposit, page.Transfers[2].OpType)
+		assert.Nil(t, page.Transfers[2].Counterparty)
+	}
+
+	//cursor taken in one order can't be used in another one
+	page, err = svc.GetHistory(ctx, 1, service.HistoryFilter{}, 2, "")
+	assert.NoError(t, err)
+	_, err = svc.GetHistory(ctx, 1, service.HistoryFilter{SortBy: service.SortByAmount}, 2, page.NextCursor)
+	assert.ErrorIs(t, err, service.ErrInvalidCursor)
+}
+
+func TestBalance_OperationDetails(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	details := service.OperationDetails{Purpose: "order payment", OrderID: "A-1", Metadata: map[string]string{"channel": "web"}}
+	assert.NoError(t, details.Validate())
+	_, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", details, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 1, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, 1, 2, 100, "RUB", service.OperationDetails{Purpose: "gift"}, "")
+	assert.NoError(t, err)
+
+	page, err := svc.GetHistory(ctx, 1, service.HistoryFilter{}, 10, "")
+	assert.NoError(t, err)
+	if assert.Len(t, page.Transfers, 2) {
+		assert.Equal(t, "gift", page.Transfers[0].Purpose)
+		assert.Nil(t, page.Transfers[0].ExternalRef)
+
+		assert.Equal(t, "order payment", page.Transfers[1].Purpose)
+		assert.Equal(t, "A-1", *page.Transfers[1].ExternalRef)
+		assert.Equal(t, map[string]string{"channel": "web"}, page.Transfers[1].Metadata)
+	}
+
+	//default purpose is kept when caller gives none
+	page, err = svc.GetHistory(ctx, 2, service.HistoryFilter{}, 10, "")
+	assert.NoError(t, err)
+	if assert.Len(t, page.Transfers, 2) {
+		assert.Equal(t, "gift", page.Transfers[0].Purpose)
+		assert.Equal(t, "External service operation", page.Transfers[1].Purpose)
+	}
+
+	invalid := service.OperationDetails{Metadata: map[string]string{"": "empty key"}}
+	assert.ErrorIs(t, invalid.Validate(), service.ErrInvalidDetails)
+}
+
+func TestBalance_GetOperation(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	deposit, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 1, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	transfer, err := svc.Transfer(ctx, 1, 2, 100, "RUB", service.OperationDetails{OrderID: "A-1"}, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, deposit.OperationID, transfer.OperationID)
+
+	operation, err := svc.GetOperation(ctx, transfer.OperationID)
+	assert.NoError(t, err)
+	assert.Equal(t, transfer.OperationID, operation.ID)
+	if assert.Len(t, operation.Entries, 2) {
+		sender, recipient := operation.Entries[0], operation.Entries[1]
+		assert.Equal(t, int64(1), sender.UserID)
+		assert.Equal(t, int64(-1), sender.PrimaryValue)
+		assert.Equal(t, service.OperationTransferOut, sender.OpType)
+		assert.Equal(t, int64(2), recipient.UserID)
+		assert.Equal(t, int64(1), recipient.PrimaryValue)
+		assert.Equal(t, service.OperationTransferIn, recipient.OpType)
+		assert.Equal(t, "A-1", *recipient.ExternalRef)
+	}
+
+	//history entries carry the same id
+	page, err := svc.GetHistory(ctx, 2, service.HistoryFilter{}, 1, "")
+	assert.NoError(t, err)
+	if assert.Len(t, page.Transfers, 1) {
+		assert.Equal(t, transfer.OperationID, page.Transfers[0].OperationID)
+	}
+
+	operation, err = svc.GetOperation(ctx, deposit.OperationID)
+	assert.NoError(t, err)
+	assert.Len(t, operation.Entries, 1)
+
+	_, err = svc.GetOperation(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, service.ErrOperationNotFound)
+}
+
+func TestBalance_IdempotencyKey(t *testing.T) {
+	memory := repository.NewMemory()
+	cfg := config.Default().Service
+	cfg.IdempotencyKeyTTL = 50 * time.Millisecond
+	svc := service.New(memory, testRates(), cfg)
+	ctx := context.Background()
+
+	first, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.NoError(t, err)
+	replayed, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.NoError(t, err)
+	assert.Equal(t, first, replayed, "replay gets outcome of the first request")
+
+	_, err = svc.ChangeBalance(ctx, 1, 2000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyReused)
+	_, err = svc.Transfer(ctx, 1, 2, 1000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyReused, "key can't be reused by another operation")
+
+	//failed operation is replayed too, even if it would succeed now
+	_, err = svc.ChangeBalance(ctx, 2, -500, "RUB", service.OperationDetails{}, "withdrawal-1")
+	assert.ErrorIs(t, err, service.ErrCreatingWithNegativeAmount)
+	_, err = svc.ChangeBalance(ctx, 2, 1000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, -500, "RUB", service.OperationDetails{}, "withdrawal-1")
+	assert.ErrorIs(t, err, service.ErrCreatingWithNegativeAmount)
+
+	//concurrent retries of transfer move money once
+	var wg sync.WaitGroup
+	operationIDs := make([]string, 10)
+	for i := range operationIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			balance, err := svc.Transfer(ctx, 1, 2, 100, "RUB", service.OperationDetails{}, "transfer-1")
+			if assert.NoError(t, err) {
+				operationIDs[i] = balance.OperationID
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, operationID := range operationIDs {
+		assert.Equal(t, operationIDs[0], operationID)
+	}
+	balance, err := svc.GetBalance(ctx, 1, "RUB", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), balance.PrimaryValue)
+
+	//expired key is executed again
+	time.Sleep(60 * time.Millisecond)
+	again, err := svc.ChangeBalance(ctx, 1, 1000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.OperationID, again.OperationID)
+	assert.Equal(t, int64(19), again.PrimaryValue)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, svc.PurgeIdempotencyKeys(ctx))
+	_, err = svc.ChangeBalance(ctx, 1, 2000, "RUB", service.OperationDetails{}, "deposit-1")
+	assert.NoError(t, err, "purged key is free")
+}
+
+func TestBalance_RetryOnConflict(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRepository, mockTx := newMockRepository(mockCtrl)
+	mockTx.EXPECT().UpdateHistory(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	deadlock := &pgconn.PgError{Code: repository.CodeDeadlockDetected}
+	serializationFailure := &pgconn.PgError{Code: repository.CodeSerializationFailure}
+
+	//the whole transaction is run again after deadlock
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", true).Return(repository.Balance{Amount: 100}, nil).Times(2)
+	gomock.InOrder(
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), "RUB", int64(100)).Return(deadlock).Times(1),
+		mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), "RUB", int64(100)).Return(nil).Times(1),
+	)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", false).Return(repository.Balance{Amount: 200}, nil).Times(1)
+
+	//retries are bounded
+	cfg := config.Default().Service
+	cfg.TxRetries = 2
+	cfg.TxRetryBaseDelay = time.Millisecond
+	cfg.TxRetryMaxDelay = time.Millisecond
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(2), "RUB", true).Return(repository.Balance{}, serializationFailure).Times(cfg.TxRetries + 1)
+
+	svc := service.New(mockRepository, testRates(), cfg)
+
+	balance, err := svc.ChangeBalance(context.Background(), 1, 100, "RUB", service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), balance.PrimaryValue)
+	}
+
+	_, err = svc.Transfer(context.Background(), 2, 3, 100, "RUB", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrAccessDatabase)
+}
+
+func TestBalance_OppositeTransfers(t *testing.T) {
+	memory := repository.NewMemory()
+	cfg := config.Default().Service
+	//any deadlock would fail transfer
+	cfg.TxRetries = 0
+	svc := service.New(memory, testRates(), cfg)
+	ctx := context.Background()
+
+	for _, id := range []int64{1, 2} {
+		_, err := svc.ChangeBalance(ctx, id, 10000, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	const transfers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < transfers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Transfer(ctx, 1, 2, 10, "RUB", service.OperationDetails{}, "")
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := svc.Transfer(ctx, 2, 1, 10, "RUB", service.OperationDetails{}, "")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range []int64{1, 2} {
+		balance, err := svc.GetBalance(ctx, id, "RUB", "")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100), balance.PrimaryValue)
+	}
+}
+
+func TestBalance_CommitError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockRepository := mock_repository.NewMockRepository(mockCtrl)
+	mockTx := mock_repository.NewMockTx(mockCtrl)
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", true).Return(repository.Balance{Amount: 100}, nil).AnyTimes()
+	mockTx.EXPECT().ChangeUserBalance(gomock.Any(), int64(1), "RUB", int64(100)).Return(nil).AnyTimes()
+	mockTx.EXPECT().UpdateHistory(gomock.Any(), int64(1), gomock.Any()).Return(nil).AnyTimes()
+	mockTx.EXPECT().GetUserBalance(gomock.Any(), int64(1), "RUB", false).Return(repository.Balance{Amount: 200}, nil).AnyTimes()
+
+	commit := func(commitErr error) func(context.Context, repository.TxOptions, func(repository.Tx) error) error {
+		return func(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error {
+			if err := fn(mockTx); err != nil {
+				return err
+			}
+			return commitErr
+		}
+	}
+
+	cfg := config.Default().Service
+	cfg.TxRetryBaseDelay = time.Millisecond
+	cfg.TxRetryMaxDelay = time.Millisecond
+	svc := service.New(mockRepository, testRates(), cfg)
+
+	//changes which were not committed are never reported as done
+	mockRepository.EXPECT().WithTx(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(commit(errors.New("connection lost"))).Times(1)
+	_, err := svc.ChangeBalance(context.Background(), 1, 100, "RUB", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrAccessDatabase)
+
+	//serialization failure on commit is retried like any other conflict
+	gomock.InOrder(
+		mockRepository.EXPECT().WithTx(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			commit(&pgconn.PgError{Code: repository.CodeSerializationFailure})).Times(1),
+		mockRepository.EXPECT().WithTx(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(commit(nil)).Times(1),
+	)
+	balance, err := svc.ChangeBalance(context.Background(), 1, 100, "RUB", service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), balance.PrimaryValue)
+	}
+}
+
+func TestBalance_Reservations(t *testing.T) {
+	memory := repository.NewMemory()
+	cfg := config.Default().Service
+	cfg.ReservationTTL = time.Minute
+	cfg.ReservationMaxTTL = time.Hour
+	svc := service.New(memory, testRates(), cfg)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 100} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	_, err := svc.Reserve(ctx, 3, 100, "RUB", 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+	_, err = svc.Reserve(ctx, 1, 100, "RUB", 2*time.Hour, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrInvalidReservation)
+	_, err = svc.Reserve(ctx, 1, 10001, "RUB", 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+
+	details := service.OperationDetails{Purpose: "Order payment", OrderID: "order-1"}
+	captured, err := svc.Reserve(ctx, 1, 4000, "RUB", time.Minute, details, "hold-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ReservationActive, captured.Status)
+		assert.Equal(t, int64(40), captured.PrimaryValue)
+	}
+	replayed, err := svc.Reserve(ctx, 1, 4000, "RUB", time.Minute, details, "hold-1")
+	assert.NoError(t, err)
+	assert.Equal(t, captured, replayed, "replay gets the same reservation")
+	released, err := svc.Reserve(ctx, 1, 3000, "RUB", 0, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//reserved money stays in balance, but can't be spent
+	balance, err := svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(30), balance.PrimaryValue)
+		assert.Equal(t, &service.Amount{PrimaryValue: 70}, balance.Reserved)
+		assert.Equal(t, &service.Amount{PrimaryValue: 100}, balance.Total)
+	}
+	_, err = svc.ChangeBalance(ctx, 1, -3001, "RUB", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	_, err = svc.Transfer(ctx, 1, 2, 3001, "RUB", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+
+	//capture charges part of reservation and returns the rest
+	_, err = svc.CaptureReservation(ctx, 1, captured.ID, 4001, service.OperationDetails{})
+	assert.ErrorIs(t, err, service.ErrInvalidReservation)
+	_, err = svc.CaptureReservation(ctx, 2, captured.ID, 0, service.OperationDetails{})
+	assert.ErrorIs(t, err, service.ErrReservationNotFound, "reservation of another user is hidden")
+	captured, err = svc.CaptureReservation(ctx, 1, captured.ID, 2500, service.OperationDetails{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ReservationCaptured, captured.Status)
+		assert.Equal(t, &service.Amount{PrimaryValue: 25}, captured.Captured)
+		operation, err := svc.GetOperation(ctx, captured.OperationID)
+		if assert.NoError(t, err) && assert.Len(t, operation.Entries, 1) {
+			assert.Equal(t, service.OperationWithdrawal, operation.Entries[0].OpType)
+			assert.Equal(t, int64(-25), operation.Entries[0].PrimaryValue)
+			assert.Equal(t, "Order payment", operation.Entries[0].Purpose)
+		}
+	}
+	_, err = svc.CaptureReservation(ctx, 1, captured.ID, 0, service.OperationDetails{})
+	assert.ErrorIs(t, err, service.ErrReservationFinished)
+
+	released, err = svc.ReleaseReservation(ctx, 1, released.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ReservationReleased, released.Status)
+		assert.Nil(t, released.Captured)
+	}
+	_, err = svc.ReleaseReservation(ctx, 1, released.ID)
+	assert.ErrorIs(t, err, service.ErrReservationFinished)
+
+	balance, err = svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(75), balance.PrimaryValue)
+		assert.Equal(t, &service.Amount{}, balance.Reserved)
+	}
+
+	//expired reservation is released by worker or by attempt to capture it
+	expiring := make([]*service.Reservation, 2)
+	for i := range expiring {
+		expiring[i], err = svc.Reserve(ctx, 1, 1000, "RUB", time.Millisecond, service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err = svc.CaptureReservation(ctx, 1, expiring[0].ID, 0, service.OperationDetails{})
+	assert.ErrorIs(t, err, service.ErrReservationExpired)
+	expired, err := svc.ExpireReservations(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	for _, reservation := range expiring {
+		reservation, err := svc.GetReservation(ctx, 1, reservation.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, service.ReservationExpired, reservation.Status)
+		}
+	}
+	balance, err = svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(75), balance.PrimaryValue)
+	}
+
+	_, err = svc.GetReservation(ctx, 1, uuid.NewString())
+	assert.ErrorIs(t, err, service.ErrReservationNotFound)
+}
+
+func TestBalance_WalletReservations(t *testing.T) {
+	svc := service.New(repository.NewMemory(), testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	_, err := svc.ChangeBalance(ctx, 1, 500, "USD", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//money is reserved in wallet of reservation's currency only
+	_, err = svc.Reserve(ctx, 1, 100, "RUB", 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	reservation, err := svc.Reserve(ctx, 1, 200, "USD", 0, service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", reservation.Currency)
+		assert.Equal(t, int64(2), reservation.PrimaryValue)
+	}
+	balance, err := svc.GetBalance(ctx, 1, "USD", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &service.Amount{PrimaryValue: 2}, balance.Reserved)
+	}
+
+	reservation, err = svc.CaptureReservation(ctx, 1, reservation.ID, 150, service.OperationDetails{})
+	if assert.NoError(t, err) {
+		operation, err := svc.GetOperation(ctx, reservation.OperationID)
+		if assert.NoError(t, err) && assert.Len(t, operation.Entries, 1) {
+			assert.Equal(t, "USD", operation.Entries[0].Currency)
+		}
+	}
+	balance, err = svc.GetBalance(ctx, 1, "USD", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(3), balance.PrimaryValue)
+		assert.Equal(t, int64(50), balance.SecondaryValue)
+		assert.Equal(t, &service.Amount{}, balance.Reserved)
+	}
+}
+
+func TestBalance_ReverseOperation(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	deposit, err := svc.ChangeBalance(ctx, 1, 10000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 100, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	transfer, err := svc.Transfer(ctx, 1, 2, 5000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//partial refund moves money back from recipient and references transfer
+	reversal, err := svc.ReverseOperation(ctx, transfer.OperationID, 2000, service.OperationDetails{OrderID: "refund-1"}, "refund-1")
+	if assert.NoError(t, err) && assert.Len(t, reversal.Entries, 2) {
+		for _, entry := range reversal.Entries {
+			assert.Equal(t, service.OperationReversal, entry.OpType)
+			assert.Equal(t, transfer.OperationID, *entry.Reverses)
+		}
+		assert.Equal(t, int64(1), reversal.Entries[0].UserID)
+		assert.Equal(t, int64(20), reversal.Entries[0].PrimaryValue)
+		assert.Equal(t, int64(2), reversal.Entries[1].UserID)
+		assert.Equal(t, int64(-20), reversal.Entries[1].PrimaryValue)
+	}
+	replayed, err := svc.ReverseOperation(ctx, transfer.OperationID, 2000, service.OperationDetails{OrderID: "refund-1"}, "refund-1")
+	assert.NoError(t, err)
+	assert.Equal(t, reversal.ID, replayed.ID, "retried refund is made once")
+
+	//refunds never exceed operation
+	_, err = svc.ReverseOperation(ctx, transfer.OperationID, 3001, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrReversalExceedsOperation)
+
+	//recipient which spent money can't refund it
+	_, err = svc.ChangeBalance(ctx, 2, -2000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ReverseOperation(ctx, transfer.OperationID, 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	_, err = svc.ChangeBalance(ctx, 2, 2000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//zero amount refunds the rest
+	reversal, err = svc.ReverseOperation(ctx, transfer.OperationID, 0, service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(30), reversal.Entries[0].PrimaryValue)
+	}
+	_, err = svc.ReverseOperation(ctx, transfer.OperationID, 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrReversalExceedsOperation)
+
+	//reversal itself is final
+	_, err = svc.ReverseOperation(ctx, reversal.ID, 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrOperationNotReversible)
+	_, err = svc.ReverseOperation(ctx, uuid.NewString(), 0, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrOperationNotFound)
+
+	//external credit is refunded from the user
+	reversal, err = svc.ReverseOperation(ctx, deposit.OperationID, 1000, service.OperationDetails{}, "")
+	if assert.NoError(t, err) && assert.Len(t, reversal.Entries, 1) {
+		assert.Equal(t, int64(-10), reversal.Entries[0].PrimaryValue)
+	}
+
+	for id, expected := range map[int64]int64{1: 90, 2: 1} {
+		balance, err := svc.GetBalance(ctx, id, "RUB", "")
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, balance.PrimaryValue)
+		}
+	}
+}
+
+func TestBalance_Wallets(t *testing.T) {
+	svc := service.New(repository.NewMemory(), testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	_, err := svc.ChangeBalance(ctx, 1, 10000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	usd, err := svc.ChangeBalance(ctx, 1, 5000, "USD", service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &service.Balance{PrimaryValue: 50, Currency: "USD", OperationID: usd.OperationID}, usd)
+	}
+	_, err = svc.ChangeBalance(ctx, 2, 100, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//wallets are independent, money of one can't be spent from another
+	_, err = svc.ChangeBalance(ctx, 1, -5001, "USD", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	_, err = svc.ChangeBalance(ctx, 2, -1, "EUR", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	_, err = svc.Transfer(ctx, 2, 1, 1, "USD", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney)
+	_, err = svc.GetBalance(ctx, 2, "USD", "")
+	assert.ErrorIs(t, err, service.ErrWalletNotFound, "rejected operations don't open wallets")
+
+	//recipient gets wallet with the first transfer in currency
+	transfer, err := svc.Transfer(ctx, 1, 2, 2000, "USD", service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(30), transfer.PrimaryValue)
+		assert.Equal(t, "USD", transfer.Currency)
+	}
+	balances, err := svc.GetBalances(ctx, 2)
+	if assert.NoError(t, err) && assert.Len(t, balances, 2) {
+		assert.Equal(t, "RUB", balances[0].Currency)
+		assert.Equal(t, int64(1), balances[0].PrimaryValue)
+		assert.Equal(t, "USD", balances[1].Currency)
+		assert.Equal(t, int64(20), balances[1].PrimaryValue)
+		assert.Equal(t, int64(20), balances[1].Total.PrimaryValue)
+	}
+	_, err = svc.GetBalances(ctx, 3)
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+
+	//history entries are tagged with currency and can be filtered by it
+	page, err := svc.GetHistory(ctx, 1, service.HistoryFilter{Currency: "USD"}, 10, "")
+	if assert.NoError(t, err) && assert.Len(t, page.Transfers, 2) {
+		for _, transfer := range page.Transfers {
+			assert.Equal(t, "USD", transfer.Currency)
+		}
+	}
+	assert.ErrorIs(t, service.HistoryFilter{Currency: "XXX"}.Validate(), service.ErrInvalidFilter)
+
+	//reversal refunds wallets operation changed
+	reversal, err := svc.ReverseOperation(ctx, transfer.OperationID, 0, service.OperationDetails{}, "")
+	if assert.NoError(t, err) && assert.Len(t, reversal.Entries, 2) {
+		assert.Equal(t, "USD", reversal.Entries[0].Currency)
+	}
+	for id, expected := range map[int64]int64{1: 50, 2: 0} {
+		balance, err := svc.GetBalance(ctx, id, "USD", "")
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, balance.PrimaryValue)
+		}
+	}
+	rub, err := svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(100), rub.PrimaryValue)
+	}
+}
+
+func TestBalance_TransferBatch(t *testing.T) {
+	memory := repository.NewMemory()
+	cfg := config.Default().Service
+	cfg.MaxBatchSize = 3
+	svc := service.New(memory, testRates(), cfg)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 100, 3: math.MaxInt64 - 100} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	_, err := svc.TransferBatch(ctx, 1, "RUB", nil, "")
+	assert.ErrorIs(t, err, service.ErrInvalidBatch)
+	_, err = svc.TransferBatch(ctx, 1, "RUB", make([]service.BatchItem, 4), "")
+	assert.ErrorIs(t, err, service.ErrInvalidBatch)
+
+	//every item is checked, nothing is transferred if one of them fails
+	var batchErr *service.BatchError
+	_, err = svc.TransferBatch(ctx, 1, "RUB", []service.BatchItem{
+		{RecipientID: 2, Amount: 100},
+		{RecipientID: 4, Amount: 100},
+		{RecipientID: 3, Amount: 101},
+	}, "batch-1")
+	assert.ErrorIs(t, err, service.ErrUserNotFound, "the first failure rejects batch")
+	if assert.ErrorAs(t, err, &batchErr) && assert.Len(t, batchErr.Results, 3) {
+		assert.Equal(t, service.BatchItemNotExecuted, batchErr.Results[0].Status)
+		assert.Equal(t, service.BatchItemFailed, batchErr.Results[1].Status)
+		assert.Equal(t, service.BatchItemFailed, batchErr.Results[2].Status)
+		assert.Equal(t, service.ErrBalanceOverflow.Error(), batchErr.Results[2].Error)
+	}
+	_, replayed := svc.TransferBatch(ctx, 1, "RUB", []service.BatchItem{
+		{RecipientID: 2, Amount: 100},
+		{RecipientID: 4, Amount: 100},
+		{RecipientID: 3, Amount: 101},
+	}, "batch-1")
+	assert.Equal(t, err, replayed, "replay tells which items failed")
+
+	_, err = svc.TransferBatch(ctx, 1, "RUB", []service.BatchItem{{RecipientID: 2, Amount: 5000}, {RecipientID: 2, Amount: 5001}}, "")
+	assert.ErrorIs(t, err, service.ErrNotEnoughMoney, "sender pays for the whole batch")
+
+	batch, err := svc.TransferBatch(ctx, 1, "RUB", []service.BatchItem{
+		{RecipientID: 2, Amount: 3000, Details: service.OperationDetails{Purpose: "Salary"}},
+		{RecipientID: 2, Amount: 1000},
+		{RecipientID: 3, Amount: 100},
+	}, "")
+	if assert.NoError(t, err) && assert.Len(t, batch.Results, 3) {
+		assert.Equal(t, int64(59), batch.Balance.PrimaryValue)
+		for _, result := range batch.Results {
+			assert.Equal(t, service.BatchItemDone, result.Status)
+		}
+		//every item is its own operation
+		operation, err := svc.GetOperation(ctx, batch.Results[0].OperationID)
+		if assert.NoError(t, err) && assert.Len(t, operation.Entries, 2) {
+			assert.Equal(t, "Salary", operation.Entries[1].Purpose)
+			assert.Equal(t, int64(30), operation.Entries[1].PrimaryValue)
+		}
+		assert.NotEqual(t, batch.Results[0].OperationID, batch.Results[1].OperationID)
+	}
+
+	balance, err := svc.GetBalance(ctx, 2, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(41), balance.PrimaryValue)
+	}
+}
+
+func TestBalance_Schedules(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 100} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	_, err := svc.CreateSchedule(ctx, 1, 2, 0, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrInvalidSchedule)
+	_, err = svc.CreateSchedule(ctx, 1, 1, 100, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrInvalidSchedule)
+	_, err = svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Time{}, "yearly", service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrInvalidSchedule)
+	_, err = svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Now().Add(-time.Hour), service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrInvalidSchedule)
+	_, err = svc.CreateSchedule(ctx, 1, 3, 100, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.ErrorIs(t, err, service.ErrUserNotFound)
+
+	details := service.OperationDetails{Purpose: "Rent", OrderID: "lease-1"}
+	once, err := svc.CreateSchedule(ctx, 1, 2, 3000, "RUB", time.Time{}, service.RecurrenceNone, details, "schedule-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ScheduleActive, once.Status)
+		assert.Equal(t, &once.StartAt, once.NextRunAt)
+	}
+	replayed, err := svc.CreateSchedule(ctx, 1, 2, 3000, "RUB", time.Time{}, service.RecurrenceNone, details, "schedule-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, once.ID, replayed.ID, "replay gets the same schedule")
+	}
+	daily, err := svc.CreateSchedule(ctx, 1, 2, 5000, "RUB", time.Time{}, service.RecurrenceDaily, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	unpaid, err := svc.CreateSchedule(ctx, 1, 2, 100000, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	later, err := svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Now().Add(time.Hour), service.RecurrenceWeekly, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	executed, err := svc.ExecuteDueSchedules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, executed)
+	executed, err = svc.ExecuteDueSchedules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed, "due times are executed once")
+
+	once, err = svc.GetSchedule(ctx, 1, once.ID)
+	if assert.NoError(t, err) && assert.Len(t, once.Runs, 1) {
+		assert.Equal(t, service.ScheduleCompleted, once.Status)
+		assert.Nil(t, once.NextRunAt)
+		assert.Equal(t, service.RunSucceeded, once.Runs[0].Status)
+		operation, err := svc.GetOperation(ctx, once.Runs[0].OperationID)
+		if assert.NoError(t, err) && assert.Len(t, operation.Entries, 2) {
+			assert.Equal(t, "Rent", operation.Entries[0].Purpose)
+			assert.Equal(t, "lease-1", *operation.Entries[0].ExternalRef)
+		}
+	}
+	daily, err = svc.GetSchedule(ctx, 1, daily.ID)
+	if assert.NoError(t, err) && assert.NotNil(t, daily.NextRunAt) {
+		assert.Equal(t, service.ScheduleActive, daily.Status)
+		assert.Equal(t, 1, daily.RunCount)
+		assert.Equal(t, daily.StartAt.AddDate(0, 0, 1), *daily.NextRunAt)
+	}
+	//rejected transfer is recorded, schedule moves on
+	unpaid, err = svc.GetSchedule(ctx, 1, unpaid.ID)
+	if assert.NoError(t, err) && assert.Len(t, unpaid.Runs, 1) {
+		assert.Equal(t, service.ScheduleCompleted, unpaid.Status)
+		assert.Equal(t, service.RunFailed, unpaid.Runs[0].Status)
+		assert.Equal(t, service.ErrNotEnoughMoney.Error(), unpaid.Runs[0].Error)
+		assert.Empty(t, unpaid.Runs[0].OperationID)
+	}
+
+	balance, err := svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(20), balance.PrimaryValue)
+	}
+
+	_, err = svc.CancelSchedule(ctx, 2, later.ID)
+	assert.ErrorIs(t, err, service.ErrScheduleNotFound, "schedule of another user is hidden")
+	later, err = svc.CancelSchedule(ctx, 1, later.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ScheduleCanceled, later.Status)
+		assert.NotNil(t, later.CanceledAt)
+		assert.Nil(t, later.NextRunAt)
+	}
+	_, err = svc.CancelSchedule(ctx, 1, later.ID)
+	assert.ErrorIs(t, err, service.ErrScheduleFinished)
+	_, err = svc.CancelSchedule(ctx, 1, once.ID)
+	assert.ErrorIs(t, err, service.ErrScheduleFinished)
+
+	schedules, err := svc.GetSchedules(ctx, 1, "", 10, "")
+	if assert.NoError(t, err) && assert.Len(t, schedules.Schedules, 4) {
+		assert.Equal(t, later.ID, schedules.Schedules[0].ID, "newest first")
+		assert.Nil(t, schedules.Schedules[0].Runs)
+		assert.Empty(t, schedules.NextCursor)
+	}
+	var paged []string
+	for cursor := ""; ; {
+		page, err := svc.GetSchedules(ctx, 1, "", 3, cursor)
+		if !assert.NoError(t, err) {
+			break
+		}
+		for _, schedule := range page.Schedules {
+			paged = append(paged, schedule.ID)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{later.ID, unpaid.ID, daily.ID, once.ID}, paged, "pages follow each other")
+	active, err := svc.GetSchedules(ctx, 1, service.ScheduleActive, 10, "")
+	if assert.NoError(t, err) && assert.Len(t, active.Schedules, 1) {
+		assert.Equal(t, daily.ID, active.Schedules[0].ID)
+	}
+	_, err = svc.GetSchedules(ctx, 1, "", 10, "invalid")
+	assert.ErrorIs(t, err, service.ErrInvalidCursor)
+	_, err = svc.GetSchedule(ctx, 1, uuid.NewString())
+	assert.ErrorIs(t, err, service.ErrScheduleNotFound)
+}
+
+func TestBalance_ScheduleRunKeyTaken(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 0} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+	schedule, err := svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	//key of run is taken by another request, run fails instead of blocking worker on every tick
+	assert.ErrorIs(t, service.ValidateIdempotencyKey("internal:schedule "+schedule.ID+" run 0"), service.ErrInvalidIdempotencyKey)
+	_, err = svc.ChangeBalance(ctx, 1, 1, "RUB", service.OperationDetails{}, "internal:schedule "+schedule.ID+" run 0")
+	assert.NoError(t, err)
+
+	executed, err := svc.ExecuteDueSchedules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, executed)
+	schedule, err = svc.GetSchedule(ctx, 1, schedule.ID)
+	if assert.NoError(t, err) && assert.Len(t, schedule.Runs, 1) {
+		assert.Equal(t, service.ScheduleCompleted, schedule.Status)
+		assert.Equal(t, service.RunFailed, schedule.Runs[0].Status)
+		assert.Equal(t, service.ErrIdempotencyKeyReused.Error(), schedule.Runs[0].Error)
+	}
+}
+
+func TestBalance_WalletSchedules(t *testing.T) {
+	svc := service.New(repository.NewMemory(), testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	_, err := svc.ChangeBalance(ctx, 1, 10000, "RUB", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 1, 500, "USD", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	_, err = svc.ChangeBalance(ctx, 2, 0, "USD", service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	paid, err := svc.CreateSchedule(ctx, 1, 2, 300, "USD", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "USD", paid.Currency)
+	}
+	//money of RUB wallet is not used for transfers in USD
+	unpaid, err := svc.CreateSchedule(ctx, 1, 2, 1000, "USD", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+
+	executed, err := svc.ExecuteDueSchedules(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, executed)
+	for schedule, status := range map[*service.Schedule]service.RunStatus{paid: service.RunSucceeded, unpaid: service.RunFailed} {
+		schedule, err := svc.GetSchedule(ctx, 1, schedule.ID)
+		if assert.NoError(t, err) && assert.Len(t, schedule.Runs, 1) {
+			assert.Equal(t, status, schedule.Runs[0].Status)
+		}
+	}
+
+	for id, expected := range map[int64]int64{1: 200, 2: 300} {
+		balance, err := svc.GetBalance(ctx, id, "USD", "")
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, balance.PrimaryValue*100+balance.SecondaryValue)
+		}
+	}
+	balance, err := svc.GetBalance(ctx, 1, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(100), balance.PrimaryValue)
+	}
+}
+
+//brokenSchedules fails to store runs of given schedule
+type brokenSchedules struct {
+	*repository.Memory
+	scheduleID *string
+}
+
+func (broken brokenSchedules) WithTx(ctx context.Context, opts repository.TxOptions, fn func(tx repository.Tx) error) error {
+	return broken.Memory.WithTx(ctx, opts, func(tx repository.Tx) error {
+		return fn(brokenScheduleTx{tx, *broken.scheduleID})
+	})
+}
+
+type brokenScheduleTx struct {
+	repository.Tx
+	scheduleID string
+}
+
+func (tx brokenScheduleTx) AddScheduleRun(ctx context.Context, run repository.ScheduleRun) error {
+	if run.ScheduleID == tx.scheduleID {
+		return errors.New("disk is full")
+	}
+	return tx.Tx.AddScheduleRun(ctx, run)
+}
+
+func TestBalance_BrokenSchedule(t *testing.T) {
+	var brokenID string
+	svc := service.New(brokenSchedules{repository.NewMemory(), &brokenID}, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 0} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+	broken, err := svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	healthy, err := svc.CreateSchedule(ctx, 1, 2, 200, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+	assert.NoError(t, err)
+	brokenID = broken.ID
+
+	//the earliest schedule keeps failing, but doesn't block the next one
+	for i := 0; i < 3; i++ {
+		_, err := svc.ExecuteDueSchedules(ctx)
+		assert.ErrorIs(t, err, service.ErrAccessDatabase)
+	}
+
+	broken, err = svc.GetSchedule(ctx, 1, broken.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, service.ScheduleActive, broken.Status)
+		assert.Equal(t, 0, broken.RunCount)
+	}
+	healthy, err = svc.GetSchedule(ctx, 1, healthy.ID)
+	if assert.NoError(t, err) && assert.Len(t, healthy.Runs, 1) {
+		assert.Equal(t, service.ScheduleCompleted, healthy.Status)
+		assert.Equal(t, service.RunSucceeded, healthy.Runs[0].Status)
+	}
+	//transfer of run which wasn't stored is rolled back with it, so it can't be made twice
+	recipient, err := svc.GetBalance(ctx, 2, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), recipient.PrimaryValue)
+	}
+}
+
+func TestBalance_ConcurrentSchedules(t *testing.T) {
+	memory := repository.NewMemory()
+	svc := service.New(memory, testRates(), config.Default().Service)
+	ctx := context.Background()
+
+	for id, amount := range map[int64]int64{1: 10000, 2: 0} {
+		_, err := svc.ChangeBalance(ctx, id, amount, "RUB", service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+	const schedules = 20
+	for i := 0; i < schedules; i++ {
+		_, err := svc.CreateSchedule(ctx, 1, 2, 100, "RUB", time.Time{}, service.RecurrenceNone, service.OperationDetails{}, "")
+		assert.NoError(t, err)
+	}
+
+	//workers of several instances skip schedules locked by each other
+	var wg sync.WaitGroup
+	executed := make([]int, 4)
+	for i := range executed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			executed[i], err = svc.ExecuteDueSchedules(ctx)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, count := range executed {
+		total += count
+	}
+	assert.Equal(t, schedules, total)
+	balance, err := svc.GetBalance(ctx, 2, "RUB", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(schedules), balance.PrimaryValue, "every schedule transfers once")
+	}
+}
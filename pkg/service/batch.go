@@ -0,0 +1,181 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+type BatchItemStatus string
+
+const (
+	BatchItemDone   BatchItemStatus = "done"
+	BatchItemFailed BatchItemStatus = "failed"
+	//item is valid, but nothing was transferred because batch was rejected
+	BatchItemNotExecuted BatchItemStatus = "not executed"
+)
+
+//BatchItem is one transfer of batch, every item is a separate operation with its own details
+type BatchItem struct {
+	RecipientID int64            `json:"recipient"`
+	Amount      int64            `json:"amount"`
+	Details     OperationDetails `json:"details"`
+}
+
+type BatchItemResult struct {
+	Recipient int64           `json:"recipient"`
+	Status    BatchItemStatus `json:"status"`
+	//only for done item
+	OperationID string `json:"operation id,omitempty"`
+	//only for failed item
+	Error string `json:"error,omitempty"`
+}
+
+//BatchTransfer is outcome of batch, results are in order of items
+type BatchTransfer struct {
+	//sender's balance after every transfer of batch is made
+	Balance *Balance           `json:"balance,omitempty"`
+	Results []*BatchItemResult `json:"results"`
+}
+
+//BatchError rejects the whole batch, it wraps error of the first failed item
+//or ErrNotEnoughMoney if sender can't pay for every item
+type BatchError struct {
+	Results []*BatchItemResult
+	Err     error
+}
+
+func (batchErr *BatchError) Error() string {
+	return batchErr.Err.Error()
+}
+
+func (batchErr *BatchError) Unwrap() error {
+	return batchErr.Err
+}
+
+//ErrorDetails are sent with error message, so caller sees which items failed
+func (batchErr *BatchError) ErrorDetails() interface{} {
+	return batchErr.Results
+}
+
+//params must be validated:
+//ids must be >= 0, recipients must differ from sender, amounts must be positive,
+//currency must be known currency code, details and idempotency key must pass validation.
+//Every item moves money between wallets in currency, missing wallets of recipients are opened.
+//Batch is made in one transaction: either every item is transferred or none of them.
+//Rejected batch is reported with BatchError which has result of every item
+func (bs *BalanceService) TransferBatch(ctx context.Context, senderID int64, currency string, items []BatchItem, idempotencyKey string) (*BatchTransfer, error) {
+	if len(items) == 0 || len(items) > bs.cfg.MaxBatchSize {
+		return nil, fmt.Errorf("%w: batch must have 1 to %d items", ErrInvalidBatch, bs.cfg.MaxBatchSize)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.TransferTimeout)
+	defer cancel()
+
+	request := batchRequest{SenderID: senderID, Currency: currency, Items: items}
+	var result outcome
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newBatchOutcome(bs.transferBatch(ctx, tx, senderID, currency, items))
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	//rejected batch is committed too, so its outcome is stored with the key
+	return result.batch()
+}
+
+func (bs *BalanceService) transferBatch(ctx context.Context, tx repository.Tx, senderID int64, currency string, items []BatchItem) (*BatchTransfer, error) {
+	//every row is locked once, in id order like transfer does
+	ids := []int64{senderID}
+	for _, item := range items {
+		ids = append(ids, item.RecipientID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	balances := make(map[int64]repository.Balance, len(ids))
+	//recipients whose wallets are opened by batch
+	opened := make(map[int64]bool)
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		balance, exists, err := bs.walletBalance(ctx, tx, id, currency, true)
+		if err != nil {
+			//unknown recipient fails only its item, unknown sender fails the whole batch
+			if errors.Is(err, ErrUserNotFound) && id != senderID {
+				continue
+			}
+			return nil, err
+		}
+		balances[id] = balance
+		if !exists && id != senderID {
+			opened[id] = true
+		}
+	}
+
+	//every item is checked before anything is written, so rejection can be replayed
+	var rejected error
+	results := make([]*BatchItemResult, len(items))
+	credited := make(map[int64]int64, len(items))
+	var total int64
+	for i, item := range items {
+		results[i] = &BatchItemResult{Recipient: item.RecipientID, Status: BatchItemNotExecuted}
+		recipient, exists := balances[item.RecipientID]
+		var err error
+		switch {
+		case !exists:
+			err = ErrUserNotFound
+		case math.MaxInt64-recipient.Amount-credited[item.RecipientID] < item.Amount:
+			err = ErrBalanceOverflow
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = BatchItemFailed, err.Error()
+			if rejected == nil {
+				rejected = err
+			}
+			continue
+		}
+		credited[item.RecipientID] += item.Amount
+
+		//sum which doesn't fit into int64 is more than any balance
+		if total > math.MaxInt64-item.Amount {
+			total = math.MaxInt64
+		} else {
+			total += item.Amount
+		}
+	}
+	//reserved money can't be transferred
+	if sender := balances[senderID]; rejected == nil && sender.Amount-sender.Reserved < total {
+		rejected = ErrNotEnoughMoney
+	}
+	if rejected != nil {
+		return nil, &BatchError{Results: results, Err: rejected}
+	}
+
+	for i, item := range items {
+		if opened[item.RecipientID] {
+			if err := tx.CreateWallet(ctx, item.RecipientID, currency); err != nil {
+				return nil, dbError(ctx, err)
+			}
+			opened[item.RecipientID] = false
+		}
+		operationID, err := bs.moveMoney(ctx, tx, senderID, item.RecipientID, item.Amount, currency, item.Details)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Status, results[i].OperationID = BatchItemDone, operationID
+	}
+
+	balance, err := bs.getBalance(ctx, tx, senderID, currency, false)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchTransfer{Balance: balance, Results: results}, nil
+}
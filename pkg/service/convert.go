@@ -0,0 +1,69 @@
+package service
+
+import (
+	"balance/pkg/currency"
+	"math/big"
+	"strconv"
+)
+
+//RoundingMode tells how converted amount is rounded to whole minor units
+type RoundingMode int
+
+const (
+	//half to the nearest even unit, doesn't drift when many amounts are rounded
+	RoundHalfEven RoundingMode = iota
+	//half away from zero
+	RoundHalfUp
+	//towards negative infinity
+	RoundFloor
+)
+
+//convertAmount converts amount of minor units of one currency to minor units of another one.
+//Rate is given for major units, so result is scaled by difference of minor unit exponents.
+//Multiplication is exact and result is rounded with given mode. Rate is taken in its shortest
+//decimal form, so 0.0135 is exactly 135/10000 and not the nearest binary fraction
+func convertAmount(amount int64, from currency.Currency, to currency.Currency, rate float64, mode RoundingMode) (int64, error) {
+	exactRate, ok := new(big.Rat).SetString(strconv.FormatFloat(rate, 'g', -1, 64))
+	if !ok || exactRate.Sign() <= 0 {
+		return 0, ErrConvertCurrency
+	}
+
+	converted := new(big.Rat).SetInt64(amount)
+	converted.Mul(converted, exactRate)
+	converted.Mul(converted, new(big.Rat).SetInt64(to.Factor()))
+	converted.Quo(converted, new(big.Rat).SetInt64(from.Factor()))
+	rounded := round(converted, mode)
+	if !rounded.IsInt64() {
+		return 0, ErrBalanceOverflow
+	}
+	return rounded.Int64(), nil
+}
+
+func round(value *big.Rat, mode RoundingMode) *big.Int {
+	//quotient is truncated towards zero
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient
+	}
+
+	awayFromZero := false
+	switch mode {
+	case RoundFloor:
+		awayFromZero = value.Sign() < 0
+	case RoundHalfUp, RoundHalfEven:
+		//compare fractional part with one half
+		twice := new(big.Int).Abs(remainder)
+		twice.Lsh(twice, 1)
+		switch twice.Cmp(value.Denom()) {
+		case 1:
+			awayFromZero = true
+		case 0:
+			awayFromZero = mode == RoundHalfUp || quotient.Bit(0) == 1
+		}
+	}
+
+	if awayFromZero {
+		quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+	}
+	return quotient
+}
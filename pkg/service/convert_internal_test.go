@@ -0,0 +1,60 @@
+package service
+
+import (
+	"balance/pkg/currency"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertAmount(t *testing.T) {
+	rub, _ := currency.Get("RUB")
+	usd, _ := currency.Get("USD")
+	jpy, _ := currency.Get("JPY")
+	kwd, _ := currency.Get("KWD")
+
+	var tests = []struct {
+		name           string
+		amount         int64
+		from           currency.Currency
+		to             currency.Currency
+		rate           float64
+		mode           RoundingMode
+		expectedAmount int64
+		expectedErr    error
+	}{
+		{name: "exact", amount: 10000, rate: 0.0135, mode: RoundHalfEven, expectedAmount: 135},
+		{name: "decimal rate is not binary fraction", amount: 1000, rate: 0.0135, mode: RoundFloor, expectedAmount: 13},
+		{name: "half even rounds down to even", amount: 50, rate: 0.25, mode: RoundHalfEven, expectedAmount: 12},
+		{name: "half even rounds up to even", amount: 70, rate: 0.25, mode: RoundHalfEven, expectedAmount: 18},
+		{name: "half up", amount: 50, rate: 0.25, mode: RoundHalfUp, expectedAmount: 13},
+		{name: "half up below half", amount: 49, rate: 0.25, mode: RoundHalfUp, expectedAmount: 12},
+		{name: "half even above half", amount: 51, rate: 0.25, mode: RoundHalfEven, expectedAmount: 13},
+		{name: "floor", amount: 99, rate: 0.5, mode: RoundFloor, expectedAmount: 49},
+		{name: "negative half up", amount: -50, rate: 0.25, mode: RoundHalfUp, expectedAmount: -13},
+		{name: "negative floor", amount: -99, rate: 0.5, mode: RoundFloor, expectedAmount: -50},
+		{name: "large amount keeps precision", amount: math.MaxInt64 - 1, rate: 0.5, mode: RoundFloor, expectedAmount: math.MaxInt64 / 2},
+		{name: "amount not representable as float", amount: 9007199254740993, rate: 1, mode: RoundHalfEven, expectedAmount: 9007199254740993},
+		{name: "overflow", amount: math.MaxInt64 / 2, rate: 2.5, mode: RoundHalfEven, expectedErr: ErrBalanceOverflow},
+		{name: "max value is not overflow", amount: math.MaxInt64, rate: 1, mode: RoundHalfEven, expectedAmount: math.MaxInt64},
+		{name: "zero rate", amount: 100, rate: 0, mode: RoundHalfEven, expectedErr: ErrConvertCurrency},
+		{name: "not a number", amount: 100, rate: math.NaN(), mode: RoundHalfEven, expectedErr: ErrConvertCurrency},
+
+		{name: "to currency without minor units", amount: 12345, from: rub, to: jpy, rate: 1.5, mode: RoundHalfEven, expectedAmount: 185},
+		{name: "to currency with three decimals", amount: 12345, from: rub, to: kwd, rate: 0.0035, mode: RoundHalfEven, expectedAmount: 432},
+		{name: "from currency without minor units", amount: 3, from: jpy, to: rub, rate: 0.66, mode: RoundHalfEven, expectedAmount: 198},
+		{name: "overflow after scaling", amount: math.MaxInt64 / 10, from: jpy, to: kwd, rate: 1, mode: RoundHalfEven, expectedErr: ErrBalanceOverflow},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.from.Code == "" {
+				test.from, test.to = rub, usd
+			}
+			amount, err := convertAmount(test.amount, test.from, test.to, test.rate, test.mode)
+			assert.Equal(t, test.expectedErr, err)
+			assert.Equal(t, test.expectedAmount, amount)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//historyCursor is position of the last transfer on page, it is given to client
+//as opaque string, so its content can change without breaking clients.
+//Position makes sense only for the order it was taken in, so order is kept too
+type historyCursor struct {
+	OrderBy       repository.HistoryOrder `json:"o"`
+	Ascending     bool                    `json:"a,omitempty"`
+	TransferredAt time.Time               `json:"t"`
+	Amount        int64                   `json:"m"`
+	ID            int64                   `json:"id"`
+}
+
+func encodeCursor(page repository.HistoryPage, position repository.HistoryPosition) string {
+	data, _ := json.Marshal(historyCursor{page.OrderBy, page.Ascending, position.TransferredAt, position.Amount, position.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//decodeCursor returns nil position for empty cursor, that is the first page
+func decodeCursor(page repository.HistoryPage, cursor string) (*repository.HistoryPosition, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, wrap(ErrInvalidCursor, err)
+	}
+	var decoded historyCursor
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.TransferredAt.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	if decoded.OrderBy != page.OrderBy || decoded.Ascending != page.Ascending {
+		return nil, ErrInvalidCursor
+	}
+	return &repository.HistoryPosition{TransferredAt: decoded.TransferredAt, Amount: decoded.Amount, ID: decoded.ID}, nil
+}
+
+//scheduleCursor is position of the last schedule on page, opaque for client like historyCursor
+type scheduleCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeScheduleCursor(position repository.SchedulePosition) string {
+	data, _ := json.Marshal(scheduleCursor{position.CreatedAt, position.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//decodeScheduleCursor returns nil position for empty cursor, that is the first page
+func decodeScheduleCursor(cursor string) (*repository.SchedulePosition, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, wrap(ErrInvalidCursor, err)
+	}
+	var decoded scheduleCursor
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.CreatedAt.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(decoded.ID); err != nil {
+		return nil, wrap(ErrInvalidCursor, err)
+	}
+	return &repository.SchedulePosition{CreatedAt: decoded.CreatedAt, ID: decoded.ID}, nil
+}
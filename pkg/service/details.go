@@ -0,0 +1,60 @@
+package service
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+//limits keep history rows small, lengths are in characters
+const (
+	maxPurposeLength       = 256
+	maxOrderIDLength       = 64
+	maxMetadataKeys        = 16
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 256
+)
+
+//OperationDetails are given by caller and stored with history entries of operation
+type OperationDetails struct {
+	//default purpose is used if empty
+	Purpose string
+	//id of order in caller's service, stored as external reference
+	OrderID  string
+	Metadata map[string]string
+}
+
+//Validate must be called before passing details to ChangeBalance or Transfer
+func (details OperationDetails) Validate() error {
+	if utf8.RuneCountInString(details.Purpose) > maxPurposeLength {
+		return fmt.Errorf("%w: purpose is longer than %d characters", ErrInvalidDetails, maxPurposeLength)
+	}
+	if utf8.RuneCountInString(details.OrderID) > maxOrderIDLength {
+		return fmt.Errorf("%w: order id is longer than %d characters", ErrInvalidDetails, maxOrderIDLength)
+	}
+	if len(details.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("%w: metadata has more than %d keys", ErrInvalidDetails, maxMetadataKeys)
+	}
+	for key, value := range details.Metadata {
+		if key == "" || utf8.RuneCountInString(key) > maxMetadataKeyLength {
+			return fmt.Errorf("%w: metadata key must have 1 to %d characters", ErrInvalidDetails, maxMetadataKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return fmt.Errorf("%w: metadata value of %q is longer than %d characters", ErrInvalidDetails, key, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+func (details OperationDetails) purpose(defaultPurpose string) string {
+	if details.Purpose == "" {
+		return defaultPurpose
+	}
+	return details.Purpose
+}
+
+func (details OperationDetails) externalRef() *string {
+	if details.OrderID == "" {
+		return nil
+	}
+	return &details.OrderID
+}
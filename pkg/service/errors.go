@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+)
+
+var (
+	ErrAccessDatabase             = errors.New("error while accessing database")
+	ErrUserNotFound               = errors.New("user with such id doesn't exist")
+	ErrWalletNotFound             = errors.New("user has no wallet in such currency")
+	ErrNegativeBalance            = errors.New("negative balance value")
+	ErrNotEnoughMoney             = errors.New("trying to withdraw more money than account has")
+	ErrCreatingWithNegativeAmount = errors.New("trying to withdraw money from non-existing account")
+	ErrBalanceOverflow            = errors.New("balance overflow")
+	ErrConvertCurrency            = errors.New("error converting to currency")
+	ErrOperationCanceled          = errors.New("operation was canceled")
+	ErrOperationTimeout           = errors.New("operation timed out")
+	ErrInvalidCursor              = errors.New("invalid page cursor")
+	ErrInvalidFilter              = errors.New("invalid history filter")
+	ErrInvalidDetails             = errors.New("invalid operation details")
+	ErrOperationNotFound          = errors.New("operation with such id doesn't exist")
+	ErrInvalidIdempotencyKey      = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyReused       = errors.New("idempotency key was used for another request")
+	ErrInvalidReservation         = errors.New("invalid reservation")
+	ErrReservationNotFound        = errors.New("reservation with such id doesn't exist")
+	ErrReservationFinished        = errors.New("reservation is already captured or released")
+	ErrReservationExpired         = errors.New("reservation has expired")
+	ErrOperationNotReversible     = errors.New("operation can't be reversed")
+	ErrReversalExceedsOperation   = errors.New("refunds exceed amount of operation")
+	ErrInvalidBatch               = errors.New("invalid batch")
+	ErrInvalidSchedule            = errors.New("invalid schedule")
+	ErrScheduleNotFound           = errors.New("schedule with such id doesn't exist")
+	ErrScheduleFinished           = errors.New("schedule is already completed or canceled")
+)
+
+//Error is one of errors above caused by error which is not shown to caller, like database error.
+//errors.Is matches both of them, so caller checks kind of error and cause is kept for logging
+type Error struct {
+	Kind  error
+	Cause error
+}
+
+func wrap(kind error, cause error) error {
+	return &Error{Kind: kind, Cause: cause}
+}
+
+func (err *Error) Error() string {
+	return err.Kind.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Cause
+}
+
+func (err *Error) Is(target error) bool {
+	return err.Kind == target
+}
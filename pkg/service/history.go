@@ -0,0 +1,116 @@
+package service
+
+import (
+	"balance/pkg/currency"
+	"balance/pkg/repository"
+	"fmt"
+	"time"
+)
+
+type Direction string
+
+const (
+	DirectionCredit Direction = "credit"
+	DirectionDebit  Direction = "debit"
+)
+
+type OperationType string
+
+const (
+	OperationDeposit     OperationType = repository.OpDeposit
+	OperationWithdrawal  OperationType = repository.OpWithdrawal
+	OperationTransferIn  OperationType = repository.OpTransferIn
+	OperationTransferOut OperationType = repository.OpTransferOut
+	//manual correction, service itself doesn't make them
+	OperationAdjustment OperationType = repository.OpAdjustment
+	//refund of earlier operation, its entries reference that operation
+	OperationReversal OperationType = repository.OpReversal
+)
+
+type HistorySort string
+
+const (
+	SortByDate   HistorySort = "date"
+	SortByAmount HistorySort = "amount"
+)
+
+//HistoryFilter selects and orders transfers of history, zero value selects every transfer from newest to oldest
+type HistoryFilter struct {
+	//inclusive
+	From time.Time
+	//exclusive
+	To time.Time
+	//both directions if empty
+	Direction Direction
+	//bounds of absolute amount in minor units, inclusive
+	MinAmount *int64
+	MaxAmount *int64
+	//every type if empty
+	OpType OperationType
+	//every currency if empty, otherwise known currency code
+	Currency string
+	//date if empty
+	SortBy HistorySort
+	//newest or largest transfers go first unless set
+	Ascending bool
+}
+
+//Validate must be called before passing filter to GetHistory
+func (filter HistoryFilter) Validate() error {
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidFilter)
+	}
+	switch filter.Direction {
+	case "", DirectionCredit, DirectionDebit:
+	default:
+		return fmt.Errorf("%w: unknown direction %q", ErrInvalidFilter, filter.Direction)
+	}
+	if filter.MinAmount != nil && *filter.MinAmount < 0 || filter.MaxAmount != nil && *filter.MaxAmount < 0 {
+		return fmt.Errorf("%w: amount bounds must not be negative", ErrInvalidFilter)
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MinAmount > *filter.MaxAmount {
+		return fmt.Errorf("%w: min amount is greater than max amount", ErrInvalidFilter)
+	}
+	switch filter.OpType {
+	case "", OperationDeposit, OperationWithdrawal, OperationTransferIn, OperationTransferOut, OperationAdjustment, OperationReversal:
+	default:
+		return fmt.Errorf("%w: unknown operation type %q", ErrInvalidFilter, filter.OpType)
+	}
+	if filter.Currency != "" {
+		if _, err := currency.Get(filter.Currency); err != nil {
+			return fmt.Errorf("%w: unknown currency %q", ErrInvalidFilter, filter.Currency)
+		}
+	}
+	switch filter.SortBy {
+	case "", SortByDate, SortByAmount:
+	default:
+		return fmt.Errorf("%w: unknown sort %q", ErrInvalidFilter, filter.SortBy)
+	}
+	return nil
+}
+
+func (filter HistoryFilter) repositoryFilter() repository.HistoryFilter {
+	sign := 0
+	switch filter.Direction {
+	case DirectionCredit:
+		sign = 1
+	case DirectionDebit:
+		sign = -1
+	}
+	return repository.HistoryFilter{
+		From:      filter.From,
+		To:        filter.To,
+		Sign:      sign,
+		MinAmount: filter.MinAmount,
+		MaxAmount: filter.MaxAmount,
+		OpType:    string(filter.OpType),
+		Currency:  filter.Currency,
+	}
+}
+
+func (filter HistoryFilter) order() repository.HistoryOrder {
+	if filter.SortBy == SortByAmount {
+		return repository.OrderByAmount
+	}
+	return repository.OrderByDate
+}
@@ -0,0 +1,278 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+//internalKeyPrefix starts keys of operations made by service itself, like scheduled transfers.
+//Callers can't use it, so they can't claim key of such operation before service does
+const internalKeyPrefix = "internal:"
+
+//ValidateIdempotencyKey checks key given by caller, empty key means request is not idempotent
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+	if strings.HasPrefix(key, internalKeyPrefix) {
+		return fmt.Errorf("%w: prefix %q is reserved", ErrInvalidIdempotencyKey, internalKeyPrefix)
+	}
+	for _, char := range key {
+		if char < ' ' || char > '~' {
+			return fmt.Errorf("%w: only printable ASCII characters are allowed", ErrInvalidIdempotencyKey)
+		}
+	}
+	return nil
+}
+
+//requests are fingerprinted, so the same key can't be used for another operation or parameters
+type changeRequest struct {
+	ID       int64            `json:"id"`
+	Amount   int64            `json:"amount"`
+	Currency string           `json:"currency"`
+	Details  OperationDetails `json:"details"`
+}
+
+type transferRequest struct {
+	SenderID    int64            `json:"sender"`
+	RecipientID int64            `json:"recipient"`
+	Amount      int64            `json:"amount"`
+	Currency    string           `json:"currency"`
+	Details     OperationDetails `json:"details"`
+}
+
+type reserveRequest struct {
+	ID       int64            `json:"id"`
+	Amount   int64            `json:"amount"`
+	Currency string           `json:"currency"`
+	TTL      time.Duration    `json:"ttl"`
+	Details  OperationDetails `json:"details"`
+}
+
+type reverseRequest struct {
+	OperationID string           `json:"operation id"`
+	Amount      int64            `json:"amount"`
+	Details     OperationDetails `json:"details"`
+}
+
+type batchRequest struct {
+	SenderID int64       `json:"sender"`
+	Currency string      `json:"currency"`
+	Items    []BatchItem `json:"items"`
+}
+
+type scheduleRequest struct {
+	SenderID    int64            `json:"sender"`
+	RecipientID int64            `json:"recipient"`
+	Amount      int64            `json:"amount"`
+	Currency    string           `json:"currency"`
+	StartAt     time.Time        `json:"start at"`
+	Recurrence  Recurrence       `json:"recurrence"`
+	Details     OperationDetails `json:"details"`
+}
+
+func fingerprint(request interface{}) (string, error) {
+	//operation is part of fingerprint, so change and transfer with equal fields differ
+	encoded, err := json.Marshal(struct {
+		Operation string      `json:"operation"`
+		Request   interface{} `json:"request"`
+	}{fmt.Sprintf("%T", request), request})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//replayableErrors are decided by operation before it writes anything, so transaction is committed
+//and they are stored under idempotency key like balance. Other errors roll back the key together
+//with operation and request can be retried
+var replayableErrors = []error{ErrNotEnoughMoney, ErrCreatingWithNegativeAmount, ErrBalanceOverflow, ErrUserNotFound,
+	ErrWalletNotFound, ErrOperationNotFound, ErrOperationNotReversible, ErrReversalExceedsOperation}
+
+//outcome of operation stored under idempotency key, one of results is set if operation succeeded
+type outcome struct {
+	Balance     *Balance     `json:"balance,omitempty"`
+	Reservation *Reservation `json:"reservation,omitempty"`
+	Operation   *Operation   `json:"operation,omitempty"`
+	Schedule    *Schedule    `json:"schedule,omitempty"`
+	//results of batch are stored even if it is rejected, so replay tells which items failed
+	Batch *BatchTransfer `json:"batch,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+func newOutcome(balance *Balance, err error) (outcome, error) {
+	if err == nil {
+		return outcome{Balance: balance}, nil
+	}
+	return failedOutcome(err)
+}
+
+func newReservationOutcome(reservation *Reservation, err error) (outcome, error) {
+	if err == nil {
+		return outcome{Reservation: reservation}, nil
+	}
+	return failedOutcome(err)
+}
+
+func newOperationOutcome(operation *Operation, err error) (outcome, error) {
+	if err == nil {
+		return outcome{Operation: operation}, nil
+	}
+	return failedOutcome(err)
+}
+
+func newScheduleOutcome(schedule *Schedule, err error) (outcome, error) {
+	if err == nil {
+		return outcome{Schedule: schedule}, nil
+	}
+	return failedOutcome(err)
+}
+
+func newBatchOutcome(batch *BatchTransfer, err error) (outcome, error) {
+	if err == nil {
+		return outcome{Batch: batch}, nil
+	}
+	result, failed := failedOutcome(err)
+	var batchErr *BatchError
+	if failed == nil && errors.As(err, &batchErr) {
+		result.Batch = &BatchTransfer{Results: batchErr.Results}
+	}
+	return result, failed
+}
+
+func failedOutcome(err error) (outcome, error) {
+	if replayable := replayableError(err); replayable != nil {
+		return outcome{Error: replayable.Error()}, nil
+	}
+	return outcome{}, err
+}
+
+//replayableError returns one of replayableErrors err is, nil if it is not replayable
+func replayableError(err error) error {
+	for _, replayable := range replayableErrors {
+		if errors.Is(err, replayable) {
+			return replayable
+		}
+	}
+	return nil
+}
+
+//err returns replayable error operation failed with
+func (outcome outcome) err() error {
+	if outcome.Error == "" {
+		return nil
+	}
+	for _, replayable := range replayableErrors {
+		if outcome.Error == replayable.Error() {
+			return replayable
+		}
+	}
+	return ErrAccessDatabase
+}
+
+func (outcome outcome) result() (*Balance, error) {
+	if err := outcome.err(); err != nil {
+		return nil, err
+	}
+	return outcome.Balance, nil
+}
+
+func (outcome outcome) reservation() (*Reservation, error) {
+	if err := outcome.err(); err != nil {
+		return nil, err
+	}
+	return outcome.Reservation, nil
+}
+
+func (outcome outcome) operation() (*Operation, error) {
+	if err := outcome.err(); err != nil {
+		return nil, err
+	}
+	return outcome.Operation, nil
+}
+
+func (outcome outcome) schedule() (*Schedule, error) {
+	if err := outcome.err(); err != nil {
+		return nil, err
+	}
+	return outcome.Schedule, nil
+}
+
+func (outcome outcome) batch() (*BatchTransfer, error) {
+	if err := outcome.err(); err != nil {
+		if outcome.Batch != nil {
+			return nil, &BatchError{Results: outcome.Batch.Results, Err: err}
+		}
+		return nil, err
+	}
+	return outcome.Batch, nil
+}
+
+//idempotent runs operation inside transaction unless outcome of request with the same key is already stored.
+//Key is claimed before operation starts, so concurrent requests with it wait for the first one and replay its outcome.
+//Returned error means transaction must be rolled back
+func (bs *BalanceService) idempotent(ctx context.Context, tx repository.Tx, key string, request interface{},
+	operation func() (outcome, error)) (outcome, error) {
+	if key == "" {
+		return operation()
+	}
+
+	requestFingerprint, err := fingerprint(request)
+	if err != nil {
+		return outcome{}, err
+	}
+	record := repository.IdempotencyRecord{Key: key, Fingerprint: requestFingerprint, CreatedAt: time.Now()}
+
+	stored, err := tx.ClaimIdempotencyKey(ctx, record)
+	if err != nil {
+		return outcome{}, dbError(ctx, err)
+	}
+	//expired key is reused as if it was never seen
+	if stored.Response != nil && record.CreatedAt.Sub(stored.CreatedAt) <= bs.cfg.IdempotencyKeyTTL {
+		if stored.Fingerprint != requestFingerprint {
+			return outcome{}, ErrIdempotencyKeyReused
+		}
+		var replayed outcome
+		if err := json.Unmarshal(stored.Response, &replayed); err != nil {
+			return outcome{}, wrap(ErrAccessDatabase, err)
+		}
+		return replayed, nil
+	}
+
+	result, err := operation()
+	if err != nil {
+		return outcome{}, err
+	}
+	record.Response, err = json.Marshal(result)
+	if err != nil {
+		return outcome{}, err
+	}
+	if err := tx.SaveIdempotencyKey(ctx, record); err != nil {
+		return outcome{}, dbError(ctx, err)
+	}
+	return result, nil
+}
+
+//PurgeIdempotencyKeys deletes keys which are not replayed anymore
+func (bs *BalanceService) PurgeIdempotencyKeys(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+		err := tx.DeleteIdempotencyKeys(ctx, time.Now().Add(-bs.cfg.IdempotencyKeyTTL))
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		return nil
+	})
+}
@@ -1,11 +1,12 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: pkg/service/model.go
+// Source: pkg/service/balance_service.go
 
 // Package mock_repository is a generated GoMock package.
 package mock_repository
 
 import (
 	repository "balance/pkg/repository"
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -34,35 +35,6 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
-// BeginTransaction mocks base method.
-func (m *MockRepository) BeginTransaction() (*repository.Transaction, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "BeginTransaction")
-	ret0, _ := ret[0].(*repository.Transaction)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// BeginTransaction indicates an expected call of BeginTransaction.
-func (mr *MockRepositoryMockRecorder) BeginTransaction() *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BeginTransaction", reflect.TypeOf((*MockRepository)(nil).BeginTransaction))
-}
-
-// ChangeUserBalance mocks base method.
-func (m *MockRepository) ChangeUserBalance(tx *repository.Transaction, id, amount int64) error {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ChangeUserBalance", tx, id, amount)
-	ret0, _ := ret[0].(error)
-	return ret0
-}
-
-// ChangeUserBalance indicates an expected call of ChangeUserBalance.
-func (mr *MockRepositoryMockRecorder) ChangeUserBalance(tx, id, amount interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeUserBalance", reflect.TypeOf((*MockRepository)(nil).ChangeUserBalance), tx, id, amount)
-}
-
 // Close mocks base method.
 func (m *MockRepository) Close() error {
 	m.ctrl.T.Helper()
@@ -77,64 +49,6 @@ func (mr *MockRepositoryMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockRepository)(nil).Close))
 }
 
-// Commit mocks base method.
-func (m *MockRepository) Commit(tx *repository.Transaction) error {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Commit", tx)
-	ret0, _ := ret[0].(error)
-	return ret0
-}
-
-// Commit indicates an expected call of Commit.
-func (mr *MockRepositoryMockRecorder) Commit(tx interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Commit", reflect.TypeOf((*MockRepository)(nil).Commit), tx)
-}
-
-// CreateUser mocks base method.
-func (m *MockRepository) CreateUser(tx *repository.Transaction, id int64) error {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateUser", tx, id)
-	ret0, _ := ret[0].(error)
-	return ret0
-}
-
-// CreateUser indicates an expected call of CreateUser.
-func (mr *MockRepositoryMockRecorder) CreateUser(tx, id interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockRepository)(nil).CreateUser), tx, id)
-}
-
-// GetUserBalance mocks base method.
-func (m *MockRepository) GetUserBalance(tx *repository.Transaction, id int64, forUpdate bool) (repository.Balance, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserBalance", tx, id, forUpdate)
-	ret0, _ := ret[0].(repository.Balance)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// GetUserBalance indicates an expected call of GetUserBalance.
-func (mr *MockRepositoryMockRecorder) GetUserBalance(tx, id, forUpdate interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockRepository)(nil).GetUserBalance), tx, id, forUpdate)
-}
-
-// GetUserHistory mocks base method.
-func (m *MockRepository) GetUserHistory(tx *repository.Transaction, id int64) ([]repository.Transfer, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserHistory", tx, id)
-	ret0, _ := ret[0].([]repository.Transfer)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// GetUserHistory indicates an expected call of GetUserHistory.
-func (mr *MockRepositoryMockRecorder) GetUserHistory(tx, id interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockRepository)(nil).GetUserHistory), tx, id)
-}
-
 // Open mocks base method.
 func (m *MockRepository) Open() error {
 	m.ctrl.T.Helper()
@@ -149,45 +63,16 @@ func (mr *MockRepositoryMockRecorder) Open() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Open", reflect.TypeOf((*MockRepository)(nil).Open))
 }
 
-// Rollback mocks base method.
-func (m *MockRepository) Rollback(tx *repository.Transaction) error {
+// WithTx mocks base method.
+func (m *MockRepository) WithTx(ctx context.Context, opts repository.TxOptions, fn func(repository.Tx) error) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Rollback", tx)
+	ret := m.ctrl.Call(m, "WithTx", ctx, opts, fn)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Rollback indicates an expected call of Rollback.
-func (mr *MockRepositoryMockRecorder) Rollback(tx interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rollback", reflect.TypeOf((*MockRepository)(nil).Rollback), tx)
-}
-
-// UpdateHistory mocks base method.
-func (m *MockRepository) UpdateHistory(tx *repository.Transaction, id, amount int64, purpose string) error {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateHistory", tx, id, amount, purpose)
-	ret0, _ := ret[0].(error)
-	return ret0
-}
-
-// UpdateHistory indicates an expected call of UpdateHistory.
-func (mr *MockRepositoryMockRecorder) UpdateHistory(tx, id, amount, purpose interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateHistory", reflect.TypeOf((*MockRepository)(nil).UpdateHistory), tx, id, amount, purpose)
-}
-
-// UserExists mocks base method.
-func (m *MockRepository) UserExists(tx *repository.Transaction, id int64) (bool, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UserExists", tx, id)
-	ret0, _ := ret[0].(bool)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// UserExists indicates an expected call of UserExists.
-func (mr *MockRepositoryMockRecorder) UserExists(tx, id interface{}) *gomock.Call {
+// WithTx indicates an expected call of WithTx.
+func (mr *MockRepositoryMockRecorder) WithTx(ctx, opts, fn interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserExists", reflect.TypeOf((*MockRepository)(nil).UserExists), tx, id)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithTx", reflect.TypeOf((*MockRepository)(nil).WithTx), ctx, opts, fn)
 }
@@ -0,0 +1,400 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: pkg/repository/tx.go
+
+// Package mock_repository is a generated GoMock package.
+package mock_repository
+
+import (
+	repository "balance/pkg/repository"
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockTx is a mock of Tx interface.
+type MockTx struct {
+	ctrl     *gomock.Controller
+	recorder *MockTxMockRecorder
+}
+
+// MockTxMockRecorder is the mock recorder for MockTx.
+type MockTxMockRecorder struct {
+	mock *MockTx
+}
+
+// NewMockTx creates a new mock instance.
+func NewMockTx(ctrl *gomock.Controller) *MockTx {
+	mock := &MockTx{ctrl: ctrl}
+	mock.recorder = &MockTxMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTx) EXPECT() *MockTxMockRecorder {
+	return m.recorder
+}
+
+// AddScheduleRun mocks base method.
+func (m *MockTx) AddScheduleRun(ctx context.Context, run repository.ScheduleRun) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddScheduleRun", ctx, run)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddScheduleRun indicates an expected call of AddScheduleRun.
+func (mr *MockTxMockRecorder) AddScheduleRun(ctx, run interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddScheduleRun", reflect.TypeOf((*MockTx)(nil).AddScheduleRun), ctx, run)
+}
+
+// ChangeUserBalance mocks base method.
+func (m *MockTx) ChangeUserBalance(ctx context.Context, id int64, currency string, amount int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChangeUserBalance", ctx, id, currency, amount)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ChangeUserBalance indicates an expected call of ChangeUserBalance.
+func (mr *MockTxMockRecorder) ChangeUserBalance(ctx, id, currency, amount interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeUserBalance", reflect.TypeOf((*MockTx)(nil).ChangeUserBalance), ctx, id, currency, amount)
+}
+
+// ChangeUserReserved mocks base method.
+func (m *MockTx) ChangeUserReserved(ctx context.Context, id int64, currency string, amount int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChangeUserReserved", ctx, id, currency, amount)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ChangeUserReserved indicates an expected call of ChangeUserReserved.
+func (mr *MockTxMockRecorder) ChangeUserReserved(ctx, id, currency, amount interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeUserReserved", reflect.TypeOf((*MockTx)(nil).ChangeUserReserved), ctx, id, currency, amount)
+}
+
+// ClaimIdempotencyKey mocks base method.
+func (m *MockTx) ClaimIdempotencyKey(ctx context.Context, record repository.IdempotencyRecord) (repository.IdempotencyRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimIdempotencyKey", ctx, record)
+	ret0, _ := ret[0].(repository.IdempotencyRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimIdempotencyKey indicates an expected call of ClaimIdempotencyKey.
+func (mr *MockTxMockRecorder) ClaimIdempotencyKey(ctx, record interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimIdempotencyKey", reflect.TypeOf((*MockTx)(nil).ClaimIdempotencyKey), ctx, record)
+}
+
+// CreateReservation mocks base method.
+func (m *MockTx) CreateReservation(ctx context.Context, reservation repository.Reservation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReservation", ctx, reservation)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateReservation indicates an expected call of CreateReservation.
+func (mr *MockTxMockRecorder) CreateReservation(ctx, reservation interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReservation", reflect.TypeOf((*MockTx)(nil).CreateReservation), ctx, reservation)
+}
+
+// CreateSchedule mocks base method.
+func (m *MockTx) CreateSchedule(ctx context.Context, schedule repository.Schedule) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSchedule", ctx, schedule)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSchedule indicates an expected call of CreateSchedule.
+func (mr *MockTxMockRecorder) CreateSchedule(ctx, schedule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSchedule", reflect.TypeOf((*MockTx)(nil).CreateSchedule), ctx, schedule)
+}
+
+// CreateUser mocks base method.
+func (m *MockTx) CreateUser(ctx context.Context, id int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockTxMockRecorder) CreateUser(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockTx)(nil).CreateUser), ctx, id)
+}
+
+// CreateWallet mocks base method.
+func (m *MockTx) CreateWallet(ctx context.Context, id int64, currency string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateWallet", ctx, id, currency)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateWallet indicates an expected call of CreateWallet.
+func (mr *MockTxMockRecorder) CreateWallet(ctx, id, currency interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateWallet", reflect.TypeOf((*MockTx)(nil).CreateWallet), ctx, id, currency)
+}
+
+// DeleteIdempotencyKeys mocks base method.
+func (m *MockTx) DeleteIdempotencyKeys(ctx context.Context, before time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIdempotencyKeys", ctx, before)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIdempotencyKeys indicates an expected call of DeleteIdempotencyKeys.
+func (mr *MockTxMockRecorder) DeleteIdempotencyKeys(ctx, before interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIdempotencyKeys", reflect.TypeOf((*MockTx)(nil).DeleteIdempotencyKeys), ctx, before)
+}
+
+// FinishReservation mocks base method.
+func (m *MockTx) FinishReservation(ctx context.Context, reservation repository.Reservation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishReservation", ctx, reservation)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishReservation indicates an expected call of FinishReservation.
+func (mr *MockTxMockRecorder) FinishReservation(ctx, reservation interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishReservation", reflect.TypeOf((*MockTx)(nil).FinishReservation), ctx, reservation)
+}
+
+// GetDueSchedules mocks base method.
+func (m *MockTx) GetDueSchedules(ctx context.Context, before time.Time, skip []string, limit int) ([]repository.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDueSchedules", ctx, before, skip, limit)
+	ret0, _ := ret[0].([]repository.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDueSchedules indicates an expected call of GetDueSchedules.
+func (mr *MockTxMockRecorder) GetDueSchedules(ctx, before, skip, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDueSchedules", reflect.TypeOf((*MockTx)(nil).GetDueSchedules), ctx, before, skip, limit)
+}
+
+// GetExpiredReservations mocks base method.
+func (m *MockTx) GetExpiredReservations(ctx context.Context, before time.Time, limit int) ([]repository.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredReservations", ctx, before, limit)
+	ret0, _ := ret[0].([]repository.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredReservations indicates an expected call of GetExpiredReservations.
+func (mr *MockTxMockRecorder) GetExpiredReservations(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredReservations", reflect.TypeOf((*MockTx)(nil).GetExpiredReservations), ctx, before, limit)
+}
+
+// GetOperation mocks base method.
+func (m *MockTx) GetOperation(ctx context.Context, operationID string) ([]repository.OperationEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOperation", ctx, operationID)
+	ret0, _ := ret[0].([]repository.OperationEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOperation indicates an expected call of GetOperation.
+func (mr *MockTxMockRecorder) GetOperation(ctx, operationID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOperation", reflect.TypeOf((*MockTx)(nil).GetOperation), ctx, operationID)
+}
+
+// GetReservation mocks base method.
+func (m *MockTx) GetReservation(ctx context.Context, id string, forUpdate bool) (repository.Reservation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReservation", ctx, id, forUpdate)
+	ret0, _ := ret[0].(repository.Reservation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReservation indicates an expected call of GetReservation.
+func (mr *MockTxMockRecorder) GetReservation(ctx, id, forUpdate interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReservation", reflect.TypeOf((*MockTx)(nil).GetReservation), ctx, id, forUpdate)
+}
+
+// GetReversals mocks base method.
+func (m *MockTx) GetReversals(ctx context.Context, operationID string) ([]repository.OperationEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReversals", ctx, operationID)
+	ret0, _ := ret[0].([]repository.OperationEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReversals indicates an expected call of GetReversals.
+func (mr *MockTxMockRecorder) GetReversals(ctx, operationID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReversals", reflect.TypeOf((*MockTx)(nil).GetReversals), ctx, operationID)
+}
+
+// GetSchedule mocks base method.
+func (m *MockTx) GetSchedule(ctx context.Context, id string, forUpdate bool) (repository.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSchedule", ctx, id, forUpdate)
+	ret0, _ := ret[0].(repository.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSchedule indicates an expected call of GetSchedule.
+func (mr *MockTxMockRecorder) GetSchedule(ctx, id, forUpdate interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSchedule", reflect.TypeOf((*MockTx)(nil).GetSchedule), ctx, id, forUpdate)
+}
+
+// GetScheduleRuns mocks base method.
+func (m *MockTx) GetScheduleRuns(ctx context.Context, scheduleID string, limit int) ([]repository.ScheduleRun, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetScheduleRuns", ctx, scheduleID, limit)
+	ret0, _ := ret[0].([]repository.ScheduleRun)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetScheduleRuns indicates an expected call of GetScheduleRuns.
+func (mr *MockTxMockRecorder) GetScheduleRuns(ctx, scheduleID, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScheduleRuns", reflect.TypeOf((*MockTx)(nil).GetScheduleRuns), ctx, scheduleID, limit)
+}
+
+// GetUserBalance mocks base method.
+func (m *MockTx) GetUserBalance(ctx context.Context, id int64, currency string, forUpdate bool) (repository.Balance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserBalance", ctx, id, currency, forUpdate)
+	ret0, _ := ret[0].(repository.Balance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserBalance indicates an expected call of GetUserBalance.
+func (mr *MockTxMockRecorder) GetUserBalance(ctx, id, currency, forUpdate interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockTx)(nil).GetUserBalance), ctx, id, currency, forUpdate)
+}
+
+// GetUserBalances mocks base method.
+func (m *MockTx) GetUserBalances(ctx context.Context, id int64) ([]repository.Balance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserBalances", ctx, id)
+	ret0, _ := ret[0].([]repository.Balance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserBalances indicates an expected call of GetUserBalances.
+func (mr *MockTxMockRecorder) GetUserBalances(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalances", reflect.TypeOf((*MockTx)(nil).GetUserBalances), ctx, id)
+}
+
+// GetUserHistory mocks base method.
+func (m *MockTx) GetUserHistory(ctx context.Context, id int64, filter repository.HistoryFilter, page repository.HistoryPage) ([]repository.Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserHistory", ctx, id, filter, page)
+	ret0, _ := ret[0].([]repository.Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserHistory indicates an expected call of GetUserHistory.
+func (mr *MockTxMockRecorder) GetUserHistory(ctx, id, filter, page interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockTx)(nil).GetUserHistory), ctx, id, filter, page)
+}
+
+// GetUserSchedules mocks base method.
+func (m *MockTx) GetUserSchedules(ctx context.Context, senderID int64, status string, page repository.SchedulePage) ([]repository.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSchedules", ctx, senderID, status, page)
+	ret0, _ := ret[0].([]repository.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSchedules indicates an expected call of GetUserSchedules.
+func (mr *MockTxMockRecorder) GetUserSchedules(ctx, senderID, status, page interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSchedules", reflect.TypeOf((*MockTx)(nil).GetUserSchedules), ctx, senderID, status, page)
+}
+
+// SaveIdempotencyKey mocks base method.
+func (m *MockTx) SaveIdempotencyKey(ctx context.Context, record repository.IdempotencyRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveIdempotencyKey", ctx, record)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveIdempotencyKey indicates an expected call of SaveIdempotencyKey.
+func (mr *MockTxMockRecorder) SaveIdempotencyKey(ctx, record interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveIdempotencyKey", reflect.TypeOf((*MockTx)(nil).SaveIdempotencyKey), ctx, record)
+}
+
+// UpdateHistory mocks base method.
+func (m *MockTx) UpdateHistory(ctx context.Context, id int64, transfer repository.Transfer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateHistory", ctx, id, transfer)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateHistory indicates an expected call of UpdateHistory.
+func (mr *MockTxMockRecorder) UpdateHistory(ctx, id, transfer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateHistory", reflect.TypeOf((*MockTx)(nil).UpdateHistory), ctx, id, transfer)
+}
+
+// UpdateSchedule mocks base method.
+func (m *MockTx) UpdateSchedule(ctx context.Context, schedule repository.Schedule) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSchedule", ctx, schedule)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSchedule indicates an expected call of UpdateSchedule.
+func (mr *MockTxMockRecorder) UpdateSchedule(ctx, schedule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSchedule", reflect.TypeOf((*MockTx)(nil).UpdateSchedule), ctx, schedule)
+}
+
+// UserExists mocks base method.
+func (m *MockTx) UserExists(ctx context.Context, id int64) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UserExists", ctx, id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UserExists indicates an expected call of UserExists.
+func (mr *MockTxMockRecorder) UserExists(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserExists", reflect.TypeOf((*MockTx)(nil).UserExists), ctx, id)
+}
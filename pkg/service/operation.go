@@ -0,0 +1,29 @@
+package service
+
+import "balance/pkg/repository"
+
+//Operation is balance change or transfer between users with every history entry it made:
+//one for balance change, sender's and recipient's ones for transfer
+type Operation struct {
+	ID      string            `json:"id"`
+	Entries []*OperationEntry `json:"entries"`
+}
+
+//OperationEntry is history entry of operation together with user whose history it is in
+type OperationEntry struct {
+	UserID int64 `json:"user id"`
+	*Transfer
+}
+
+//entries must be ordered as repository returns them, sender's entry goes first
+func newOperation(id string, entries []repository.OperationEntry) (*Operation, error) {
+	operation := &Operation{ID: id, Entries: make([]*OperationEntry, 0, len(entries))}
+	for _, entry := range entries {
+		transfer, err := newTransfer(entry.Transfer)
+		if err != nil {
+			return nil, err
+		}
+		operation.Entries = append(operation.Entries, &OperationEntry{UserID: entry.UserID, Transfer: transfer})
+	}
+	return operation, nil
+}
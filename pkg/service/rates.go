@@ -0,0 +1,102 @@
+package service
+
+import (
+	"balance/pkg/config"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//ExchangeRateProvider gives rate for converting amount from one currency to another
+type ExchangeRateProvider interface {
+	Rate(ctx context.Context, from string, to string) (float64, error)
+}
+
+//ExchangeRate is rate balance was converted with, age tells how long ago it was received from provider
+type ExchangeRate struct {
+	Rate float64 `json:"rate"`
+	Age  int64   `json:"age"` //seconds
+}
+
+type cachedRate struct {
+	rate       float64
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+//rateCache keeps last known rate for every currency pair. Rate younger than TTL is returned as is,
+//older one is returned too while being refreshed in background, so unreachable provider doesn't
+//break conversion until rate becomes older than max staleness
+type rateCache struct {
+	provider     ExchangeRateProvider
+	ttl          time.Duration
+	maxStaleness time.Duration
+	//background refresh is not bound to any request, so it has its own timeout
+	refreshTimeout time.Duration
+	now            func() time.Time
+
+	mu    sync.Mutex
+	rates map[string]*cachedRate
+}
+
+func newRateCache(provider ExchangeRateProvider, cfg config.Service) *rateCache {
+	return &rateCache{
+		provider:       provider,
+		ttl:            cfg.RateCacheTTL,
+		maxStaleness:   cfg.RateMaxStaleness,
+		refreshTimeout: cfg.BalanceTimeout,
+		now:            time.Now,
+		rates:          make(map[string]*cachedRate),
+	}
+}
+
+func (cache *rateCache) Rate(ctx context.Context, from string, to string) (ExchangeRate, error) {
+	key := fmt.Sprintf("%s_%s", from, to)
+
+	cache.mu.Lock()
+	cached, ok := cache.rates[key]
+	if ok {
+		age := cache.now().Sub(cached.fetchedAt)
+		if age <= cache.maxStaleness {
+			if age > cache.ttl && !cached.refreshing {
+				cached.refreshing = true
+				go cache.refresh(key, from, to)
+			}
+			rate := ExchangeRate{Rate: cached.rate, Age: int64(age / time.Second)}
+			cache.mu.Unlock()
+			return rate, nil
+		}
+	}
+	cache.mu.Unlock()
+
+	//no rate or it is too old to be used, caller has to wait for provider
+	rate, err := cache.provider.Rate(ctx, from, to)
+	if err != nil {
+		return ExchangeRate{}, err
+	}
+	cache.store(key, rate)
+	return ExchangeRate{Rate: rate}, nil
+}
+
+func (cache *rateCache) refresh(key string, from string, to string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cache.refreshTimeout)
+	defer cancel()
+
+	rate, err := cache.provider.Rate(ctx, from, to)
+	if err != nil {
+		log.Printf("refreshing exchange rate %s: %v", key, err)
+		cache.mu.Lock()
+		cache.rates[key].refreshing = false
+		cache.mu.Unlock()
+		return
+	}
+	cache.store(key, rate)
+}
+
+func (cache *rateCache) store(key string, rate float64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.rates[key] = &cachedRate{rate: rate, fetchedAt: cache.now()}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"balance/pkg/config"
+	"balance/pkg/exchange"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testClock is moved explicitly, it is read by background refreshes too
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestRateCache_Rate(t *testing.T) {
+	provider := exchange.NewFake()
+	provider.Set("RUB", "USD", 0.0135)
+	clock := &testClock{now: time.Now()}
+
+	cfg := config.Default().Service
+	cfg.RateCacheTTL = time.Minute
+	cfg.RateMaxStaleness = time.Hour
+	cache := newRateCache(provider, cfg)
+	cache.now = clock.Now
+	ctx := context.Background()
+
+	rate, err := cache.Rate(ctx, "RUB", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, ExchangeRate{Rate: 0.0135, Age: 0}, rate)
+
+	clock.Advance(30 * time.Second)
+	rate, err = cache.Rate(ctx, "RUB", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, ExchangeRate{Rate: 0.0135, Age: 30}, rate, "fresh rate is served from cache")
+	assert.Equal(t, 1, provider.Calls())
+
+	//stale rate is served at once and refreshed in background
+	provider.Set("RUB", "USD", 0.014)
+	clock.Advance(time.Minute)
+	rate, err = cache.Rate(ctx, "RUB", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, ExchangeRate{Rate: 0.0135, Age: 90}, rate)
+	assert.Eventually(t, func() bool {
+		rate, _ := cache.Rate(ctx, "RUB", "USD")
+		return rate.Rate == 0.014
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, provider.Calls())
+
+	//last known rate is served while provider is unreachable
+	provider.Fail("RUB", "USD", exchange.ErrRateUnavailable)
+	clock.Advance(50 * time.Minute)
+	rate, err = cache.Rate(ctx, "RUB", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, ExchangeRate{Rate: 0.014, Age: 3000}, rate)
+	assert.Eventually(t, func() bool { return provider.Calls() == 3 }, time.Second, time.Millisecond)
+
+	clock.Advance(time.Hour)
+	_, err = cache.Rate(ctx, "RUB", "USD")
+	assert.ErrorIs(t, err, exchange.ErrRateUnavailable, "rate older than max staleness is not used")
+
+	_, err = cache.Rate(ctx, "RUB", "VND")
+	assert.ErrorIs(t, err, exchange.ErrUnknownPair)
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ReservationStatus string
+
+const (
+	ReservationActive   ReservationStatus = repository.ReservationActive
+	ReservationCaptured ReservationStatus = repository.ReservationCaptured
+	ReservationReleased ReservationStatus = repository.ReservationReleased
+	ReservationExpired  ReservationStatus = repository.ReservationExpired
+)
+
+//expired reservations are released in batches, each one in its own transaction
+const expiryBatchSize = 100
+
+//Reservation is money held on user's balance until it is captured, released or expires.
+//Held money stays in balance, but can't be withdrawn, transferred or reserved again
+type Reservation struct {
+	ID     string `json:"id"`
+	UserID int64  `json:"user id"`
+	//reserved amount in currency of wallet
+	PrimaryValue   int64             `json:"primary value"`
+	SecondaryValue int64             `json:"secondary value"`
+	Currency       string            `json:"currency"`
+	Status         ReservationStatus `json:"status"`
+	CreatedAt      time.Time         `json:"created at"`
+	ExpiresAt      time.Time         `json:"expires at"`
+	//set when reservation stops being active
+	FinishedAt *time.Time `json:"finished at,omitempty"`
+	//set only for captured reservation: charged part and operation of its history entry
+	Captured    *Amount           `json:"captured,omitempty"`
+	OperationID string            `json:"operation id,omitempty"`
+	Purpose     string            `json:"purpose"`
+	ExternalRef *string           `json:"external ref,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func newReservation(reservation repository.Reservation) (*Reservation, error) {
+	amount, err := newAmount(reservation.Amount, reservation.Currency)
+	if err != nil {
+		return nil, err
+	}
+	result := &Reservation{
+		ID:             reservation.ID,
+		UserID:         reservation.UserID,
+		PrimaryValue:   amount.PrimaryValue,
+		SecondaryValue: amount.SecondaryValue,
+		Currency:       reservation.Currency,
+		Status:         ReservationStatus(reservation.Status),
+		CreatedAt:      reservation.CreatedAt,
+		ExpiresAt:      reservation.ExpiresAt,
+		FinishedAt:     reservation.FinishedAt,
+		Purpose:        reservation.Purpose,
+		ExternalRef:    reservation.ExternalRef,
+		Metadata:       reservation.Metadata,
+	}
+	if result.Status == ReservationCaptured {
+		if result.Captured, err = newAmount(reservation.Captured, reservation.Currency); err != nil {
+			return nil, err
+		}
+		if reservation.OperationID != nil {
+			result.OperationID = *reservation.OperationID
+		}
+	}
+	return result, nil
+}
+
+//params must be validated:
+//id must be >= 0, currency must be known currency code, details and idempotency key must pass validation.
+//Amount must be positive in minor units of currency, zero ttl means service.reservation_ttl.
+//Repeated request with the same idempotency key gets outcome of the first one
+func (bs *BalanceService) Reserve(ctx context.Context, id int64, amount int64, currency string, ttl time.Duration, details OperationDetails,
+	idempotencyKey string) (*Reservation, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidReservation)
+	}
+	if ttl == 0 {
+		ttl = bs.cfg.ReservationTTL
+	}
+	if ttl < 0 || ttl > bs.cfg.ReservationMaxTTL {
+		return nil, fmt.Errorf("%w: ttl must be positive and not longer than %s", ErrInvalidReservation, bs.cfg.ReservationMaxTTL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	request := reserveRequest{ID: id, Amount: amount, Currency: currency, TTL: ttl, Details: details}
+	var result outcome
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newReservationOutcome(bs.reserve(ctx, tx, id, amount, currency, ttl, details))
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.reservation()
+}
+
+func (bs *BalanceService) reserve(ctx context.Context, tx repository.Tx, id int64, amount int64, currency string, ttl time.Duration,
+	details OperationDetails) (*Reservation, error) {
+	//money is reserved only in existing wallet, it can't be created by reservation
+	balance, _, err := bs.walletBalance(ctx, tx, id, currency, true)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Amount-balance.Reserved < amount {
+		return nil, ErrNotEnoughMoney
+	}
+
+	//database keeps microseconds, so reservation is returned as it will be read later
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	reservation := repository.Reservation{
+		ID:          uuid.NewString(),
+		UserID:      id,
+		Amount:      amount,
+		Currency:    currency,
+		Status:      repository.ReservationActive,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		Purpose:     details.purpose("Reservation"),
+		ExternalRef: details.externalRef(),
+		Metadata:    details.Metadata,
+	}
+	if err := tx.ChangeUserReserved(ctx, id, currency, amount); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if err := tx.CreateReservation(ctx, reservation); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return newReservation(reservation)
+}
+
+//params must be validated:
+//reservationID must be UUID in canonical form, details must pass validation.
+//Zero amount captures the whole reservation, part of it which is not captured is returned to user.
+//Captured money is withdrawn, history entry gets details of reservation unless they are given
+func (bs *BalanceService) CaptureReservation(ctx context.Context, userID int64, reservationID string, amount int64, details OperationDetails) (*Reservation, error) {
+	if amount < 0 {
+		return nil, fmt.Errorf("%w: capture amount must not be negative", ErrInvalidReservation)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	return bs.finishActive(ctx, userID, reservationID, func(tx repository.Tx, reservation repository.Reservation) (repository.Reservation, error) {
+		captured := amount
+		if captured == 0 {
+			captured = reservation.Amount
+		}
+		if captured > reservation.Amount {
+			return repository.Reservation{}, fmt.Errorf("%w: capture amount exceeds reserved amount", ErrInvalidReservation)
+		}
+
+		operationID := uuid.NewString()
+		reservation, err := bs.finishReservation(ctx, tx, reservation, repository.ReservationCaptured, captured, &operationID)
+		if err != nil {
+			return repository.Reservation{}, err
+		}
+		if err := tx.ChangeUserBalance(ctx, reservation.UserID, reservation.Currency, -captured); err != nil {
+			return repository.Reservation{}, dbError(ctx, err)
+		}
+
+		transfer := repository.Transfer{
+			OperationID: operationID,
+			Amount:      -captured,
+			Currency:    reservation.Currency,
+			Purpose:     details.purpose(reservation.Purpose),
+			OpType:      repository.OpWithdrawal,
+			ExternalRef: reservation.ExternalRef,
+			Metadata:    reservation.Metadata,
+		}
+		if ref := details.externalRef(); ref != nil {
+			transfer.ExternalRef = ref
+		}
+		if len(details.Metadata) != 0 {
+			transfer.Metadata = details.Metadata
+		}
+		if err := tx.UpdateHistory(ctx, reservation.UserID, transfer); err != nil {
+			return repository.Reservation{}, dbError(ctx, err)
+		}
+		return reservation, nil
+	})
+}
+
+//params must be validated:
+//reservationID must be UUID in canonical form.
+//The whole reserved amount is returned to user
+func (bs *BalanceService) ReleaseReservation(ctx context.Context, userID int64, reservationID string) (*Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	return bs.finishActive(ctx, userID, reservationID, func(tx repository.Tx, reservation repository.Reservation) (repository.Reservation, error) {
+		return bs.finishReservation(ctx, tx, reservation, repository.ReservationReleased, 0, nil)
+	})
+}
+
+//params must be validated:
+//reservationID must be UUID in canonical form
+func (bs *BalanceService) GetReservation(ctx context.Context, userID int64, reservationID string) (*Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.BalanceTimeout)
+	defer cancel()
+
+	var reservation repository.Reservation
+	err := bs.inTx(ctx, readOnly, func(tx repository.Tx) (err error) {
+		reservation, err = bs.userReservation(ctx, tx, userID, reservationID, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newReservation(reservation)
+}
+
+//ExpireReservations releases every active reservation which expired and returns number of them
+func (bs *BalanceService) ExpireReservations(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		expired, err := bs.expireReservations(ctx)
+		total += expired
+		if err != nil || expired < expiryBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (bs *BalanceService) expireReservations(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	var expired int
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+			//reservations locked by captures or other workers are skipped
+			reservations, err := tx.GetExpiredReservations(ctx, time.Now(), expiryBatchSize)
+			if err != nil {
+				return dbError(ctx, err)
+			}
+			//users are locked in id order, like transfers do
+			sort.Slice(reservations, func(i, j int) bool {
+				return reservations[i].UserID < reservations[j].UserID
+			})
+			for _, reservation := range reservations {
+				if _, err := bs.finishReservation(ctx, tx, reservation, repository.ReservationExpired, 0, nil); err != nil {
+					return err
+				}
+			}
+			expired = len(reservations)
+			return nil
+		})
+	})
+	return expired, err
+}
+
+//finishActive runs change of active reservation in transaction which is retried on conflicts.
+//Reservation found expired is released instead and ErrReservationExpired is returned after commit
+func (bs *BalanceService) finishActive(ctx context.Context, userID int64, reservationID string,
+	change func(tx repository.Tx, reservation repository.Reservation) (repository.Reservation, error)) (*Reservation, error) {
+	var finished repository.Reservation
+	var expired bool
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+			//reservation is locked before user, the same order as expiry uses
+			reservation, err := bs.userReservation(ctx, tx, userID, reservationID, true)
+			if err != nil {
+				return err
+			}
+			switch reservation.Status {
+			case repository.ReservationActive:
+			case repository.ReservationExpired:
+				return ErrReservationExpired
+			default:
+				return ErrReservationFinished
+			}
+
+			expired = !reservation.ExpiresAt.After(time.Now())
+			if expired {
+				finished, err = bs.finishReservation(ctx, tx, reservation, repository.ReservationExpired, 0, nil)
+				return err
+			}
+			finished, err = change(tx, reservation)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrReservationExpired
+	}
+	return newReservation(finished)
+}
+
+//userReservation reads reservation, reservation of another user is reported as unknown one
+func (bs *BalanceService) userReservation(ctx context.Context, tx repository.Tx, userID int64, reservationID string, forUpdate bool) (repository.Reservation, error) {
+	reservation, err := tx.GetReservation(ctx, reservationID, forUpdate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return repository.Reservation{}, wrap(ErrReservationNotFound, err)
+		}
+		return repository.Reservation{}, dbError(ctx, err)
+	}
+	if reservation.UserID != userID {
+		return repository.Reservation{}, ErrReservationNotFound
+	}
+	return reservation, nil
+}
+
+//finishReservation returns held money to user and saves final status of reservation
+func (bs *BalanceService) finishReservation(ctx context.Context, tx repository.Tx, reservation repository.Reservation,
+	status string, captured int64, operationID *string) (repository.Reservation, error) {
+	if err := tx.ChangeUserReserved(ctx, reservation.UserID, reservation.Currency, -reservation.Amount); err != nil {
+		return repository.Reservation{}, dbError(ctx, err)
+	}
+
+	finishedAt := time.Now().UTC().Truncate(time.Microsecond)
+	reservation.Status = status
+	reservation.FinishedAt = &finishedAt
+	reservation.Captured = captured
+	reservation.OperationID = operationID
+	if err := tx.FinishReservation(ctx, reservation); err != nil {
+		return repository.Reservation{}, dbError(ctx, err)
+	}
+	return reservation, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//errConflict is returned by dbError for transaction aborted because of concurrent ones,
+//it never reaches caller: transaction is retried or ErrAccessDatabase is returned
+var errConflict = errors.New("transaction conflicted with concurrent ones")
+
+//random source of its own, so replicas started at once do not retry in lockstep
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+//conflict reports if database aborted transaction to resolve deadlock or serialization failure,
+//running it again from the beginning may succeed
+func conflict(err error) bool {
+	switch repository.SQLState(err) {
+	case repository.CodeDeadlockDetected, repository.CodeSerializationFailure:
+		return true
+	}
+	return false
+}
+
+//retry runs transaction until it is not aborted by conflict with concurrent ones,
+//at most cfg.TxRetries more times. Attempt must open and finish its own transaction
+func (bs *BalanceService) retry(ctx context.Context, attempt func() error) error {
+	for retries := 0; ; retries++ {
+		err := attempt()
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+		if retries == bs.cfg.TxRetries {
+			log.Printf("transaction conflicted %d times, giving up", retries+1)
+			return wrap(ErrAccessDatabase, errors.Unwrap(err))
+		}
+
+		timer := time.NewTimer(bs.backoff(retries))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx)
+		}
+	}
+}
+
+//backoff is random delay before retry, its upper bound grows exponentially (full jitter)
+func (bs *BalanceService) backoff(retries int) time.Duration {
+	bound := bs.cfg.TxRetryBaseDelay
+	for i := 0; i < retries && bound < bs.cfg.TxRetryMaxDelay; i++ {
+		bound *= 2
+	}
+	if bound > bs.cfg.TxRetryMaxDelay {
+		bound = bs.cfg.TxRetryMaxDelay
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(bound)) + 1)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+//reversibleTypes are operations made by service for a caller, adjustments and reversals themselves can't be reversed
+var reversibleTypes = map[string]bool{
+	repository.OpDeposit:     true,
+	repository.OpWithdrawal:  true,
+	repository.OpTransferIn:  true,
+	repository.OpTransferOut: true,
+}
+
+//params must be validated:
+//operationID must be UUID in canonical form, amount must not be negative,
+//details and idempotency key must pass validation.
+//Zero amount refunds everything which is not refunded yet, refunds of operation never exceed its amount.
+//Every user of operation gets entry moving money back, so recipient of transfer must have enough
+//available money, otherwise reversal is rejected with ErrNotEnoughMoney
+func (bs *BalanceService) ReverseOperation(ctx context.Context, operationID string, amount int64, details OperationDetails, idempotencyKey string) (*Operation, error) {
+	//reversal moves money of up to two users like transfer does
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.TransferTimeout)
+	defer cancel()
+
+	request := reverseRequest{OperationID: operationID, Amount: amount, Details: details}
+	var result outcome
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newOperationOutcome(bs.reverse(ctx, tx, operationID, amount, details))
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.operation()
+}
+
+func (bs *BalanceService) reverse(ctx context.Context, tx repository.Tx, operationID string, amount int64, details OperationDetails) (*Operation, error) {
+	//history is never changed, so operation is read without locks
+	entries, err := tx.GetOperation(ctx, operationID)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if len(entries) == 0 {
+		return nil, ErrOperationNotFound
+	}
+	for _, entry := range entries {
+		if !reversibleTypes[entry.OpType] {
+			return nil, fmt.Errorf("%w: %s", ErrOperationNotReversible, entry.OpType)
+		}
+	}
+
+	//wallets are locked before refunds are summed up, so concurrent reversals of operation wait for each other.
+	//Rows are locked in id order like transfer does, every entry of operation is in the same currency
+	currency := entries[0].Currency
+	ids := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.UserID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	balances := make(map[int64]repository.Balance, len(ids))
+	for _, id := range ids {
+		if balances[id], err = bs.userBalance(ctx, tx, id, currency, true); err != nil {
+			return nil, err
+		}
+	}
+
+	//every entry of operation moves the same absolute amount, refunds are counted by entries of the first user
+	reversals, err := tx.GetReversals(ctx, operationID)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	remaining := abs(entries[0].Amount)
+	for _, reversal := range reversals {
+		if reversal.UserID == entries[0].UserID {
+			remaining -= abs(reversal.Amount)
+		}
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount == 0 || amount > remaining {
+		return nil, fmt.Errorf("%w: %d minor units of %s can be refunded", ErrReversalExceedsOperation, remaining, currency)
+	}
+
+	//every check is done before anything is written, so rejection can be replayed
+	for _, entry := range entries {
+		balance := balances[entry.UserID]
+		if entry.Amount > 0 && balance.Amount-balance.Reserved < amount {
+			return nil, ErrNotEnoughMoney
+		}
+		if entry.Amount < 0 && math.MaxInt64-amount < balance.Amount {
+			return nil, ErrBalanceOverflow
+		}
+	}
+
+	reversalID := uuid.NewString()
+	for _, entry := range entries {
+		refund := amount
+		if entry.Amount > 0 {
+			refund = -amount
+		}
+		if err := tx.ChangeUserBalance(ctx, entry.UserID, currency, refund); err != nil {
+			return nil, dbError(ctx, err)
+		}
+		err := tx.UpdateHistory(ctx, entry.UserID, repository.Transfer{
+			OperationID:  reversalID,
+			Amount:       refund,
+			Currency:     currency,
+			Purpose:      details.purpose(fmt.Sprintf("Reversal of %s", operationID)),
+			OpType:       repository.OpReversal,
+			Counterparty: entry.Counterparty,
+			ExternalRef:  details.externalRef(),
+			Metadata:     details.Metadata,
+			Reverses:     &operationID,
+		})
+		if err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+
+	reversal, err := tx.GetOperation(ctx, reversalID)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return newOperation(reversalID, reversal)
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,468 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Recurrence string
+
+//empty recurrence means one-time transfer
+const (
+	RecurrenceNone    Recurrence = ""
+	RecurrenceDaily   Recurrence = repository.RecurrenceDaily
+	RecurrenceWeekly  Recurrence = repository.RecurrenceWeekly
+	RecurrenceMonthly Recurrence = repository.RecurrenceMonthly
+)
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = repository.ScheduleActive
+	ScheduleCompleted ScheduleStatus = repository.ScheduleCompleted
+	ScheduleCanceled  ScheduleStatus = repository.ScheduleCanceled
+)
+
+type RunStatus string
+
+const (
+	RunSucceeded RunStatus = repository.RunSucceeded
+	RunFailed    RunStatus = repository.RunFailed
+)
+
+//maxScheduleRuns is number of latest runs returned with schedule
+const maxScheduleRuns = 50
+
+//startGrace lets start time given by caller be slightly in the past because of clock skew
+const startGrace = time.Minute
+
+//Schedule is transfer made by service at given time, once or repeatedly
+type Schedule struct {
+	ID          string `json:"id"`
+	SenderID    int64  `json:"sender"`
+	RecipientID int64  `json:"recipient"`
+	//transferred amount in currency of wallets
+	PrimaryValue   int64      `json:"primary value"`
+	SecondaryValue int64      `json:"secondary value"`
+	Currency       string     `json:"currency"`
+	Recurrence     Recurrence `json:"recurrence,omitempty"`
+	StartAt        time.Time  `json:"start at"`
+	//nil when schedule is not active anymore
+	NextRunAt *time.Time `json:"next run at,omitempty"`
+	//number of due times executed, failed ones included
+	RunCount    int               `json:"run count"`
+	Status      ScheduleStatus    `json:"status"`
+	CreatedAt   time.Time         `json:"created at"`
+	CanceledAt  *time.Time        `json:"canceled at,omitempty"`
+	Purpose     string            `json:"purpose,omitempty"`
+	ExternalRef *string           `json:"external ref,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	//set only by GetSchedule: latest runs, newest first
+	Runs []*ScheduleRun `json:"runs,omitempty"`
+}
+
+//ScheduleRun is outcome of one due time of schedule
+type ScheduleRun struct {
+	ScheduledAt time.Time `json:"scheduled at"`
+	ExecutedAt  time.Time `json:"executed at"`
+	Status      RunStatus `json:"status"`
+	//set for succeeded run
+	OperationID string `json:"operation id,omitempty"`
+	//set for failed run
+	Error string `json:"error,omitempty"`
+}
+
+func newSchedule(schedule repository.Schedule) (*Schedule, error) {
+	amount, err := newAmount(schedule.Amount, schedule.Currency)
+	if err != nil {
+		return nil, err
+	}
+	result := &Schedule{
+		ID:             schedule.ID,
+		SenderID:       schedule.SenderID,
+		RecipientID:    schedule.RecipientID,
+		PrimaryValue:   amount.PrimaryValue,
+		SecondaryValue: amount.SecondaryValue,
+		Currency:       schedule.Currency,
+		StartAt:        schedule.StartAt,
+		NextRunAt:      schedule.NextRunAt,
+		RunCount:       schedule.Runs,
+		Status:         ScheduleStatus(schedule.Status),
+		CreatedAt:      schedule.CreatedAt,
+		CanceledAt:     schedule.CanceledAt,
+		Purpose:        schedule.Purpose,
+		ExternalRef:    schedule.ExternalRef,
+		Metadata:       schedule.Metadata,
+	}
+	if schedule.Recurrence != nil {
+		result.Recurrence = Recurrence(*schedule.Recurrence)
+	}
+	return result, nil
+}
+
+func newScheduleRun(run repository.ScheduleRun) *ScheduleRun {
+	result := &ScheduleRun{ScheduledAt: run.ScheduledAt, ExecutedAt: run.ExecutedAt, Status: RunStatus(run.Status)}
+	if run.OperationID != nil {
+		result.OperationID = *run.OperationID
+	}
+	if run.Error != nil {
+		result.Error = *run.Error
+	}
+	return result
+}
+
+//params must be validated:
+//senderID and recipientID must be >= 0, currency must be known currency code, details and idempotency key must pass validation.
+//Amount must be positive in minor units of currency, money is moved between wallets in it, zero startAt means now. Recurring schedule runs on the same time of every day,
+//week or month counted from startAt in UTC, monthly one runs on the last day of shorter months.
+//Repeated request with the same idempotency key gets outcome of the first one
+func (bs *BalanceService) CreateSchedule(ctx context.Context, senderID int64, recipientID int64, amount int64, currency string,
+	startAt time.Time, recurrence Recurrence, details OperationDetails, idempotencyKey string) (*Schedule, error) {
+	switch {
+	case amount <= 0:
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidSchedule)
+	case senderID == recipientID:
+		return nil, fmt.Errorf("%w: sender and recipient must differ", ErrInvalidSchedule)
+	case recurrence != RecurrenceNone && recurrence != RecurrenceDaily && recurrence != RecurrenceWeekly && recurrence != RecurrenceMonthly:
+		return nil, fmt.Errorf("%w: recurrence must be one of %s, %s or %s", ErrInvalidSchedule, RecurrenceDaily, RecurrenceWeekly, RecurrenceMonthly)
+	case !startAt.IsZero() && startAt.Before(time.Now().Add(-startGrace)):
+		return nil, fmt.Errorf("%w: start must not be in the past", ErrInvalidSchedule)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	request := scheduleRequest{SenderID: senderID, RecipientID: recipientID, Amount: amount, Currency: currency, StartAt: startAt,
+		Recurrence: recurrence, Details: details}
+	var result outcome
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			result, err = bs.idempotent(ctx, tx, idempotencyKey, request, func() (outcome, error) {
+				return newScheduleOutcome(bs.createSchedule(ctx, tx, senderID, recipientID, amount, currency, startAt, recurrence, details))
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.schedule()
+}
+
+func (bs *BalanceService) createSchedule(ctx context.Context, tx repository.Tx, senderID int64, recipientID int64, amount int64,
+	currency string, startAt time.Time, recurrence Recurrence, details OperationDetails) (*Schedule, error) {
+	//balance is checked only when schedule runs, but both accounts must exist already
+	for _, id := range []int64{senderID, recipientID} {
+		exists, err := tx.UserExists(ctx, id)
+		if err != nil {
+			return nil, dbError(ctx, err)
+		}
+		if !exists {
+			return nil, ErrUserNotFound
+		}
+	}
+
+	//database keeps microseconds, so schedule is returned as it will be read later
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if startAt.IsZero() {
+		startAt = now
+	}
+	startAt = startAt.UTC().Truncate(time.Microsecond)
+	schedule := repository.Schedule{
+		ID:          uuid.NewString(),
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		Amount:      amount,
+		Currency:    currency,
+		StartAt:     startAt,
+		NextRunAt:   &startAt,
+		Status:      repository.ScheduleActive,
+		CreatedAt:   now,
+		Purpose:     details.Purpose,
+		ExternalRef: details.externalRef(),
+		Metadata:    details.Metadata,
+	}
+	if recurrence != RecurrenceNone {
+		value := string(recurrence)
+		schedule.Recurrence = &value
+	}
+	if err := tx.CreateSchedule(ctx, schedule); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return newSchedule(schedule)
+}
+
+//SchedulePage is part of sender's schedules from newest to oldest
+type SchedulePage struct {
+	Schedules []*Schedule `json:"schedules"`
+	//empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+//params must be validated:
+//status must be one of schedule statuses or empty for all of them, limit must be > 0.
+//Schedules created by sender are returned page by page from newest to oldest, runs are not included
+func (bs *BalanceService) GetSchedules(ctx context.Context, senderID int64, status ScheduleStatus, limit int, cursor string) (*SchedulePage, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.BalanceTimeout)
+	defer cancel()
+
+	after, err := decodeScheduleCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	//one more schedule tells if there is next page
+	dbPage := repository.SchedulePage{After: after, Limit: limit + 1}
+
+	var schedules []repository.Schedule
+	err = bs.inTx(ctx, readOnly, func(tx repository.Tx) (err error) {
+		schedules, err = tx.GetUserSchedules(ctx, senderID, string(status), dbPage)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &SchedulePage{Schedules: make([]*Schedule, 0, limit)}
+	if len(schedules) > limit {
+		schedules = schedules[:limit]
+		page.NextCursor = encodeScheduleCursor(schedules[limit-1].Position())
+	}
+	for _, schedule := range schedules {
+		converted, err := newSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		page.Schedules = append(page.Schedules, converted)
+	}
+	return page, nil
+}
+
+//params must be validated:
+//scheduleID must be UUID in canonical form.
+//Schedule is returned with its latest runs
+func (bs *BalanceService) GetSchedule(ctx context.Context, senderID int64, scheduleID string) (*Schedule, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.BalanceTimeout)
+	defer cancel()
+
+	var schedule repository.Schedule
+	var runs []repository.ScheduleRun
+	err := bs.inTx(ctx, readOnly, func(tx repository.Tx) (err error) {
+		schedule, err = bs.userSchedule(ctx, tx, senderID, scheduleID, false)
+		if err != nil {
+			return err
+		}
+		runs, err = tx.GetScheduleRuns(ctx, scheduleID, maxScheduleRuns)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := newSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		result.Runs = append(result.Runs, newScheduleRun(run))
+	}
+	return result, nil
+}
+
+//params must be validated:
+//scheduleID must be UUID in canonical form.
+//Canceled schedule is not executed anymore, run which is executing at the moment is finished first
+func (bs *BalanceService) CancelSchedule(ctx context.Context, senderID int64, scheduleID string) (*Schedule, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout)
+	defer cancel()
+
+	var schedule repository.Schedule
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) (err error) {
+			schedule, err = bs.userSchedule(ctx, tx, senderID, scheduleID, true)
+			if err != nil {
+				return err
+			}
+			if schedule.Status != repository.ScheduleActive {
+				return ErrScheduleFinished
+			}
+
+			canceledAt := time.Now().UTC().Truncate(time.Microsecond)
+			schedule.Status = repository.ScheduleCanceled
+			schedule.NextRunAt = nil
+			schedule.CanceledAt = &canceledAt
+			if err := tx.UpdateSchedule(ctx, schedule); err != nil {
+				return dbError(ctx, err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newSchedule(schedule)
+}
+
+//ExecuteDueSchedules runs every due time of active schedules which has come and returns number of runs.
+//Missed due times are executed one by one, so every one of them gets its own run. Schedule which can't be
+//executed is skipped until the next call, so it doesn't block others, and the first such error is returned
+func (bs *BalanceService) ExecuteDueSchedules(ctx context.Context) (int, error) {
+	total := 0
+	var skip []string
+	var failure error
+	for {
+		scheduleID, executed, err := bs.executeDueSchedule(ctx, skip)
+		if err != nil && (scheduleID == "" || ctx.Err() != nil) {
+			return total, err
+		}
+		if err != nil {
+			log.Printf("executing schedule %s: %v", scheduleID, err)
+			skip = append(skip, scheduleID)
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		if !executed {
+			return total, failure
+		}
+		total++
+	}
+}
+
+//executeDueSchedule runs the earliest due time of schedule not locked by other workers and not skipped,
+//id of schedule is returned along with error of its run. Transfer, run and next due time are stored in the
+//transaction which locks schedule, so the same due time is transferred once and only one connection is used
+func (bs *BalanceService) executeDueSchedule(ctx context.Context, skip []string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, bs.cfg.ChangeTimeout+bs.cfg.TransferTimeout)
+	defer cancel()
+
+	var scheduleID string
+	var executed bool
+	err := bs.retry(ctx, func() error {
+		return bs.inTx(ctx, repository.TxOptions{}, func(tx repository.Tx) error {
+			scheduleID, executed = "", false
+			schedules, err := tx.GetDueSchedules(ctx, time.Now(), skip, 1)
+			if err != nil {
+				return dbError(ctx, err)
+			}
+			if len(schedules) == 0 {
+				return nil
+			}
+			schedule := schedules[0]
+			scheduleID = schedule.ID
+
+			run, err := bs.runSchedule(ctx, tx, schedule)
+			if err != nil {
+				return err
+			}
+			if err := tx.AddScheduleRun(ctx, run); err != nil {
+				return dbError(ctx, err)
+			}
+			schedule.Runs++
+			if schedule.Recurrence == nil {
+				schedule.Status = repository.ScheduleCompleted
+				schedule.NextRunAt = nil
+			} else {
+				next := runAt(schedule.StartAt, *schedule.Recurrence, schedule.Runs)
+				schedule.NextRunAt = &next
+			}
+			if err := tx.UpdateSchedule(ctx, schedule); err != nil {
+				return dbError(ctx, err)
+			}
+			executed = true
+			return nil
+		})
+	})
+	return scheduleID, executed, err
+}
+
+//runSchedule makes transfer of due time in transaction of the run. Rejected transfer is failed run,
+//other errors leave due time to be executed again
+func (bs *BalanceService) runSchedule(ctx context.Context, tx repository.Tx, schedule repository.Schedule) (repository.ScheduleRun, error) {
+	details := OperationDetails{Purpose: schedule.Purpose, Metadata: schedule.Metadata}
+	if schedule.ExternalRef != nil {
+		details.OrderID = *schedule.ExternalRef
+	}
+	//outcome is stored with key of run like outcome of client's transfer
+	key := fmt.Sprintf("%sschedule %s run %d", internalKeyPrefix, schedule.ID, schedule.Runs)
+	request := transferRequest{SenderID: schedule.SenderID, RecipientID: schedule.RecipientID, Amount: schedule.Amount,
+		Currency: schedule.Currency, Details: details}
+	result, err := bs.idempotent(ctx, tx, key, request, func() (outcome, error) {
+		return newOutcome(bs.transfer(ctx, tx, schedule.SenderID, schedule.RecipientID, schedule.Amount, schedule.Currency, details))
+	})
+	var balance *Balance
+	if err == nil {
+		balance, err = result.result()
+	}
+
+	run := repository.ScheduleRun{
+		ScheduleID:  schedule.ID,
+		ScheduledAt: *schedule.NextRunAt,
+		ExecutedAt:  time.Now().UTC().Truncate(time.Microsecond),
+		Status:      repository.RunSucceeded,
+	}
+	if err != nil {
+		rejection := replayableError(err)
+		//key of run can't be taken by callers, but run must not get stuck if it is taken anyway
+		if rejection == nil && errors.Is(err, ErrIdempotencyKeyReused) {
+			rejection = ErrIdempotencyKeyReused
+		}
+		if rejection == nil {
+			return repository.ScheduleRun{}, err
+		}
+		message := rejection.Error()
+		run.Status = repository.RunFailed
+		run.Error = &message
+		return run, nil
+	}
+	run.OperationID = &balance.OperationID
+	return run, nil
+}
+
+//runAt returns due time of run with given number counted from zero
+func runAt(start time.Time, recurrence string, run int) time.Time {
+	switch recurrence {
+	case repository.RecurrenceDaily:
+		return start.AddDate(0, 0, run)
+	case repository.RecurrenceWeekly:
+		return start.AddDate(0, 0, 7*run)
+	case repository.RecurrenceMonthly:
+		//AddDate normalizes 31st of shorter month to the next one, so day is clamped instead
+		first := time.Date(start.Year(), start.Month()+time.Month(run), 1, start.Hour(), start.Minute(), start.Second(),
+			start.Nanosecond(), start.Location())
+		day := start.Day()
+		if last := first.AddDate(0, 1, -1).Day(); day > last {
+			day = last
+		}
+		return first.AddDate(0, 0, day-1)
+	}
+	return start
+}
+
+//userSchedule reads schedule, schedule of another sender is reported as unknown one
+func (bs *BalanceService) userSchedule(ctx context.Context, tx repository.Tx, senderID int64, scheduleID string, forUpdate bool) (repository.Schedule, error) {
+	schedule, err := tx.GetSchedule(ctx, scheduleID, forUpdate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return repository.Schedule{}, wrap(ErrScheduleNotFound, err)
+		}
+		return repository.Schedule{}, dbError(ctx, err)
+	}
+	if schedule.SenderID != senderID {
+		return repository.Schedule{}, ErrScheduleNotFound
+	}
+	return schedule, nil
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"balance/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunAt(t *testing.T) {
+	start := time.Date(2022, time.January, 31, 9, 30, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name       string
+		start      time.Time
+		recurrence string
+		run        int
+		expected   time.Time
+	}{
+		{name: "first run is start", start: start, recurrence: repository.RecurrenceMonthly, run: 0, expected: start},
+		{name: "daily", start: start, recurrence: repository.RecurrenceDaily, run: 1, expected: time.Date(2022, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{name: "weekly", start: start, recurrence: repository.RecurrenceWeekly, run: 2, expected: time.Date(2022, time.February, 14, 9, 30, 0, 0, time.UTC)},
+		{name: "monthly clamps to shorter month", start: start, recurrence: repository.RecurrenceMonthly, run: 1, expected: time.Date(2022, time.February, 28, 9, 30, 0, 0, time.UTC)},
+		{name: "monthly keeps day after shorter month", start: start, recurrence: repository.RecurrenceMonthly, run: 2, expected: time.Date(2022, time.March, 31, 9, 30, 0, 0, time.UTC)},
+		{name: "monthly in leap year", start: start.AddDate(2, 0, 0), recurrence: repository.RecurrenceMonthly, run: 1, expected: time.Date(2024, time.February, 29, 9, 30, 0, 0, time.UTC)},
+		{name: "monthly across year", start: start, recurrence: repository.RecurrenceMonthly, run: 12, expected: time.Date(2023, time.January, 31, 9, 30, 0, 0, time.UTC)},
+		{name: "one-time", start: start, recurrence: "", run: 1, expected: start},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, runAt(test.start, test.recurrence, test.run))
+		})
+	}
+}
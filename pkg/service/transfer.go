@@ -1,14 +1,54 @@
 package service
 
-import "time"
+import (
+	"balance/pkg/currency"
+	"balance/pkg/repository"
+	"time"
+)
 
 type Transfer struct {
-	PrimaryValue   int64     `json:"primary value"`
-	SecondaryValue int8      `json:"secondary value"`
-	TransferredAt  time.Time `json:"transferred at"`
-	Purpose        string    `json:"purpose"`
+	OperationID    string        `json:"operation id"`
+	PrimaryValue   int64         `json:"primary value"`
+	SecondaryValue int64         `json:"secondary value"`
+	Currency       string        `json:"currency"`
+	TransferredAt  time.Time     `json:"transferred at"`
+	Purpose        string        `json:"purpose"`
+	OpType         OperationType `json:"operation type"`
+	//user on the other side, only for transfers between users
+	Counterparty *int64 `json:"counterparty,omitempty"`
+	//id of operation in external service, order id given by caller
+	ExternalRef *string           `json:"external ref,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	//only for reversals, id of refunded operation
+	Reverses *string `json:"reverses,omitempty"`
 }
 
-func newTransfer(secondary int64, transferredAt time.Time, purpose string) (*Transfer, error) {
-	return &Transfer{secondary / 100, int8(secondary % 100), transferredAt, purpose}, nil
+//HistoryPage is part of user's history from newest to oldest transfer
+type HistoryPage struct {
+	Transfers []*Transfer `json:"transfers"`
+	//empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+//transfer is stored in currency of wallet it changed
+func newTransfer(transfer repository.Transfer) (*Transfer, error) {
+	units, err := currency.Get(transfer.Currency)
+	if err != nil {
+		return nil, wrap(ErrConvertCurrency, err)
+	}
+
+	primary, minor := units.Split(transfer.Amount)
+	return &Transfer{
+		OperationID:    transfer.OperationID,
+		PrimaryValue:   primary,
+		SecondaryValue: minor,
+		Currency:       units.Code,
+		TransferredAt:  transfer.TransferredAt,
+		Purpose:        transfer.Purpose,
+		OpType:         OperationType(transfer.OpType),
+		Counterparty:   transfer.Counterparty,
+		ExternalRef:    transfer.ExternalRef,
+		Metadata:       transfer.Metadata,
+		Reverses:       transfer.Reverses,
+	}, nil
 }